@@ -0,0 +1,69 @@
+package nsq
+
+import (
+	"net"
+	"path"
+	"strings"
+)
+
+// filterNSQDAddrs returns the discovered nsqd addresses allowed by
+// Config.NSQDAllowlist and Config.NSQDDenylist, in the same order
+func filterNSQDAddrs(config *Config, addrs []string) []string {
+	if len(config.NSQDAllowlist) == 0 && len(config.NSQDDenylist) == 0 {
+		return addrs
+	}
+	var allowed []string
+	for _, addr := range addrs {
+		if len(config.NSQDAllowlist) > 0 && !matchAnyAddress(config.NSQDAllowlist, addr) {
+			continue
+		}
+		if matchAnyAddress(config.NSQDDenylist, addr) {
+			continue
+		}
+		allowed = append(allowed, addr)
+	}
+	return allowed
+}
+
+func matchAnyAddress(patterns []string, addr string) bool {
+	for _, pattern := range patterns {
+		if matchAddress(pattern, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddress reports whether the "host:port" addr matches pattern, an
+// address, a CIDR or a glob (matched against the host only when it has no port)
+func matchAddress(pattern string, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	if strings.Contains(pattern, "/") {
+		_, ipNet, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ipNet.Contains(ip)
+	}
+
+	subject := addr
+	if _, _, err := net.SplitHostPort(pattern); err != nil {
+		subject = host
+	}
+	ok, _ := path.Match(pattern, subject)
+	return ok
+}
+
+func validateAddressPattern(pattern string) error {
+	if strings.Contains(pattern, "/") {
+		_, _, err := net.ParseCIDR(pattern)
+		return err
+	}
+	_, err := path.Match(pattern, "")
+	return err
+}
@@ -1,11 +1,14 @@
 package nsq
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -24,20 +27,69 @@ func (c *deadlinedConn) Write(b []byte) (n int, err error) {
 	return c.Conn.Write(b)
 }
 
-func newDeadlineTransport(timeout time.Duration) *http.Transport {
+func newDeadlineTransport(dialer Dialer, connectTimeout time.Duration, requestTimeout time.Duration) *http.Transport {
 	transport := &http.Transport{
 		DisableKeepAlives: true,
-		Dial: func(netw, addr string) (net.Conn, error) {
-			c, err := net.DialTimeout(netw, addr, timeout)
+		DialContext: func(ctx context.Context, netw, addr string) (net.Conn, error) {
+			if connectTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, connectTimeout)
+				defer cancel()
+			}
+			c, err := dialer.DialContext(ctx, netw, addr)
 			if err != nil {
 				return nil, err
 			}
-			return &deadlinedConn{timeout, c}, nil
+			return &deadlinedConn{requestTimeout, c}, nil
 		},
 	}
 	return transport
 }
 
+// newLookupdHTTPClient returns the client used to query nsqlookupd
+func newLookupdHTTPClient(config *Config) (*http.Client, error) {
+	if config.LookupdHTTPClient != nil {
+		return config.LookupdHTTPClient, nil
+	}
+	dialer, err := proxiedDialer(config.ProxyURL, &net.Dialer{})
+	if err != nil {
+		return nil, err
+	}
+	transport := newDeadlineTransport(dialer, config.DialTimeout, 2*time.Second)
+	transport.TLSClientConfig = config.LookupdTLSConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// lookupdHeaders returns the headers that authenticate a query to nsqlookupd
+func lookupdHeaders(config *Config) (http.Header, error) {
+	headers := make(http.Header)
+	switch {
+	case config.LookupdBasicAuth != "":
+		auth := base64.StdEncoding.EncodeToString([]byte(config.LookupdBasicAuth))
+		headers.Set("Authorization", "Basic "+auth)
+	case config.LookupdBearerToken != "":
+		headers.Set("Authorization", fmt.Sprintf("Bearer %s", config.LookupdBearerToken))
+	case config.LookupdAuthorization:
+		secret, err := config.authSecret()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get auth secret - %s", err)
+		}
+		if secret != "" {
+			headers.Set("Authorization", fmt.Sprintf("Bearer %s", secret))
+		}
+	}
+	return headers, nil
+}
+
+// redactEndpoint returns endpoint with any password replaced, for logging
+func redactEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	return u.Redacted()
+}
+
 type wrappedResp struct {
 	Status     string      `json:"status_txt"`
 	StatusCode int         `json:"status_code"`
@@ -45,8 +97,7 @@ type wrappedResp struct {
 }
 
 // stores the result in the value pointed to by ret(must be a pointer)
-func apiRequestNegotiateV1(method string, endpoint string, headers http.Header, ret interface{}) error {
-	httpclient := &http.Client{Transport: newDeadlineTransport(2 * time.Second)}
+func apiRequestNegotiateV1(httpclient *http.Client, method string, endpoint string, headers http.Header, ret interface{}) error {
 	req, err := http.NewRequest(method, endpoint, nil)
 	if err != nil {
 		return err
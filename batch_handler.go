@@ -0,0 +1,188 @@
+package nsq
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BatchHandler is the message processing interface for a Consumer handling
+// messages in batches (see AddBatchHandler), e.g. to write them in bulk
+//
+// When HandleMessages returns nil every message of the batch is FINished,
+// otherwise they are all REQueued (with backoff, unless the error is an
+// ErrRequeueWithoutBackoff), except for those it responded to itself.
+type BatchHandler interface {
+	HandleMessages(messages []*Message) error
+}
+
+// BatchHandlerFunc is a convenience type to avoid having to declare a struct
+// to implement the BatchHandler interface
+type BatchHandlerFunc func(messages []*Message) error
+
+// HandleMessages implements the BatchHandler interface
+func (h BatchHandlerFunc) HandleMessages(messages []*Message) error {
+	return h(messages)
+}
+
+// AddBatchHandler sets the BatchHandler for messages received by this
+// Consumer, which is called with up to maxSize messages at a time: once that
+// many were received, or linger after the first of them was.
+//
+// max_in_flight must be at least maxSize for batches to fill up, and linger
+// should be well below the msg_timeout. Config.RecoverHandlerPanics and
+// Config.HandlerTimeout apply to each call of the BatchHandler, requeueing
+// the whole batch.
+//
+// This panics if called after connecting to NSQD or NSQ Lookupd
+func (r *Consumer) AddBatchHandler(handler BatchHandler, maxSize int, linger time.Duration) {
+	if maxSize < 1 {
+		panic("maxSize must be at least 1")
+	}
+	h := &batchHandler{
+		r:        r,
+		handler:  handler,
+		maxSize:  maxSize,
+		linger:   linger,
+		messages: make(chan *Message),
+	}
+	// messages are handed to the batching goroutine by a single handler
+	r.AddHandler(h)
+	r.wg.Add(1)
+	go h.batchLoop()
+}
+
+// batchHandler accumulates messages for a BatchHandler, see AddBatchHandler
+type batchHandler struct {
+	r        *Consumer
+	handler  BatchHandler
+	maxSize  int
+	linger   time.Duration
+	messages chan *Message
+}
+
+func (h *batchHandler) HandleMessage(m *Message) error {
+	m.DisableAutoResponse()
+	select {
+	case h.messages <- m:
+	case <-h.r.exitChan:
+		// the Consumer exited without waiting for its handlers (see Stop),
+		// nsqd will requeue the message once it times out
+	}
+	return nil
+}
+
+func (h *batchHandler) batchLoop() {
+	var batch MessageBatch
+	var timer *time.Timer
+	var lingerChan <-chan time.Time
+
+	for {
+		select {
+		case m := <-h.messages:
+			batch.Add(m)
+			if batch.Len() == 1 {
+				timer = time.NewTimer(h.linger)
+				lingerChan = timer.C
+			}
+			if batch.Len() < h.maxSize {
+				continue
+			}
+			timer.Stop()
+		case <-lingerChan:
+		case <-h.r.exitChan:
+			goto exit
+		}
+		lingerChan = nil
+		h.flush(&batch)
+	}
+
+exit:
+	if timer != nil {
+		timer.Stop()
+	}
+	h.r.log(LogLevelInfo, "exiting batchLoop")
+	h.r.wg.Done()
+}
+
+// flush passes the batch to the BatchHandler and responds to its messages
+func (h *batchHandler) flush(batch *MessageBatch) {
+	messages := batch.Messages()
+	err := h.handleMessages(messages)
+	var requeue ErrRequeueWithoutBackoff
+	if errors.As(err, &requeue) {
+		h.r.log(LogLevelInfo, "Handler requeued a batch of %d msgs (%s)", len(messages), err)
+		batch.RequeueWithoutBackoff(requeue.Delay)
+		return
+	}
+	if err != nil {
+		h.r.log(LogLevelError, "Handler returned error (%s) for a batch of %d msgs", err, len(messages))
+		batch.Requeue(-1)
+		return
+	}
+	batch.Finish()
+}
+
+// handleMessages calls the BatchHandler like Consumer.handleMessage calls a
+// Handler, returning a recovered panic as an error (when enabled) and
+// requeueing the messages if it times out
+func (h *batchHandler) handleMessages(messages []*Message) (err error) {
+	r := h.r
+	if timeout := r.config.HandlerTimeout; timeout > 0 {
+		start := time.Now()
+		// a sync.Once so that the handler returning waits for the timer's requeue
+		var once sync.Once
+		onTimeout := func() {
+			once.Do(func() {
+				var requeued int
+				for _, m := range messages {
+					if !m.HasResponded() {
+						m.Requeue(-1)
+						requeued++
+					}
+				}
+				if requeued == 0 {
+					return
+				}
+				atomic.AddUint64(&r.handlerTimeouts, 1)
+				r.log(LogLevelWarning, "Handler timed out after %s for a batch of %d msgs, requeueing %d",
+					timeout, len(messages), requeued)
+			})
+		}
+		timer := time.AfterFunc(timeout, onTimeout)
+		defer func() {
+			timer.Stop()
+			// the handler may return before the timer fires
+			if time.Since(start) >= timeout {
+				onTimeout()
+			}
+		}()
+	}
+	if r.config.RecoverHandlerPanics {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			stack := debug.Stack()
+			atomic.AddUint64(&r.handlerPanics, 1)
+			r.log(LogLevelError, "Handler panicked for a batch of %d msgs - %v\n%s", len(messages), p, stack)
+
+			r.mtx.RLock()
+			f := r.panicHandler
+			r.mtx.RUnlock()
+			if f != nil {
+				for _, m := range messages {
+					f(m, p, stack)
+				}
+			}
+
+			// requeued by flush
+			err = fmt.Errorf("handler panic - %v", p)
+		}()
+	}
+	return h.handler.HandleMessages(messages)
+}
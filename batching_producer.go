@@ -0,0 +1,191 @@
+package nsq
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BatchingProducer is a high-level type that coalesces individual publishes
+// into MPUB commands to a single `nsqd`.
+//
+// Messages published to the same topic are buffered until their combined
+// size reaches maxBytes or the oldest of them has waited maxLinger,
+// whichever happens first, and are then sent with a single MultiPublish.
+// Because MPUB is atomic every message in a batch receives the same result.
+type BatchingProducer struct {
+	producer  *Producer
+	maxBytes  int
+	maxLinger time.Duration
+
+	mtx     sync.Mutex
+	batches map[string]*publishBatch
+
+	stopFlag int32
+	wg       sync.WaitGroup
+}
+
+type publishBatch struct {
+	topic   string
+	bodies  [][]byte
+	size    int
+	pending []*ProducerTransaction
+	timer   *time.Timer
+}
+
+// NewBatchingProducer returns an instance of BatchingProducer for the specified
+// address (see NewProducer), flushing a topic's batch once it holds maxBytes
+// of message bodies or has been open for maxLinger
+func NewBatchingProducer(addr string, config *Config, maxBytes int, maxLinger time.Duration) (*BatchingProducer, error) {
+	w, err := NewProducer(addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return newBatchingProducer(w, maxBytes, maxLinger), nil
+}
+
+func newBatchingProducer(w *Producer, maxBytes int, maxLinger time.Duration) *BatchingProducer {
+	return &BatchingProducer{
+		producer:  w,
+		maxBytes:  maxBytes,
+		maxLinger: maxLinger,
+		batches:   make(map[string]*publishBatch),
+	}
+}
+
+// Producer returns the underlying Producer (e.g. to configure logging)
+func (b *BatchingProducer) Producer() *Producer {
+	return b.producer
+}
+
+// Publish adds a message body to the batch for the specified topic and
+// waits until that batch has been published, returning its result
+func (b *BatchingProducer) Publish(topic string, body []byte) error {
+	doneChan := make(chan *ProducerTransaction, 1)
+	err := b.PublishAsync(topic, body, doneChan)
+	if err != nil {
+		return err
+	}
+	t := <-doneChan
+	return t.Error
+}
+
+// PublishAsync adds a message body to the batch for the specified topic
+// without waiting for it to be published.
+//
+// Once the batch has been published the supplied `doneChan` (if specified)
+// will receive a `ProducerTransaction` instance with the supplied variadic
+// arguments and the response error (of the batch) if present.
+func (b *BatchingProducer) PublishAsync(topic string, body []byte, doneChan chan *ProducerTransaction,
+	args ...interface{}) error {
+	t := &ProducerTransaction{
+		doneChan: doneChan,
+		Args:     args,
+	}
+
+	b.mtx.Lock()
+	if atomic.LoadInt32(&b.stopFlag) == 1 {
+		b.mtx.Unlock()
+		return ErrStopped
+	}
+	batch, ok := b.batches[topic]
+	if !ok {
+		batch = &publishBatch{topic: topic}
+		b.batches[topic] = batch
+		batch.timer = time.AfterFunc(b.maxLinger, func() {
+			b.mtx.Lock()
+			ok := b.takeLocked(batch)
+			b.mtx.Unlock()
+			if ok {
+				b.publish(batch)
+			}
+		})
+	}
+	batch.bodies = append(batch.bodies, body)
+	batch.size += len(body) + 4
+	batch.pending = append(batch.pending, t)
+	full := batch.size >= b.maxBytes && b.takeLocked(batch)
+	b.mtx.Unlock()
+
+	if full {
+		b.publish(batch)
+	}
+
+	return nil
+}
+
+// Flush publishes every buffered message without waiting for the
+// results (which are delivered as usual)
+func (b *BatchingProducer) Flush() {
+	for _, batch := range b.takeAll() {
+		b.publish(batch)
+	}
+}
+
+// Stop flushes any buffered messages, waits for their results
+// and then stops the underlying Producer (permanent)
+//
+// NOTE: this blocks until completion
+func (b *BatchingProducer) Stop() {
+	b.mtx.Lock()
+	if !atomic.CompareAndSwapInt32(&b.stopFlag, 0, 1) {
+		b.mtx.Unlock()
+		return
+	}
+	b.mtx.Unlock()
+	for _, batch := range b.takeAll() {
+		b.publish(batch)
+	}
+	b.wg.Wait()
+	b.producer.Stop()
+}
+
+// takeAll removes every buffered batch, to be published
+func (b *BatchingProducer) takeAll() []*publishBatch {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	batches := make([]*publishBatch, 0, len(b.batches))
+	for _, batch := range b.batches {
+		if b.takeLocked(batch) {
+			batches = append(batches, batch)
+		}
+	}
+	return batches
+}
+
+// takeLocked removes batch, to be published by the caller (once b.mtx is
+// released, so that publishing does not block PublishAsync), returning
+// false if it has already been taken, b.mtx must be held
+func (b *BatchingProducer) takeLocked(batch *publishBatch) bool {
+	if b.batches[batch.topic] != batch {
+		return false
+	}
+	delete(b.batches, batch.topic)
+	batch.timer.Stop()
+	b.wg.Add(1)
+	return true
+}
+
+// publish sends a batch removed by takeLocked
+func (b *BatchingProducer) publish(batch *publishBatch) {
+	doneChan := make(chan *ProducerTransaction, 1)
+	err := b.producer.MultiPublishAsync(batch.topic, batch.bodies, doneChan)
+	if err != nil {
+		b.producer.log(LogLevelError, "failed to publish batch of %d messages to %s - %s",
+			len(batch.bodies), batch.topic, err)
+		go b.finishBatch(batch, err)
+		return
+	}
+	go func() {
+		t := <-doneChan
+		b.finishBatch(batch, t.Error)
+	}()
+}
+
+func (b *BatchingProducer) finishBatch(batch *publishBatch, err error) {
+	for _, t := range batch.pending {
+		t.Error = err
+		t.finish()
+	}
+	b.wg.Done()
+}
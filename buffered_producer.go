@@ -0,0 +1,163 @@
+package nsq
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BufferedProducer is a high-level type that publishes to a single `nsqd`
+// without flushing each publish to the network.
+//
+// Published messages are appended to the connection's write buffer, which is
+// only flushed when Flush is called, when Config.OutputBufferTimeout has
+// elapsed since the first message was buffered (when non-zero) or when it
+// fills up. Flush also waits for (and returns) the result of every message
+// published since the previous Flush, making it an explicit durability point.
+type BufferedProducer struct {
+	producer *Producer
+	timeout  time.Duration
+
+	mtx     sync.Mutex
+	pending []chan *ProducerTransaction
+	timer   *time.Timer
+
+	stopFlag int32
+}
+
+// NewBufferedProducer returns an instance of BufferedProducer for the
+// specified address (see NewProducer)
+func NewBufferedProducer(addr string, config *Config) (*BufferedProducer, error) {
+	w, err := NewProducer(addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return newBufferedProducer(w), nil
+}
+
+func newBufferedProducer(w *Producer) *BufferedProducer {
+	return &BufferedProducer{
+		producer: w,
+		timeout:  w.config.OutputBufferTimeout,
+	}
+}
+
+// Producer returns the underlying Producer (e.g. to configure logging)
+func (b *BufferedProducer) Producer() *Producer {
+	return b.producer
+}
+
+// Publish appends a message body for the specified topic to the write buffer,
+// returning an error if it could not be (e.g. when unable to connect).
+//
+// Its result is returned by the next Flush.
+func (b *BufferedProducer) Publish(topic string, body []byte) error {
+	return b.send(Publish(topic, body))
+}
+
+// MultiPublish appends a message body for each of bodies (published atomically,
+// see Producer.MultiPublish) to the write buffer, returning an error if they
+// could not be.
+//
+// Their (single) result is returned by the next Flush.
+func (b *BufferedProducer) MultiPublish(topic string, bodies [][]byte) error {
+	cmd, err := MultiPublish(topic, bodies)
+	if err != nil {
+		return err
+	}
+	return b.send(cmd)
+}
+
+func (b *BufferedProducer) send(cmd *Command) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if atomic.LoadInt32(&b.stopFlag) == 1 {
+		return ErrStopped
+	}
+	doneChan := make(chan *ProducerTransaction, 1)
+	t := &ProducerTransaction{
+		cmd:      cmd,
+		buffered: true,
+		doneChan: doneChan,
+	}
+	err := b.producer.sendTransaction(context.Background(), t)
+	if err != nil {
+		return err
+	}
+	b.pending = append(b.pending, doneChan)
+	if b.timer == nil && b.timeout > 0 {
+		b.timer = time.AfterFunc(b.timeout, b.flushBuffer)
+	}
+	return nil
+}
+
+// flushBuffer flushes the write buffer without waiting for the results
+func (b *BufferedProducer) flushBuffer() {
+	b.mtx.Lock()
+	b.timer = nil
+	b.mtx.Unlock()
+
+	if err := b.producer.flushCommands(); err != nil {
+		b.producer.log(LogLevelError, "failed to flush buffered publishes - %s", err)
+	}
+}
+
+// Flush flushes the write buffer and waits for the result of each publish
+// (i.e. each call to Publish or MultiPublish) since the previous Flush,
+// returning them in the same order
+//
+// NOTE: this blocks until completion
+func (b *BufferedProducer) Flush() []error {
+	b.mtx.Lock()
+	pending := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mtx.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	// a failed flush closes the connection, failing the pending publishes
+	b.producer.flushCommands()
+
+	errs := make([]error, len(pending))
+	for i, doneChan := range pending {
+		t := <-doneChan
+		errs[i] = t.Error
+	}
+	return errs
+}
+
+// Stop flushes any buffered messages, waits for their results (which are
+// returned, see Flush) and then stops the underlying Producer (permanent)
+//
+// NOTE: this blocks until completion
+func (b *BufferedProducer) Stop() []error {
+	b.mtx.Lock()
+	if !atomic.CompareAndSwapInt32(&b.stopFlag, 0, 1) {
+		b.mtx.Unlock()
+		return nil
+	}
+	b.mtx.Unlock()
+
+	errs := b.Flush()
+	b.producer.Stop()
+	return errs
+}
+
+// flushCommands flushes the commands written (but not flushed) to the
+// connection, in order with other commands
+func (w *Producer) flushCommands() error {
+	doneChan := make(chan *ProducerTransaction, 1)
+	err := w.sendTransaction(context.Background(), &ProducerTransaction{doneChan: doneChan})
+	if err != nil {
+		return err
+	}
+	t := <-doneChan
+	return t.Error
+}
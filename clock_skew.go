@@ -0,0 +1,59 @@
+package nsq
+
+import (
+	"time"
+)
+
+// clockSkew measures the skew of the clock of an nsqd from the timestamps of
+// its messages, see Config.ClockSkewThreshold
+type clockSkew struct {
+	samples int
+	min     time.Duration
+	skewed  bool
+}
+
+// add records the offset of a message, returning the smallest offset of the
+// last samples messages once that many were recorded
+func (s *clockSkew) add(offset time.Duration, samples int) (time.Duration, bool) {
+	if s.samples == 0 || offset < s.min {
+		s.min = offset
+	}
+	s.samples++
+	if s.samples < samples {
+		return 0, false
+	}
+	s.samples = 0
+	return s.min, true
+}
+
+// checkClockSkew measures the clock skew of the nsqd of c with msg, reporting
+// it when it starts or stops exceeding Config.ClockSkewThreshold.
+//
+// Only the first attempt of a message is measured, a requeued message keeping
+// the timestamp of its original publish.
+func (r *Consumer) checkClockSkew(c *Conn, msg *Message) {
+	threshold := r.config.ClockSkewThreshold
+	if threshold <= 0 || msg.Attempts > 1 {
+		return
+	}
+
+	skew, ok := c.clockSkew.add(msg.ReceivedAt.Sub(msg.Time()), r.config.ClockSkewSamples)
+	if !ok {
+		return
+	}
+	skewed := skew > threshold || skew < -threshold
+	if skewed == c.clockSkew.skewed {
+		return
+	}
+	c.clockSkew.skewed = skewed
+
+	if !skewed {
+		r.log(LogLevelInfo, "(%s) message timestamps are no longer skewed from local time", c.String())
+		return
+	}
+	r.log(LogLevelWarning, "(%s) message timestamps are skewed from local time by %s, check the clocks (NTP) of nsqd and this host",
+		c.String(), skew)
+	if f := r.getHooks().OnClockSkew; f != nil {
+		f(c.String(), skew)
+	}
+}
@@ -142,7 +142,13 @@ func DeferredPublish(topic string, delay time.Duration, body []byte) *Command {
 
 // MultiPublish creates a new Command to write more than one message to a given topic
 // (useful for high-throughput situations to avoid roundtrips and saturate the pipe)
+//
+// At least one body is required (nsqd rejects an empty MPUB).
 func MultiPublish(topic string, bodies [][]byte) (*Command, error) {
+	if len(bodies) == 0 {
+		return nil, fmt.Errorf("MPUB requires at least one message body")
+	}
+
 	var params = [][]byte{[]byte(topic)}
 
 	num := uint32(len(bodies))
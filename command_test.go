@@ -16,3 +16,25 @@ func BenchmarkCommand(b *testing.B) {
 		cmd.WriteTo(&buf)
 	}
 }
+
+func TestMultiPublishCommand(t *testing.T) {
+	_, err := MultiPublish("test", nil)
+	if err == nil {
+		t.Fatal("expected error for MPUB without bodies")
+	}
+
+	cmd, err := MultiPublish("test", [][]byte{[]byte("a"), []byte("bc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	cmd.WriteTo(&buf)
+	expected := "MPUB test\n" +
+		"\x00\x00\x00\x0f" + // body size
+		"\x00\x00\x00\x02" + // message count
+		"\x00\x00\x00\x01a" +
+		"\x00\x00\x00\x02bc"
+	if buf.String() != expected {
+		t.Fatalf("MPUB %q != %q", buf.String(), expected)
+	}
+}
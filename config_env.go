@@ -0,0 +1,49 @@
+package nsq
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// LoadFromEnv sets every option for which a corresponding environment
+// variable is present, following the rules in Config.Set.
+//
+// The variable name for an option is the upper-cased option name, joined
+// to prefix (if non-empty) with an underscore, e.g. with the prefix "NSQ"
+// the option read_timeout is read from NSQ_READ_TIMEOUT.
+//
+// Options that cannot be expressed as a string (such as tls_config) are skipped.
+func (c *Config) LoadFromEnv(prefix string) error {
+	c.assertInitialized()
+	for _, opt := range textOptions() {
+		name := strings.ToUpper(opt)
+		if prefix != "" {
+			name = strings.ToUpper(strings.TrimSuffix(prefix, "_")) + "_" + name
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := c.Set(opt, value); err != nil {
+			return fmt.Errorf("failed to set option %s from %s - %s", opt, name, err)
+		}
+	}
+	return nil
+}
+
+// textOptions returns the name of every option that can be set from a string
+func textOptions() []string {
+	var opts []string
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		opt := field.Tag.Get("opt")
+		if opt == "" || field.Type.Kind() == reflect.Ptr || opt == "dialer" {
+			continue
+		}
+		opts = append(opts, opt)
+	}
+	return append(opts, tlsOptions...)
+}
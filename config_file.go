@@ -0,0 +1,66 @@
+package nsq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// NewConfigFromFile returns a new nsq configuration initialized with
+// defaults and then updated with the options found in the JSON document
+// at the supplied path.
+//
+// The document must be an object whose keys are the option names accepted
+// by Config.Set, for example:
+//
+// 	{
+// 		"max_in_flight": 200,
+// 		"read_timeout": "30s",
+// 		"tls_v1": true
+// 	}
+//
+// Values are coerced following the same rules as Config.Set (numbers
+// for durations are interpreted as milliseconds).
+func NewConfigFromFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := decodeConfigJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s - %s", path, err)
+	}
+
+	c := NewConfig()
+	if err := c.SetMany(opts); err != nil {
+		return nil, fmt.Errorf("config file %s - %s", path, err)
+	}
+	return c, nil
+}
+
+// decodeConfigJSON unmarshals a JSON object of options, converting numbers
+// into int64 (or float64 when fractional) so that they coerce cleanly
+func decodeConfigJSON(data []byte) (map[string]interface{}, error) {
+	var opts map[string]interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&opts); err != nil {
+		return nil, err
+	}
+
+	for k, v := range opts {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		if i, err := n.Int64(); err == nil {
+			opts[k] = i
+		} else if f, err := n.Float64(); err == nil {
+			opts[k] = f
+		}
+	}
+	return opts, nil
+}
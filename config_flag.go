@@ -1,6 +1,7 @@
 package nsq
 
 import (
+	"flag"
 	"strings"
 )
 
@@ -9,10 +10,18 @@ type ConfigFlag struct {
 	Config *Config
 }
 
-// Set takes a comma separated value and follows the rules in Config.Set
+// Set takes a comma (or equals) separated value and follows the rules in Config.Set
 // using the first field as the option key, and the second (if present) as the value
+//
+// e.g. "max_in_flight,200" and "max_in_flight=200" are equivalent
 func (c *ConfigFlag) Set(opt string) (err error) {
-	parts := strings.SplitN(opt, ",", 2)
+	sep := ","
+	if eq := strings.Index(opt, "="); eq >= 0 {
+		if comma := strings.Index(opt, ","); comma == -1 || eq < comma {
+			sep = "="
+		}
+	}
+	parts := strings.SplitN(opt, sep, 2)
 	key := parts[0]
 
 	switch len(parts) {
@@ -29,3 +38,49 @@ func (c *ConfigFlag) Set(opt string) (err error) {
 func (c *ConfigFlag) String() string {
 	return ""
 }
+
+// RegisterFlags defines a flag on fs for every option that can be set
+// from a string, named after the option and prefixed by prefix (e.g. with
+// the prefix "nsq-" the option max_in_flight becomes -nsq-max_in_flight).
+//
+// Values are applied to c following the rules in Config.Set as the flags
+// are parsed, and boolean options may be given without a value.
+//
+// To expose every option through a single repeatable flag instead, see ConfigFlag.
+func (c *Config) RegisterFlags(fs *flag.FlagSet, prefix string) {
+	c.assertInitialized()
+	for _, opt := range textOptions() {
+		fs.Var(&optionFlag{config: c, option: opt}, prefix+opt,
+			"nsq client option "+opt+" (see nsq.Config)")
+	}
+}
+
+// optionFlag implements flag.Value for a single Config option
+type optionFlag struct {
+	config *Config
+	option string
+}
+
+func (f *optionFlag) Set(value string) error {
+	return f.config.Set(f.option, value)
+}
+
+func (f *optionFlag) String() string {
+	if f.config == nil {
+		return ""
+	}
+	v, ok := f.config.Map()[f.option]
+	if !ok || v == nil {
+		return ""
+	}
+	return formatOptionValue(v)
+}
+
+// IsBoolFlag allows boolean options to be given without a value
+func (f *optionFlag) IsBoolFlag() bool {
+	if f.option == "tls_insecure_skip_verify" {
+		return true
+	}
+	_, ok := f.config.Map()[f.option].(bool)
+	return ok
+}
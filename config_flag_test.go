@@ -2,6 +2,9 @@ package nsq_test
 
 import (
 	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
 
 	"github.com/nsqio/go-nsq"
 )
@@ -23,3 +26,67 @@ func ExampleConfigFlag() {
 	println("HeartbeatInterval", cfg.HeartbeatInterval)
 	println("MaxAttempts", cfg.MaxAttempts)
 }
+
+func TestConfigFlagKeyValue(t *testing.T) {
+	cfg := nsq.NewConfig()
+	flagSet := flag.NewFlagSet("", flag.ContinueOnError)
+	flagSet.Var(&nsq.ConfigFlag{cfg}, "consumer-opt", "")
+
+	err := flagSet.Parse([]string{
+		"--consumer-opt=max_in_flight=200",
+		"--consumer-opt=auth_secret,a=b",
+		"--consumer-opt=snappy",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxInFlight != 200 {
+		t.Errorf("max_in_flight %d != 200", cfg.MaxInFlight)
+	}
+	if cfg.AuthSecret != "a=b" {
+		t.Errorf("auth_secret %q != %q", cfg.AuthSecret, "a=b")
+	}
+	if !cfg.Snappy {
+		t.Errorf("snappy not enabled")
+	}
+}
+
+func TestConfigRegisterFlags(t *testing.T) {
+	cfg := nsq.NewConfig()
+	flagSet := flag.NewFlagSet("", flag.ContinueOnError)
+	flagSet.SetOutput(ioutil.Discard)
+	cfg.RegisterFlags(flagSet, "nsq-")
+
+	if f := flagSet.Lookup("nsq-read_timeout"); f == nil || f.DefValue != "1m0s" {
+		t.Fatalf("read_timeout flag not registered with its default - %v", f)
+	}
+	if flagSet.Lookup("nsq-tls_config") != nil {
+		t.Errorf("tls_config should not be registered as a flag")
+	}
+
+	err := flagSet.Parse([]string{
+		"-nsq-read_timeout=30s",
+		"-nsq-max_in_flight", "50",
+		"-nsq-deflate",
+		"-nsq-tls_min_version=tls1.2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ReadTimeout != 30*time.Second {
+		t.Errorf("read_timeout %s != 30s", cfg.ReadTimeout)
+	}
+	if cfg.MaxInFlight != 50 {
+		t.Errorf("max_in_flight %d != 50", cfg.MaxInFlight)
+	}
+	if !cfg.Deflate {
+		t.Errorf("deflate not enabled")
+	}
+	if cfg.TlsConfig == nil {
+		t.Errorf("tls_min_version not applied")
+	}
+
+	if err := flagSet.Parse([]string{"-nsq-max_in_flight=-1"}); err == nil {
+		t.Errorf("expected error for out of range max_in_flight")
+	}
+}
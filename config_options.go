@@ -0,0 +1,328 @@
+package nsq
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Option is a typed modifier of a Config, for use with NewConfigWith.
+//
+// It is the compile-time checked alternative to Config.Set
+type Option func(c *Config) error
+
+// NewConfigWith returns a new default nsq configuration, with the supplied
+// options applied in order.
+//
+// The resulting Config is validated (see Config.Validate) before being returned.
+func NewConfigWith(opts ...Option) (*Config, error) {
+	c := NewConfig()
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// WithDialTimeout sets dial_timeout
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *Config) error {
+		c.DialTimeout = d
+		return nil
+	}
+}
+
+// WithReadTimeout sets read_timeout
+func WithReadTimeout(d time.Duration) Option {
+	return func(c *Config) error {
+		c.ReadTimeout = d
+		return nil
+	}
+}
+
+// WithWriteTimeout sets write_timeout
+func WithWriteTimeout(d time.Duration) Option {
+	return func(c *Config) error {
+		c.WriteTimeout = d
+		return nil
+	}
+}
+
+// WithLocalAddr sets local_addr
+func WithLocalAddr(addr net.Addr) Option {
+	return func(c *Config) error {
+		c.LocalAddr = addr
+		return nil
+	}
+}
+
+// WithDialer sets dialer
+func WithDialer(d Dialer) Option {
+	return func(c *Config) error {
+		c.Dialer = d
+		return nil
+	}
+}
+
+// WithProxyURL sets proxy_url
+func WithProxyURL(proxyURL string) Option {
+	return func(c *Config) error {
+		c.ProxyURL = proxyURL
+		return nil
+	}
+}
+
+// WithLookupdPollInterval sets lookupd_poll_interval
+func WithLookupdPollInterval(d time.Duration) Option {
+	return func(c *Config) error {
+		c.LookupdPollInterval = d
+		return nil
+	}
+}
+
+// WithLookupdPollJitter sets lookupd_poll_jitter
+func WithLookupdPollJitter(jitter float64) Option {
+	return func(c *Config) error {
+		c.LookupdPollJitter = jitter
+		return nil
+	}
+}
+
+// WithLookupdBasicAuth sets lookupd_basic_auth
+func WithLookupdBasicAuth(user string, password string) Option {
+	return func(c *Config) error {
+		c.LookupdBasicAuth = user + ":" + password
+		return nil
+	}
+}
+
+// WithLookupdBearerToken sets lookupd_bearer_token
+func WithLookupdBearerToken(token string) Option {
+	return func(c *Config) error {
+		c.LookupdBearerToken = token
+		return nil
+	}
+}
+
+// WithLookupdTLS sets lookupd_tls_config
+func WithLookupdTLS(tlsConf *tls.Config) Option {
+	return func(c *Config) error {
+		c.LookupdTLSConfig = tlsConf
+		return nil
+	}
+}
+
+// WithLookupdHTTPClient sets lookupd_http_client
+func WithLookupdHTTPClient(client *http.Client) Option {
+	return func(c *Config) error {
+		c.LookupdHTTPClient = client
+		return nil
+	}
+}
+
+// WithRequeueDelay sets default_requeue_delay and max_requeue_delay
+func WithRequeueDelay(defaultDelay time.Duration, maxDelay time.Duration) Option {
+	return func(c *Config) error {
+		c.DefaultRequeueDelay = defaultDelay
+		c.MaxRequeueDelay = maxDelay
+		return nil
+	}
+}
+
+// WithRequeueDelayStrategy sets requeue_delay_strategy
+func WithRequeueDelayStrategy(s RequeueDelayStrategy) Option {
+	return func(c *Config) error {
+		c.RequeueDelayStrategy = s
+		return nil
+	}
+}
+
+// WithBackoffStrategy sets backoff_strategy
+func WithBackoffStrategy(s BackoffStrategy) Option {
+	return func(c *Config) error {
+		return c.Set("backoff_strategy", s)
+	}
+}
+
+// WithMaxBackoffDuration sets max_backoff_duration
+func WithMaxBackoffDuration(d time.Duration) Option {
+	return func(c *Config) error {
+		c.MaxBackoffDuration = d
+		return nil
+	}
+}
+
+// WithBackoffMultiplier sets backoff_multiplier
+func WithBackoffMultiplier(d time.Duration) Option {
+	return func(c *Config) error {
+		c.BackoffMultiplier = d
+		return nil
+	}
+}
+
+// WithBackoffJitter sets backoff_jitter
+func WithBackoffJitter(jitter float64) Option {
+	return func(c *Config) error {
+		c.BackoffJitter = jitter
+		return nil
+	}
+}
+
+// WithMaxAttempts sets max_attempts
+func WithMaxAttempts(attempts uint16) Option {
+	return func(c *Config) error {
+		c.MaxAttempts = attempts
+		return nil
+	}
+}
+
+// WithHealthCheckInterval sets health_check_interval
+func WithHealthCheckInterval(d time.Duration) Option {
+	return func(c *Config) error {
+		c.HealthCheckInterval = d
+		return nil
+	}
+}
+
+// WithPublishRetry sets publish_max_attempts, publish_retry_backoff
+// and publish_max_retry_backoff
+func WithPublishRetry(maxAttempts uint16, backoff time.Duration, maxBackoff time.Duration) Option {
+	return func(c *Config) error {
+		c.PublishMaxAttempts = maxAttempts
+		c.PublishRetryBackoff = backoff
+		c.PublishMaxRetryBackoff = maxBackoff
+		return nil
+	}
+}
+
+// WithReconnectBackoff sets reconnect_backoff and max_reconnect_backoff
+func WithReconnectBackoff(backoff time.Duration, maxBackoff time.Duration) Option {
+	return func(c *Config) error {
+		c.ReconnectBackoff = backoff
+		c.MaxReconnectBackoff = maxBackoff
+		return nil
+	}
+}
+
+// WithPublishRateLimit sets publish_rate_limit, publish_byte_rate_limit
+// and publish_rate_limit_fail_fast
+func WithPublishRateLimit(msgsPerSec float64, bytesPerSec float64, failFast bool) Option {
+	return func(c *Config) error {
+		c.PublishRateLimit = msgsPerSec
+		c.PublishByteRateLimit = bytesPerSec
+		c.PublishRateLimitFailFast = failFast
+		return nil
+	}
+}
+
+// WithClientID sets client_id
+func WithClientID(id string) Option {
+	return func(c *Config) error {
+		c.ClientID = id
+		return nil
+	}
+}
+
+// WithHostname sets hostname
+func WithHostname(hostname string) Option {
+	return func(c *Config) error {
+		c.Hostname = hostname
+		return nil
+	}
+}
+
+// WithUserAgent sets user_agent
+func WithUserAgent(userAgent string) Option {
+	return func(c *Config) error {
+		c.UserAgent = userAgent
+		return nil
+	}
+}
+
+// WithHeartbeatInterval sets heartbeat_interval
+func WithHeartbeatInterval(d time.Duration) Option {
+	return func(c *Config) error {
+		c.HeartbeatInterval = d
+		return nil
+	}
+}
+
+// WithSampleRate sets sample_rate
+func WithSampleRate(rate int32) Option {
+	return func(c *Config) error {
+		c.SampleRate = rate
+		return nil
+	}
+}
+
+// WithTLS enables tls_v1 and sets tls_config
+func WithTLS(tlsConf *tls.Config) Option {
+	return func(c *Config) error {
+		c.TlsV1 = true
+		c.TlsConfig = tlsConf
+		return nil
+	}
+}
+
+// WithDeflate enables deflate and sets deflate_level
+func WithDeflate(level int) Option {
+	return func(c *Config) error {
+		c.Deflate = true
+		c.DeflateLevel = level
+		return nil
+	}
+}
+
+// WithSnappy enables snappy
+func WithSnappy() Option {
+	return func(c *Config) error {
+		c.Snappy = true
+		return nil
+	}
+}
+
+// WithOutputBuffer sets output_buffer_size and output_buffer_timeout
+func WithOutputBuffer(size int64, timeout time.Duration) Option {
+	return func(c *Config) error {
+		c.OutputBufferSize = size
+		c.OutputBufferTimeout = timeout
+		return nil
+	}
+}
+
+// WithMaxInFlight sets max_in_flight
+func WithMaxInFlight(n int) Option {
+	return func(c *Config) error {
+		c.MaxInFlight = n
+		return nil
+	}
+}
+
+// WithMsgTimeout sets msg_timeout
+func WithMsgTimeout(d time.Duration) Option {
+	return func(c *Config) error {
+		c.MsgTimeout = d
+		return nil
+	}
+}
+
+// WithAuthSecretProvider sets AuthSecretProvider
+func WithAuthSecretProvider(provider func() (string, error)) Option {
+	return func(c *Config) error {
+		c.AuthSecretProvider = provider
+		return nil
+	}
+}
+
+// WithAuthSecret sets auth_secret
+func WithAuthSecret(secret string) Option {
+	return func(c *Config) error {
+		c.AuthSecret = secret
+		return nil
+	}
+}
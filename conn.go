@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"compress/flate"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -26,6 +27,7 @@ type IdentifyResponse struct {
 	Deflate      bool  `json:"deflate"`
 	Snappy       bool  `json:"snappy"`
 	AuthRequired bool  `json:"auth_required"`
+	MsgTimeout   int64 `json:"msg_timeout"` // milliseconds
 }
 
 // AuthResponse represents the metadata
@@ -57,18 +59,27 @@ type Conn struct {
 
 	mtx sync.Mutex
 
+	id     int64
 	config *Config
 
-	conn    *net.TCPConn
+	conn    net.Conn
 	tlsConn *tls.Conn
 	addr    string
 
+	// the server-side message timeout (0 when unknown)
+	msgTimeout time.Duration
+
+	// measured by the Consumer from readLoop (see Config.ClockSkewThreshold)
+	clockSkew clockSkew
+
 	delegate ConnDelegate
 
-	logger   []logger
-	logLvl   LogLevel
-	logFmt   []string
-	logGuard sync.RWMutex
+	logger           []logger
+	structuredLogger StructuredLogger
+	logKeyvals       []interface{}
+	logLvl           LogLevel
+	logFmt           []string
+	logGuard         sync.RWMutex
 
 	r io.Reader
 	w io.Writer
@@ -85,12 +96,15 @@ type Conn struct {
 	readLoopRunning int32
 }
 
+var connCount int64
+
 // NewConn returns a new Conn instance
 func NewConn(addr string, config *Config, delegate ConnDelegate) *Conn {
 	if !config.initialized {
 		panic("Config must be created with NewConfig()")
 	}
 	return &Conn{
+		id:   atomic.AddInt64(&connCount, 1),
 		addr: addr,
 
 		config:   config,
@@ -171,16 +185,29 @@ func (c *Conn) getLogLevel() LogLevel {
 // Connect dials and bootstraps the nsqd connection
 // (including IDENTIFY) and returns the IdentifyResponse
 func (c *Conn) Connect() (*IdentifyResponse, error) {
-	dialer := &net.Dialer{
-		LocalAddr: c.config.LocalAddr,
-		Timeout:   c.config.DialTimeout,
+	dialer := c.config.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{
+			LocalAddr: c.config.LocalAddr,
+		}
+	}
+	dialer, err := proxiedDialer(c.config.ProxyURL, dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if c.config.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.DialTimeout)
+		defer cancel()
 	}
 
-	conn, err := dialer.Dial("tcp", c.addr)
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
 	if err != nil {
 		return nil, err
 	}
-	c.conn = conn.(*net.TCPConn)
+	c.conn = conn
 	c.r = conn
 	c.w = conn
 
@@ -196,11 +223,16 @@ func (c *Conn) Connect() (*IdentifyResponse, error) {
 	}
 
 	if resp != nil && resp.AuthRequired {
-		if c.config.AuthSecret == "" {
+		secret, err := c.config.authSecret()
+		if err != nil {
+			c.log(LogLevelError, "Auth Failed %s", err)
+			return nil, fmt.Errorf("failed to get auth secret - %s", err)
+		}
+		if secret == "" {
 			c.log(LogLevelError, "Auth Required")
 			return nil, errors.New("Auth Required")
 		}
-		err := c.auth(c.config.AuthSecret)
+		err = c.auth(secret)
 		if err != nil {
 			c.log(LogLevelError, "Auth Failed %s", err)
 			return nil, err
@@ -218,11 +250,36 @@ func (c *Conn) Connect() (*IdentifyResponse, error) {
 func (c *Conn) Close() error {
 	atomic.StoreInt32(&c.closeFlag, 1)
 	if c.conn != nil && atomic.LoadInt64(&c.messagesInFlight) == 0 {
-		return c.conn.CloseRead()
+		return c.closeRead()
 	}
 	return nil
 }
 
+// closeRead shuts down the reading side of the underlying connection,
+// unblocking readLoop while still allowing pending writes to complete.
+//
+// Connections returned by a custom Dialer that cannot half-close
+// are unblocked with an expired read deadline instead.
+func (c *Conn) closeRead() error {
+	if hc, ok := c.conn.(interface {
+		CloseRead() error
+	}); ok {
+		return hc.CloseRead()
+	}
+	return c.conn.SetReadDeadline(time.Now())
+}
+
+// closeWrite shuts down the writing side of the underlying connection,
+// falling back to a full close when half-close is not supported
+func (c *Conn) closeWrite() error {
+	if hc, ok := c.conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return hc.CloseWrite()
+	}
+	return c.conn.Close()
+}
+
 // IsClosing indicates whether or not the
 // connection is currently in the processing of
 // gracefully closing
@@ -276,6 +333,12 @@ func (c *Conn) String() string {
 	return c.addr
 }
 
+// ID returns an identifier of the connection, unique within the process (a
+// reconnection to the same nsqd is a new Conn with another ID)
+func (c *Conn) ID() int64 {
+	return c.id
+}
+
 // Read performs a deadlined read on the underlying TCP connection
 func (c *Conn) Read(p []byte) (int, error) {
 	c.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
@@ -308,6 +371,32 @@ exit:
 	return err
 }
 
+// WriteCommandBuffered is a goroutine safe method to write a Command
+// to this connection's write buffer, without flushing it
+// (see FlushCommands)
+func (c *Conn) WriteCommandBuffered(cmd *Command) error {
+	c.mtx.Lock()
+	_, err := cmd.WriteTo(c)
+	c.mtx.Unlock()
+	if err != nil {
+		c.log(LogLevelError, "IO error - %s", err)
+		c.delegate.OnIOError(c, err)
+	}
+	return err
+}
+
+// FlushCommands is a goroutine safe Flush
+func (c *Conn) FlushCommands() error {
+	c.mtx.Lock()
+	err := c.Flush()
+	c.mtx.Unlock()
+	if err != nil {
+		c.log(LogLevelError, "IO error - %s", err)
+		c.delegate.OnIOError(c, err)
+	}
+	return err
+}
+
 type flusher interface {
 	Flush() error
 }
@@ -345,6 +434,11 @@ func (c *Conn) identify() (*IdentifyResponse, error) {
 		ci["output_buffer_timeout"] = int64(c.config.OutputBufferTimeout / time.Millisecond)
 	}
 	ci["msg_timeout"] = int64(c.config.MsgTimeout / time.Millisecond)
+	for k, v := range c.config.identifyExtra {
+		if _, ok := ci[k]; !ok {
+			ci[k] = v
+		}
+	}
 	cmd, err := Identify(ci)
 	if err != nil {
 		return nil, ErrIdentify{err.Error()}
@@ -379,6 +473,7 @@ func (c *Conn) identify() (*IdentifyResponse, error) {
 	c.log(LogLevelDebug, "IDENTIFY response: %+v", resp)
 
 	c.maxRdyCount = resp.MaxRdyCount
+	c.msgTimeout = time.Duration(resp.MsgTimeout) * time.Millisecond
 
 	if resp.TLSv1 {
 		c.log(LogLevelInfo, "upgrading to TLS")
@@ -518,9 +613,9 @@ func (c *Conn) readLoop() {
 			goto exit
 		}
 
-		frameType, data, err := ReadUnpackedResponse(c)
+		frameType, data, buf, err := c.readFrame()
 		if err != nil {
-			if err == io.EOF && atomic.LoadInt32(&c.closeFlag) == 1 {
+			if atomic.LoadInt32(&c.closeFlag) == 1 && (err == io.EOF || isTimeout(err)) {
 				goto exit
 			}
 			if !strings.Contains(err.Error(), "use of closed network connection") {
@@ -546,17 +641,24 @@ func (c *Conn) readLoop() {
 		case FrameTypeResponse:
 			c.delegate.OnResponse(c, data)
 		case FrameTypeMessage:
-			msg, err := DecodeMessage(data)
+			msg, err := c.decodeMessage(data, buf)
 			if err != nil {
 				c.log(LogLevelError, "IO error - %s", err)
 				c.delegate.OnIOError(c, err)
 				goto exit
 			}
+			now := time.Now()
 			msg.Delegate = delegate
 			msg.NSQDAddress = c.String()
+			msg.ConnID = c.id
+			msg.ReceivedAt = now
+			if c.msgTimeout > 0 {
+				msg.msgTimeout = c.msgTimeout
+				msg.timeoutAt = now.Add(c.msgTimeout)
+			}
 
 			atomic.AddInt64(&c.messagesInFlight, 1)
-			atomic.StoreInt64(&c.lastMsgTimestamp, time.Now().UnixNano())
+			atomic.StoreInt64(&c.lastMsgTimestamp, now.UnixNano())
 
 			c.delegate.OnMessage(c, msg)
 		case FrameTypeError:
@@ -584,6 +686,51 @@ exit:
 	c.log(LogLevelInfo, "readLoop exiting")
 }
 
+// readFrame reads the next frame, into a pooled buffer when
+// Config.PoolMessages is set, which is returned along with the data of
+// message frames (i.e. owned by the message decoded from it)
+func (c *Conn) readFrame() (int32, []byte, *[]byte, error) {
+	if !c.config.PoolMessages {
+		frameType, data, err := ReadUnpackedResponse(c)
+		return frameType, data, nil, err
+	}
+
+	buf := bufferPool.Get().(*[]byte)
+	resp, err := ReadResponseInto(c, *buf)
+	if err != nil {
+		bufferPool.Put(buf)
+		return -1, nil, nil, err
+	}
+	*buf = resp
+
+	frameType, data, err := UnpackResponse(resp)
+	if err != nil || frameType != FrameTypeMessage {
+		// the data of other frames may be retained by the delegate
+		// (e.g. in a Producer's transactions), they're few and small
+		data = append([]byte(nil), data...)
+		bufferPool.Put(buf)
+		return frameType, data, nil, err
+	}
+	return frameType, data, buf, nil
+}
+
+// decodeMessage decodes a message frame, into a pooled Message owning buf
+// (the buffer the frame was read into, see readFrame) when it isn't nil
+func (c *Conn) decodeMessage(data []byte, buf *[]byte) (*Message, error) {
+	if buf == nil {
+		return DecodeMessage(data)
+	}
+	msg := acquireMessage()
+	if err := decodeMessage(data, msg); err != nil {
+		bufferPool.Put(buf)
+		*msg = Message{}
+		messagePool.Put(msg)
+		return nil, err
+	}
+	msg.buf = buf
+	return msg, nil
+}
+
 func (c *Conn) writeLoop() {
 	for {
 		select {
@@ -616,6 +763,8 @@ func (c *Conn) writeLoop() {
 					c.delegate.OnContinue(c)
 				}
 			}
+			// the command holds a copy of the ID
+			resp.msg.Release()
 
 			err := c.WriteCommand(resp.cmd)
 			if err != nil {
@@ -666,7 +815,7 @@ func (c *Conn) close() {
 	c.stopper.Do(func() {
 		c.log(LogLevelInfo, "beginning close")
 		close(c.exitChan)
-		c.conn.CloseRead()
+		c.closeRead()
 
 		c.wg.Add(1)
 		go c.cleanup()
@@ -686,7 +835,8 @@ func (c *Conn) cleanup() {
 		// and readLoop has exited
 		var msgsInFlight int64
 		select {
-		case <-c.msgResponseChan:
+		case resp := <-c.msgResponseChan:
+			resp.msg.Release()
 			msgsInFlight = atomic.AddInt64(&c.messagesInFlight, -1)
 		case <-ticker.C:
 			msgsInFlight = atomic.LoadInt64(&c.messagesInFlight)
@@ -720,7 +870,7 @@ func (c *Conn) waitForCleanup() {
 	// this blocks until readLoop and writeLoop
 	// (and cleanup goroutine above) have exited
 	c.wg.Wait()
-	c.conn.CloseWrite()
+	c.closeWrite()
 	c.log(LogLevelInfo, "clean close complete")
 	c.delegate.OnClose(c)
 }
@@ -731,12 +881,11 @@ func (c *Conn) onMessageFinish(m *Message) {
 
 func (c *Conn) onMessageRequeue(m *Message, delay time.Duration, backoff bool) {
 	if delay == -1 {
-		// linear delay
-		delay = c.config.DefaultRequeueDelay * time.Duration(m.Attempts)
-		// bound the requeueDelay to configured max
-		if delay > c.config.MaxRequeueDelay {
-			delay = c.config.MaxRequeueDelay
+		strategy := c.config.RequeueDelayStrategy
+		if strategy == nil {
+			strategy = RequeueDelayFunc(LinearRequeueDelay)
 		}
+		delay = strategy.RequeueDelay(m.Attempts, c.config.DefaultRequeueDelay, c.config.MaxRequeueDelay)
 	}
 	c.msgResponseChan <- &msgResponse{msg: m, cmd: Requeue(m.ID, delay), success: false, backoff: backoff}
 }
@@ -749,6 +898,14 @@ func (c *Conn) onMessageTouch(m *Message) {
 }
 
 func (c *Conn) log(lvl LogLevel, line string, args ...interface{}) {
+	if l, logLvl, keyvals := c.getStructuredLogger(); l != nil {
+		if logLvl <= lvl {
+			msg, fields := logFields(keyvals, line, args)
+			l.Log(lvl, msg, append(fields, "addr", c.String())...)
+		}
+		return
+	}
+
 	logger, logLvl, logFmt := c.getLogger(lvl)
 
 	if logger == nil {
@@ -763,3 +920,10 @@ func (c *Conn) log(lvl LogLevel, line string, args ...interface{}) {
 		fmt.Sprintf(logFmt, c.String()),
 		fmt.Sprintf(line, args...)))
 }
+
+func isTimeout(err error) bool {
+	if ne, ok := err.(net.Error); ok {
+		return ne.Timeout()
+	}
+	return false
+}
@@ -2,8 +2,10 @@ package nsq
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"math"
 	"math/rand"
@@ -11,6 +13,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,7 +29,8 @@ import (
 //
 // When the return value is nil Consumer will automatically handle FINishing.
 //
-// When the returned value is non-nil Consumer will automatically handle REQueing.
+// When the returned value is non-nil Consumer will automatically handle REQueing
+// (without backoff for an ErrRequeueWithoutBackoff).
 type Handler interface {
 	HandleMessage(message *Message) error
 }
@@ -43,6 +48,31 @@ func (h HandlerFunc) HandleMessage(m *Message) error {
 	return h(m)
 }
 
+// HandlerWithContext is a Handler that receives a context, for propagating
+// cancellation to the calls it makes (see AddHandlerWithContext)
+//
+// The context is cancelled when the Consumer is stopped, and its deadline
+// falls shortly before the server-side timeout of the message expires (as of
+// its delivery, the deadline isn't extended by Touch) or at the
+// Config.HandlerTimeout, whichever is first. It carries the trace context the
+// message was published with, if any (see TraceContextFromContext).
+type HandlerWithContext interface {
+	HandleMessage(ctx context.Context, message *Message) error
+}
+
+// HandlerWithContextFunc is a convenience type to avoid having to declare a
+// struct to implement the HandlerWithContext interface
+type HandlerWithContextFunc func(ctx context.Context, message *Message) error
+
+// HandleMessage implements the HandlerWithContext interface
+func (h HandlerWithContextFunc) HandleMessage(ctx context.Context, m *Message) error {
+	return h(ctx, m)
+}
+
+// MiddlewareFunc wraps a Handler (e.g. for logging, metrics or tracing),
+// see Consumer.Use. Deduplicator.Handler is one.
+type MiddlewareFunc func(next Handler) Handler
+
 // DiscoveryFilter is an interface accepted by `SetBehaviorDelegate()`
 // for filtering the nsqds returned from discovery via nsqlookupd
 type DiscoveryFilter interface {
@@ -51,7 +81,7 @@ type DiscoveryFilter interface {
 
 // FailedMessageLogger is an interface that can be implemented by handlers that wish
 // to receive a callback when a message is deemed "failed" (i.e. the number of attempts
-// exceeded the Consumer specified MaxAttemptCount)
+// exceeded the Consumer specified MaxAttemptCount), see also Consumer.SetGiveUpHandler
 type FailedMessageLogger interface {
 	LogFailedMessage(message *Message)
 }
@@ -62,7 +92,23 @@ type ConsumerStats struct {
 	MessagesReceived uint64
 	MessagesFinished uint64
 	MessagesRequeued uint64
+	HandlerPanics    uint64 // recovered, see Config.RecoverHandlerPanics
+	HandlerTimeouts  uint64 // see Config.HandlerTimeout
+	MessagesFiltered uint64 // see SetFilter
+	MessagesDeduped  uint64 // see Config.DedupeWindow
 	Connections      int
+
+	MessagesInFlight int64            // received and not yet responded to
+	RDY              map[string]int64 // the RDY count of each connection, by nsqd address
+	BackoffLevel     int32            // the consecutive failures backed off for (the highest of the connections), 0 when not in backoff
+	BackoffLevels    map[string]int32 // the BackoffLevel of each connection in backoff, by nsqd address, see Config.BackoffPerConnection
+	BackoffTime      time.Duration    // the total duration of the backoffs started (of the Consumer or its connections)
+	InBackoff        bool             // whether RDY is held back after failures (on any connection)
+	Paused           bool             // see Pause
+
+	// time since nsqlookupd was last queried successfully (0 until then),
+	// the nsqd it listed are used while it can't be queried
+	LookupdStaleness time.Duration
 }
 
 var instCount int64
@@ -89,23 +135,50 @@ type Consumer struct {
 	messagesReceived uint64
 	messagesFinished uint64
 	messagesRequeued uint64
+	handlerPanics    uint64
+	handlerTimeouts  uint64
+	messagesFiltered uint64
+	messagesDeduped  uint64
 	totalRdyCount    int64
 	backoffDuration  int64
+	backoffTime      int64
 	backoffCounter   int32
 	maxInFlight      int32
 
 	mtx sync.RWMutex
 
-	logger   []logger
-	logLvl   LogLevel
-	logGuard sync.RWMutex
+	logger           []logger
+	structuredLogger StructuredLogger
+	logLvl           LogLevel
+	logGuard         sync.RWMutex
 
 	behaviorDelegate interface{}
+	middleware       []MiddlewareFunc
+	panicHandler     func(message *Message, recovered interface{}, stack []byte)
+	filter           func(message *Message) bool
+	giveUpHandler    func(message *Message)
+	envelopeCodec    EnvelopeCodec
+	nodeSelector     NodeSelector
+	starvation       func(starved bool)
+	hooks            atomic.Value // *ConsumerHooks
+
+	// remembers finished messages, see Config.DedupeWindow
+	dedupe *Deduplicator
+
+	// handlers added with AddConcurrentHandlers, see ChangeConcurrentHandlers
+	poolMtx      sync.Mutex
+	handlerPools []*handlerPool
+
+	deadLetterProducer *Producer
+	deadLetterTopic    string
 
 	id      int64
 	topic   string
 	channel string
-	config  Config
+
+	// configMtx guards the options that can be changed by ApplyConfig
+	configMtx sync.RWMutex
+	config    Config
 
 	rngMtx sync.Mutex
 	rng    *rand.Rand
@@ -113,29 +186,52 @@ type Consumer struct {
 	needRDYRedistributed int32
 
 	backoffMtx sync.Mutex
+	// by connection, see Config.BackoffPerConnection
+	connBackoffs map[string]*connBackoff
 
 	incomingMessages chan *Message
 
 	rdyRetryMtx    sync.Mutex
 	rdyRetryTimers map[string]*time.Timer
 
+	// closed once no messages are in flight, see Drain
+	drainMtx   sync.Mutex
+	drainChans []chan struct{}
+
 	pendingConnections map[string]*Conn
 	connections        map[string]*Conn
+	// the IO error connections were closed for, see ConsumerHooks.OnDisconnect
+	connErrors map[string]error
+	// closed once the connection is closed, for reconnecting it, see reconnectConns
+	reconnecting map[string]chan struct{}
+
+	// per-nsqd configuration, see ConnectToNSQDWithConfig
+	nsqdConfigs map[string]*Config
 
 	nsqdTCPAddrs []string
 
 	// used at connection close to force a possible reconnect
-	lookupdRecheckChan chan int
-	lookupdHTTPAddrs   []string
-	lookupdQueryIndex  int
+	lookupdRecheckChan    chan int
+	lookupdPollChangeChan chan int
+	lookupdLoopStop       chan int // closed when the last lookupd is removed
+	lookupdHTTPAddrs      []string
+	lookupdQueryIndex     int
+	lookupdResults        map[string][]string // the nsqd last listed by each lookupd
+	lookupdLastSuccess    time.Time
+	lookupdHTTPClient     *http.Client
 
 	wg              sync.WaitGroup
 	runningHandlers int32
 	stopFlag        int32
+	pausedFlag      int32
 	connectedFlag   int32
 	stopHandler     sync.Once
 	exitHandler     sync.Once
 
+	// cancelled by Stop, see HandlerWithContext
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	// read from this channel to block until consumer is cleanly stopped
 	StopChan chan int
 	exitChan chan int
@@ -158,6 +254,11 @@ func NewConsumer(topic string, channel string, config *Config) (*Consumer, error
 		return nil, errors.New("invalid channel name")
 	}
 
+	lookupdHTTPClient, err := newLookupdHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+
 	r := &Consumer{
 		id: atomic.AddInt64(&instCount, 1),
 
@@ -172,16 +273,28 @@ func NewConsumer(topic string, channel string, config *Config) (*Consumer, error
 		incomingMessages: make(chan *Message),
 
 		rdyRetryTimers:     make(map[string]*time.Timer),
+		connBackoffs:       make(map[string]*connBackoff),
 		pendingConnections: make(map[string]*Conn),
 		connections:        make(map[string]*Conn),
+		connErrors:         make(map[string]error),
+		reconnecting:       make(map[string]chan struct{}),
+		nsqdConfigs:        make(map[string]*Config),
 
-		lookupdRecheckChan: make(chan int, 1),
+		lookupdRecheckChan:    make(chan int, 1),
+		lookupdPollChangeChan: make(chan int, 1),
+		lookupdResults:        make(map[string][]string),
+		lookupdHTTPClient:     lookupdHTTPClient,
 
 		rng: rand.New(rand.NewSource(time.Now().UnixNano())),
 
 		StopChan: make(chan int),
 		exitChan: make(chan int),
 	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	if config.DedupeWindow > 0 {
+		r.dedupe = NewDeduplicatorWithMaxKeys(config.DedupeWindow, config.DedupeMaxKeys)
+	}
 
 	// Set default logger for all log levels
 	l := log.New(os.Stderr, "", log.Flags())
@@ -196,11 +309,42 @@ func NewConsumer(topic string, channel string, config *Config) (*Consumer, error
 
 // Stats retrieves the current connection and message statistics for a Consumer
 func (r *Consumer) Stats() *ConsumerStats {
+	conns := r.conns()
+	rdy := make(map[string]int64, len(conns))
+	var inFlight int64
+	for _, c := range conns {
+		rdy[c.String()] = c.RDY()
+		inFlight += atomic.LoadInt64(&c.messagesInFlight)
+	}
+
+	backoffLevel := atomic.LoadInt32(&r.backoffCounter)
+	r.backoffMtx.Lock()
+	backoffLevels := make(map[string]int32, len(r.connBackoffs))
+	for addr, b := range r.connBackoffs {
+		backoffLevels[addr] = b.counter
+		if b.counter > backoffLevel {
+			backoffLevel = b.counter
+		}
+	}
+	r.backoffMtx.Unlock()
+
 	return &ConsumerStats{
 		MessagesReceived: atomic.LoadUint64(&r.messagesReceived),
 		MessagesFinished: atomic.LoadUint64(&r.messagesFinished),
 		MessagesRequeued: atomic.LoadUint64(&r.messagesRequeued),
-		Connections:      len(r.conns()),
+		HandlerPanics:    atomic.LoadUint64(&r.handlerPanics),
+		HandlerTimeouts:  atomic.LoadUint64(&r.handlerTimeouts),
+		MessagesFiltered: atomic.LoadUint64(&r.messagesFiltered),
+		MessagesDeduped:  atomic.LoadUint64(&r.messagesDeduped),
+		Connections:      len(conns),
+		MessagesInFlight: inFlight,
+		RDY:              rdy,
+		BackoffLevel:     backoffLevel,
+		BackoffLevels:    backoffLevels,
+		BackoffTime:      time.Duration(atomic.LoadInt64(&r.backoffTime)),
+		InBackoff:        backoffLevel > 0,
+		Paused:           r.IsPaused(),
+		LookupdStaleness: r.lookupdStaleness(),
 	}
 }
 
@@ -281,6 +425,77 @@ func (r *Consumer) SetBehaviorDelegate(cb interface{}) {
 	r.behaviorDelegate = cb
 }
 
+// SetPanicHandler registers f to be called with the message, the value passed
+// to panic and the stack trace whenever a panic in a handler is recovered
+// (see Config.RecoverHandlerPanics), once per message of a batch (see
+// AddBatchHandler)
+//
+// f is called from the handler's goroutine.
+func (r *Consumer) SetPanicHandler(f func(message *Message, recovered interface{}, stack []byte)) {
+	r.mtx.Lock()
+	r.panicHandler = f
+	r.mtx.Unlock()
+}
+
+// SetFilter registers f to be called with each message before it is passed
+// to the handlers. Messages for which f returns false are FINished right
+// away, without being handled (nor considered for MaxAttempts).
+//
+// f is called from the handlers' goroutines and must not respond to the message.
+func (r *Consumer) SetFilter(f func(message *Message) bool) {
+	r.mtx.Lock()
+	r.filter = f
+	r.mtx.Unlock()
+}
+
+// SetGiveUpHandler registers f to be called with each message that exceeded
+// Config.MaxAttempts, e.g. to persist or republish it, before it is FINished
+// (and once it was published to the dead-letter topic, see SetDeadLetter).
+//
+// f is called from the handler's goroutine, after any FailedMessageLogger, and
+// may block but must not respond to the message.
+func (r *Consumer) SetGiveUpHandler(f func(message *Message)) {
+	r.mtx.Lock()
+	r.giveUpHandler = f
+	r.mtx.Unlock()
+}
+
+// SetEnvelopeCodec registers codec to decode message bodies with before they
+// are dispatched to handlers, e.g. DefaultEnvelopeCodec for the envelopes
+// published with Producer.PublishWithHeaders.
+//
+// The Body of a message that is enveloped is replaced by the unwrapped body
+// and its Headers are set, other messages are dispatched unchanged.
+func (r *Consumer) SetEnvelopeCodec(codec EnvelopeCodec) {
+	r.mtx.Lock()
+	r.envelopeCodec = codec
+	r.mtx.Unlock()
+}
+
+// SetNodeSelector registers selector to filter and order the nsqd returned
+// by nsqlookupd before connecting to them, e.g. to prefer those in the same
+// rack or to exclude canary nodes. It is applied before any DiscoveryFilter.
+//
+// Only nsqd newly returned by selector are connected to, in the returned order;
+// existing connections are not affected.
+func (r *Consumer) SetNodeSelector(selector NodeSelector) {
+	r.mtx.Lock()
+	r.nodeSelector = selector
+	r.mtx.Unlock()
+}
+
+// SetStarvationHandler registers f to be called with true once the Consumer
+// has been starved (see IsStarved) for Config.StarvationThreshold, and with
+// false when it is no longer starved after that, e.g. to alert on an
+// undersized max_in_flight.
+//
+// f is called from an internal goroutine and must not block.
+func (r *Consumer) SetStarvationHandler(f func(starved bool)) {
+	r.mtx.Lock()
+	r.starvation = f
+	r.mtx.Unlock()
+}
+
 // perConnMaxInFlight calculates the per-connection max-in-flight count.
 //
 // This may change dynamically based on the number of connections to nsqd the Consumer
@@ -313,7 +528,8 @@ func (r *Consumer) getMaxInFlight() int32 {
 //
 // For example, ChangeMaxInFlight(0) would pause message flow
 //
-// If already connected, it updates the reader RDY state for each connection.
+// If already connected, it immediately redistributes the RDY state across
+// connections (without reconnecting), e.g. to scale with the queue depth.
 func (r *Consumer) ChangeMaxInFlight(maxInFlight int) {
 	if r.getMaxInFlight() == int32(maxInFlight) {
 		return
@@ -321,11 +537,111 @@ func (r *Consumer) ChangeMaxInFlight(maxInFlight int) {
 
 	atomic.StoreInt32(&r.maxInFlight, int32(maxInFlight))
 
+	r.updateAllRDY()
+
+	if r.config.AutoHandlerConcurrency && maxInFlight > 0 {
+		r.ChangeConcurrentHandlers(maxInFlight)
+	}
+}
+
+// consumerReloadableOptions are the options that may be changed
+// on a running Consumer via ApplyConfig
+var consumerReloadableOptions = []string{
+	"max_in_flight",
+	"lookupd_poll_interval",
+	"lookupd_poll_jitter",
+	"sample_rate",
+}
+
+// ApplyConfig updates the configuration of a running Consumer.
+//
+// Only max_in_flight, lookupd_poll_interval, lookupd_poll_jitter and
+// sample_rate may differ from the Config the Consumer was created with,
+// an error is returned (and nothing is applied) if any other option changed.
+//
+// A new max_in_flight takes effect immediately (as with ChangeMaxInFlight)
+// and the lookupd polling schedule is reset. Because nsqd only accepts
+// IDENTIFY once per connection, changing sample_rate reconnects every
+// connection (one at a time, once its messages in flight are responded to)
+// so that they re-IDENTIFY with the new value.
+func (r *Consumer) ApplyConfig(config *Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	r.configMtx.Lock()
+	current := r.config.Map()
+	for opt, v := range config.Map() {
+		if indexOf(opt, consumerReloadableOptions) >= 0 {
+			continue
+		}
+		if !optionValuesEqual(current[opt], v) {
+			r.configMtx.Unlock()
+			return fmt.Errorf("option %s cannot be changed on a running Consumer", opt)
+		}
+	}
+	pollChanged := r.config.LookupdPollInterval != config.LookupdPollInterval ||
+		r.config.LookupdPollJitter != config.LookupdPollJitter
+	sampleRateChanged := r.config.SampleRate != config.SampleRate
+	r.config.MaxInFlight = config.MaxInFlight
+	r.config.LookupdPollInterval = config.LookupdPollInterval
+	r.config.LookupdPollJitter = config.LookupdPollJitter
+	r.config.SampleRate = config.SampleRate
+	r.configMtx.Unlock()
+
+	r.ChangeMaxInFlight(config.MaxInFlight)
+
+	if pollChanged {
+		select {
+		case r.lookupdPollChangeChan <- 1:
+		default:
+		}
+	}
+
+	if sampleRateChanged {
+		r.log(LogLevelInfo, "sample_rate changed to %d, reconnecting", config.SampleRate)
+		go r.reconnectConns()
+	}
+	return nil
+}
+
+// reconnectConns closes and immediately reconnects each connection, one at a
+// time, for nsqd to apply the configuration (which is only sent on IDENTIFY)
+func (r *Consumer) reconnectConns() {
 	for _, c := range r.conns() {
-		r.maybeUpdateRDY(c)
+		addr := c.String()
+		done := make(chan struct{})
+		r.mtx.Lock()
+		_, reconnecting := r.reconnecting[addr]
+		open := r.connections[addr] == c
+		if open && !reconnecting {
+			r.reconnecting[addr] = done
+		}
+		r.mtx.Unlock()
+		if !open || reconnecting {
+			// already closed, or being reconnected
+			continue
+		}
+
+		// messages in flight are still responded to before the connection closes
+		c.Close()
+		<-done
+		if atomic.LoadInt32(&r.stopFlag) == 1 {
+			return
+		}
+		err := r.ConnectToNSQD(addr)
+		if err != nil && err != ErrAlreadyConnected {
+			r.log(LogLevelError, "(%s) error reconnecting to nsqd - %s", addr, err)
+		}
 	}
 }
 
+func (r *Consumer) lookupdPollInterval() (time.Duration, float64) {
+	r.configMtx.RLock()
+	defer r.configMtx.RUnlock()
+	return r.config.LookupdPollInterval, r.config.LookupdPollJitter
+}
+
 // ConnectToNSQLookupd adds an nsqlookupd address to the list for this Consumer instance.
 //
 // If it is the first to be added, it initiates an HTTP request to discover nsqd
@@ -356,13 +672,18 @@ func (r *Consumer) ConnectToNSQLookupd(addr string) error {
 	}
 	r.lookupdHTTPAddrs = append(r.lookupdHTTPAddrs, parsedAddr)
 	numLookupd := len(r.lookupdHTTPAddrs)
+	var stop chan int
+	if numLookupd == 1 {
+		stop = make(chan int)
+		r.lookupdLoopStop = stop
+	}
 	r.mtx.Unlock()
 
 	// if this is the first one, kick off the go loop
 	if numLookupd == 1 {
 		r.queryLookupd()
 		r.wg.Add(1)
-		go r.lookupdLoop()
+		go r.lookupdLoop(stop)
 	}
 
 	return nil
@@ -385,46 +706,81 @@ func (r *Consumer) ConnectToNSQLookupds(addresses []string) error {
 }
 
 // poll all known lookup servers every LookupdPollInterval
-func (r *Consumer) lookupdLoop() {
+func (r *Consumer) lookupdLoop(stop <-chan int) {
 	// add some jitter so that multiple consumers discovering the same topic,
 	// when restarted at the same time, dont all connect at once.
+	interval, pollJitter := r.lookupdPollInterval()
 	r.rngMtx.Lock()
-	jitter := time.Duration(int64(r.rng.Float64() *
-		r.config.LookupdPollJitter * float64(r.config.LookupdPollInterval)))
+	jitter := time.Duration(int64(r.rng.Float64() * pollJitter * float64(interval)))
 	r.rngMtx.Unlock()
-	var ticker *time.Ticker
+	var timer *time.Timer
+
+	// poll every LookupdPollFastInterval at first (and after losing a
+	// connection), doubling up to LookupdPollInterval
+	fastInterval := r.config.LookupdPollFastInterval
 
 	select {
 	case <-time.After(jitter):
+	case <-stop:
+		goto exit
 	case <-r.exitChan:
 		goto exit
 	}
 
-	ticker = time.NewTicker(r.config.LookupdPollInterval)
+	timer = time.NewTimer(r.nextLookupdPoll(&fastInterval))
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-timer.C:
 			r.queryLookupd()
 		case <-r.lookupdRecheckChan:
 			r.queryLookupd()
+			fastInterval = r.config.LookupdPollFastInterval
+		case <-r.lookupdPollChangeChan:
+		case <-stop:
+			goto exit
 		case <-r.exitChan:
 			goto exit
 		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(r.nextLookupdPoll(&fastInterval))
 	}
 
 exit:
-	if ticker != nil {
-		ticker.Stop()
+	if timer != nil {
+		timer.Stop()
 	}
 	r.log(LogLevelInfo, "exiting lookupdLoop")
 	r.wg.Done()
 }
 
+// nextLookupdPoll returns the duration until the next lookupd poll, doubling
+// fastInterval until it reaches LookupdPollInterval (when it is set to 0)
+func (r *Consumer) nextLookupdPoll(fastInterval *time.Duration) time.Duration {
+	interval, _ := r.lookupdPollInterval()
+	if *fastInterval <= 0 || *fastInterval >= interval {
+		*fastInterval = 0
+		return interval
+	}
+	next := *fastInterval
+	*fastInterval *= 2
+	return next
+}
+
 // return the next lookupd endpoint to query
 // keeping track of which one was last used
 func (r *Consumer) nextLookupdEndpoint() string {
 	r.mtx.RLock()
+	if len(r.lookupdHTTPAddrs) == 0 {
+		// the last one was removed while querying
+		r.mtx.RUnlock()
+		return ""
+	}
 	if r.lookupdQueryIndex >= len(r.lookupdHTTPAddrs) {
 		r.lookupdQueryIndex = 0
 	}
@@ -438,17 +794,24 @@ func (r *Consumer) nextLookupdEndpoint() string {
 
 type lookupResp struct {
 	Channels  []string    `json:"channels"`
-	Producers []*peerInfo `json:"producers"`
+	Producers []*PeerInfo `json:"producers"`
 	Timestamp int64       `json:"timestamp"`
 }
 
-type peerInfo struct {
-	RemoteAddress    string `json:"remote_address"`
-	Hostname         string `json:"hostname"`
-	BroadcastAddress string `json:"broadcast_address"`
-	TCPPort          int    `json:"tcp_port"`
-	HTTPPort         int    `json:"http_port"`
-	Version          string `json:"version"`
+// PeerInfo describes an nsqd as registered with nsqlookupd
+type PeerInfo struct {
+	RemoteAddress    string   `json:"remote_address"`
+	Hostname         string   `json:"hostname"`
+	BroadcastAddress string   `json:"broadcast_address"`
+	TCPPort          int      `json:"tcp_port"`
+	HTTPPort         int      `json:"http_port"`
+	Version          string   `json:"version"`
+	Topics           []string `json:"topics"` // only returned by /nodes
+}
+
+// TCPAddress returns the address to connect to the nsqd at
+func (p *PeerInfo) TCPAddress() string {
+	return net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.TCPPort))
 }
 
 // make an HTTP req to one of the configured nsqlookupd instances to discover
@@ -460,43 +823,133 @@ func (r *Consumer) queryLookupd() {
 
 retry:
 	endpoint := r.nextLookupdEndpoint()
+	if endpoint == "" {
+		return
+	}
 
-	r.log(LogLevelInfo, "querying nsqlookupd %s", endpoint)
+	r.log(LogLevelInfo, "querying nsqlookupd %s", redactEndpoint(endpoint))
 
 	var data lookupResp
-	headers := make(http.Header)
-	if r.config.AuthSecret != "" && r.config.LookupdAuthorization {
-		headers.Set("Authorization", fmt.Sprintf("Bearer %s", r.config.AuthSecret))
+	headers, err := lookupdHeaders(&r.config)
+	if err != nil {
+		r.log(LogLevelError, "error authenticating to nsqlookupd - %s", err)
+		return
 	}
-	err := apiRequestNegotiateV1("GET", endpoint, headers, &data)
+	err = apiRequestNegotiateV1(r.lookupdHTTPClient, "GET", endpoint, headers, &data)
 	if err != nil {
-		r.log(LogLevelError, "error querying nsqlookupd (%s) - %s", endpoint, err)
+		r.log(LogLevelError, "error querying nsqlookupd (%s) - %s", redactEndpoint(endpoint), err)
 		retries++
 		if retries < 3 {
 			r.log(LogLevelInfo, "retrying with next nsqlookupd")
 			goto retry
 		}
+		r.connectToCachedNSQD()
 		return
 	}
 
+	r.mtx.RLock()
+	selector := r.nodeSelector
+	r.mtx.RUnlock()
+	if selector != nil {
+		data.Producers = selector(data.Producers)
+	}
+
 	var nsqdAddrs []string
 	for _, producer := range data.Producers {
-		broadcastAddress := producer.BroadcastAddress
-		port := producer.TCPPort
-		joined := net.JoinHostPort(broadcastAddress, strconv.Itoa(port))
-		nsqdAddrs = append(nsqdAddrs, joined)
+		nsqdAddrs = append(nsqdAddrs, producer.TCPAddress())
 	}
+	nsqdAddrs = filterNSQDAddrs(&r.config, nsqdAddrs)
 	// apply filter
 	if discoveryFilter, ok := r.behaviorDelegate.(DiscoveryFilter); ok {
 		nsqdAddrs = discoveryFilter.Filter(nsqdAddrs)
 	}
+
+	r.mtx.Lock()
+	r.lookupdResults[endpoint] = nsqdAddrs
+	r.lookupdLastSuccess = time.Now()
+	removed := r.lookupdRemovedNSQD()
+	r.mtx.Unlock()
+
 	for _, addr := range nsqdAddrs {
+		if indexOf(addr, removed) != -1 {
+			continue
+		}
 		err = r.ConnectToNSQD(addr)
 		if err != nil && err != ErrAlreadyConnected {
 			r.log(LogLevelError, "(%s) error connecting to nsqd - %s", addr, err)
 			continue
 		}
 	}
+	for _, addr := range removed {
+		if r.DisconnectFromNSQD(addr) == nil {
+			r.log(LogLevelInfo, "(%s) no longer listed by nsqlookupd, disconnected", addr)
+		}
+	}
+}
+
+// connectToCachedNSQD (re)connects to the nsqd last listed by the lookupd
+// when none of them can be queried
+func (r *Consumer) connectToCachedNSQD() {
+	r.mtx.RLock()
+	removed := r.lookupdRemovedNSQD()
+	var addrs []string
+	for _, results := range r.lookupdResults {
+		for _, addr := range results {
+			if indexOf(addr, addrs) == -1 && indexOf(addr, removed) == -1 {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	r.mtx.RUnlock()
+	if len(addrs) == 0 {
+		return
+	}
+
+	r.log(LogLevelWarning, "using the nsqd last listed by nsqlookupd %s ago",
+		r.lookupdStaleness())
+	for _, addr := range addrs {
+		err := r.ConnectToNSQD(addr)
+		if err != nil && err != ErrAlreadyConnected {
+			r.log(LogLevelError, "(%s) error connecting to nsqd - %s", addr, err)
+		}
+	}
+}
+
+// lookupdRemovedNSQD returns the nsqd that at least LookupdRemoveQuorum lookupd
+// no longer list in their latest response (r.mtx must be held)
+func (r *Consumer) lookupdRemovedNSQD() []string {
+	quorum := r.config.LookupdRemoveQuorum
+	if quorum == 0 {
+		return nil
+	}
+	var seen, removed []string
+	for _, results := range r.lookupdResults {
+		for _, addr := range results {
+			if indexOf(addr, seen) != -1 {
+				continue
+			}
+			seen = append(seen, addr)
+			absent := 0
+			for _, other := range r.lookupdResults {
+				if indexOf(addr, other) == -1 {
+					absent++
+				}
+			}
+			if absent >= quorum {
+				removed = append(removed, addr)
+			}
+		}
+	}
+	return removed
+}
+
+func (r *Consumer) lookupdStaleness() time.Duration {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if r.lookupdLastSuccess.IsZero() {
+		return 0
+	}
+	return time.Since(r.lookupdLastSuccess)
 }
 
 // ConnectToNSQDs takes multiple nsqd addresses to connect directly to.
@@ -529,12 +982,25 @@ func (r *Consumer) ConnectToNSQD(addr string) error {
 
 	atomic.StoreInt32(&r.connectedFlag, 1)
 
-	conn := NewConn(addr, &r.config, &consumerConnDelegate{r})
+	// each connection gets its own copy so that ApplyConfig doesn't race with it
+	r.configMtx.RLock()
+	config := r.config
+	r.configMtx.RUnlock()
+	r.mtx.RLock()
+	if override, ok := r.nsqdConfigs[addr]; ok {
+		config = *override
+	}
+	r.mtx.RUnlock()
+
+	conn := NewConn(addr, &config, &consumerConnDelegate{r})
 	conn.SetLoggerLevel(r.getLogLevel())
 	format := fmt.Sprintf("%3d [%s/%s] (%%s)", r.id, r.topic, r.channel)
 	for index := range r.logger {
 		conn.SetLoggerForLevel(r.logger[index], LogLevel(index), format)
 	}
+	if l, lvl := r.getStructuredLogger(); l != nil {
+		conn.SetStructuredLogger(l, lvl, r.logKeyvals()...)
+	}
 	r.mtx.Lock()
 	_, pendingOk := r.pendingConnections[addr]
 	_, ok := r.connections[addr]
@@ -584,14 +1050,40 @@ func (r *Consumer) ConnectToNSQD(addr string) error {
 	r.connections[addr] = conn
 	r.mtx.Unlock()
 
-	// pre-emptive signal to existing connections to lower their RDY count
-	for _, c := range r.conns() {
-		r.maybeUpdateRDY(c)
+	if f := r.getHooks().OnConnect; f != nil {
+		f(addr)
 	}
 
+	// pre-emptive signal to existing connections to lower their RDY count
+	r.updateAllRDY()
+
 	return nil
 }
 
+// ConnectToNSQDWithConfig is like ConnectToNSQD but uses config, rather than
+// the Config the Consumer was created with, for the connection to addr
+// (e.g. a different TLS config or output buffer settings for a remote nsqd).
+//
+// The override is remembered and also applies when reconnecting to addr, or
+// when addr is discovered via nsqlookupd, until DisconnectFromNSQD is called.
+//
+// Only options that apply to a connection (timeouts, TLS, compression,
+// output buffering, heartbeats, sample_rate, msg_timeout, auth, identifiers
+// and dialing) are taken from config. Consumer wide options such as
+// max_in_flight and backoff are unaffected, and ApplyConfig does not
+// change overridden connections.
+func (r *Consumer) ConnectToNSQDWithConfig(addr string, config *Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	r.nsqdConfigs[addr] = config.Clone()
+	r.mtx.Unlock()
+
+	return r.ConnectToNSQD(addr)
+}
+
 func indexOf(n string, h []string) int {
 	for i, a := range h {
 		if n == a {
@@ -614,6 +1106,7 @@ func (r *Consumer) DisconnectFromNSQD(addr string) error {
 
 	// slice delete
 	r.nsqdTCPAddrs = append(r.nsqdTCPAddrs[:idx], r.nsqdTCPAddrs[idx+1:]...)
+	delete(r.nsqdConfigs, addr)
 
 	pendingConn, pendingOk := r.pendingConnections[addr]
 	conn, ok := r.connections[addr]
@@ -629,6 +1122,9 @@ func (r *Consumer) DisconnectFromNSQD(addr string) error {
 
 // DisconnectFromNSQLookupd removes the specified `nsqlookupd` address
 // from the list used for periodic discovery.
+//
+// Removing the last one stops polling until an nsqlookupd is added again.
+// Connections to the nsqd already discovered are kept (see DisconnectFromNSQD).
 func (r *Consumer) DisconnectFromNSQLookupd(addr string) error {
 	parsedAddr, err := buildLookupAddr(addr, r.topic)
 	if err != nil {
@@ -643,26 +1139,56 @@ func (r *Consumer) DisconnectFromNSQLookupd(addr string) error {
 		return ErrNotConnected
 	}
 
-	if len(r.lookupdHTTPAddrs) == 1 {
-		return fmt.Errorf("cannot disconnect from only remaining nsqlookupd HTTP address %s", addr)
-	}
-
 	r.lookupdHTTPAddrs = append(r.lookupdHTTPAddrs[:idx], r.lookupdHTTPAddrs[idx+1:]...)
+	delete(r.lookupdResults, parsedAddr)
+
+	if len(r.lookupdHTTPAddrs) == 0 {
+		close(r.lookupdLoopStop)
+		r.lookupdLoopStop = nil
+	}
 
 	return nil
 }
 
 func (r *Consumer) onConnMessage(c *Conn, msg *Message) {
 	atomic.AddUint64(&r.messagesReceived, 1)
+	r.checkClockSkew(c, msg)
+	r.decodeEnvelope(msg)
 	r.incomingMessages <- msg
 }
 
+// decodeEnvelope unwraps the body of msg with the EnvelopeCodec, if any
+func (r *Consumer) decodeEnvelope(msg *Message) {
+	r.mtx.RLock()
+	codec := r.envelopeCodec
+	r.mtx.RUnlock()
+	if codec == nil {
+		return
+	}
+
+	headers, body, err := codec.Decode(msg.Body)
+	switch {
+	case err == ErrNotEnveloped:
+	case err != nil:
+		r.log(LogLevelWarning, "(%s) failed to decode envelope of msg %s - %s",
+			msg.NSQDAddress, msg.ID, err)
+	default:
+		msg.Headers = headers
+		msg.Body = body
+	}
+}
+
 func (r *Consumer) onConnMessageFinished(c *Conn, msg *Message) {
 	atomic.AddUint64(&r.messagesFinished, 1)
+	if r.dedupe != nil && msg.dedupeKey != "" {
+		r.dedupe.Add(msg.dedupeKey)
+	}
+	r.checkDrained()
 }
 
 func (r *Consumer) onConnMessageRequeued(c *Conn, msg *Message) {
 	atomic.AddUint64(&r.messagesRequeued, 1)
+	r.checkDrained()
 }
 
 func (r *Consumer) onConnBackoff(c *Conn) {
@@ -693,6 +1219,11 @@ func (r *Consumer) onConnError(c *Conn, data []byte) {}
 func (r *Consumer) onConnHeartbeat(c *Conn) {}
 
 func (r *Consumer) onConnIOError(c *Conn, err error) {
+	r.mtx.Lock()
+	if _, ok := r.connErrors[c.String()]; !ok {
+		r.connErrors[c.String()] = err
+	}
+	r.mtx.Unlock()
 	c.Close()
 }
 
@@ -712,13 +1243,35 @@ func (r *Consumer) onConnClose(c *Conn) {
 	}
 	r.rdyRetryMtx.Unlock()
 
+	r.backoffMtx.Lock()
+	if b, ok := r.connBackoffs[c.String()]; ok {
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+		delete(r.connBackoffs, c.String())
+	}
+	r.backoffMtx.Unlock()
+
 	r.mtx.Lock()
 	delete(r.connections, c.String())
 	left := len(r.connections)
+	err := r.connErrors[c.String()]
+	delete(r.connErrors, c.String())
+	if done, ok := r.reconnecting[c.String()]; ok {
+		delete(r.reconnecting, c.String())
+		close(done)
+	}
 	r.mtx.Unlock()
 
+	if f := r.getHooks().OnDisconnect; f != nil {
+		f(c.String(), err)
+	}
+
 	r.log(LogLevelWarning, "there are %d connections left alive", left)
 
+	// messages in flight on this connection will not be responded to
+	r.checkDrained()
+
 	if (hasRDYRetryTimer || rdyCount > 0) &&
 		(int32(left) == r.getMaxInFlight() || r.inBackoff()) {
 		// we're toggling out of (normal) redistribution cases and this conn
@@ -752,8 +1305,9 @@ func (r *Consumer) onConnClose(c *Conn) {
 		// try to reconnect after a bit
 		go func(addr string) {
 			for {
-				r.log(LogLevelInfo, "(%s) re-connecting in %s", addr, r.config.LookupdPollInterval)
-				time.Sleep(r.config.LookupdPollInterval)
+				interval, _ := r.lookupdPollInterval()
+				r.log(LogLevelInfo, "(%s) re-connecting in %s", addr, interval)
+				time.Sleep(interval)
 				if atomic.LoadInt32(&r.stopFlag) == 1 {
 					break
 				}
@@ -775,12 +1329,36 @@ func (r *Consumer) onConnClose(c *Conn) {
 	}
 }
 
+// canIncreaseBackoff returns whether the backoff level may be increased past
+// counter, i.e. the duration of the next level is within MaxBackoffDuration
+// and the current one did not already reach it (strategies that cap their
+// durations would otherwise increase it indefinitely)
+func (r *Consumer) canIncreaseBackoff(counter int32) bool {
+	strategy := r.config.BackoffStrategy
+	if counter > 0 && strategy.Calculate(int(counter)) >= r.config.MaxBackoffDuration {
+		return false
+	}
+	return strategy.Calculate(int(counter)+1) <= r.config.MaxBackoffDuration
+}
+
 func (r *Consumer) startStopContinueBackoff(conn *Conn, signal backoffSignal) {
+	if r.config.BackoffPerConnection {
+		r.startStopContinueConnBackoff(conn, signal)
+		return
+	}
+
 	// prevent many async failures/successes from immediately resulting in
 	// max backoff/normal rate (by ensuring that we dont continually incr/decr
 	// the counter during a backoff period)
 	r.backoffMtx.Lock()
-	defer r.backoffMtx.Unlock()
+	var hook func()
+	defer func() {
+		r.backoffMtx.Unlock()
+		// outside of the lock, as the hooks may call Stats
+		if hook != nil {
+			hook()
+		}
+	}()
 	if r.inBackoffTimeout() {
 		return
 	}
@@ -795,8 +1373,7 @@ func (r *Consumer) startStopContinueBackoff(conn *Conn, signal backoffSignal) {
 			backoffUpdated = true
 		}
 	case backoffFlag:
-		nextBackoff := r.config.BackoffStrategy.Calculate(int(backoffCounter) + 1)
-		if nextBackoff <= r.config.MaxBackoffDuration {
+		if r.canIncreaseBackoff(backoffCounter) {
 			backoffCounter++
 			backoffUpdated = true
 		}
@@ -810,6 +1387,7 @@ func (r *Consumer) startStopContinueBackoff(conn *Conn, signal backoffSignal) {
 		for _, c := range r.conns() {
 			r.updateRDY(c, count)
 		}
+		hook = r.getHooks().OnResume
 	} else if r.backoffCounter > 0 {
 		// start or continue backoff
 		backoffDuration := r.config.BackoffStrategy.Calculate(int(backoffCounter))
@@ -817,6 +1395,7 @@ func (r *Consumer) startStopContinueBackoff(conn *Conn, signal backoffSignal) {
 		if backoffDuration > r.config.MaxBackoffDuration {
 			backoffDuration = r.config.MaxBackoffDuration
 		}
+		backoffDuration = r.applyBackoffJitter(backoffDuration)
 
 		r.log(LogLevelWarning, "backing off for %s (backoff level %d), setting all to RDY 0",
 			backoffDuration, backoffCounter)
@@ -827,50 +1406,178 @@ func (r *Consumer) startStopContinueBackoff(conn *Conn, signal backoffSignal) {
 		}
 
 		r.backoff(backoffDuration)
+		if f := r.getHooks().OnBackoff; f != nil {
+			hook = func() { f(backoffDuration) }
+		}
 	}
 }
 
-func (r *Consumer) backoff(d time.Duration) {
-	atomic.StoreInt64(&r.backoffDuration, d.Nanoseconds())
-	time.AfterFunc(d, r.resume)
+// connBackoff is the backoff state of a connection, see Config.BackoffPerConnection
+type connBackoff struct {
+	counter int32
+	// pending until the backoff duration expires
+	timer *time.Timer
 }
 
-func (r *Consumer) resume() {
-	if atomic.LoadInt32(&r.stopFlag) == 1 {
-		atomic.StoreInt64(&r.backoffDuration, 0)
-		return
+// startStopContinueConnBackoff is startStopContinueBackoff for only conn
+func (r *Consumer) startStopContinueConnBackoff(conn *Conn, signal backoffSignal) {
+	r.backoffMtx.Lock()
+	var hook func()
+	defer func() {
+		r.backoffMtx.Unlock()
+		// outside of the lock, as the hooks may call Stats
+		if hook != nil {
+			hook()
+		}
+	}()
+	b, ok := r.connBackoffs[conn.String()]
+	if !ok {
+		b = &connBackoff{}
 	}
-
-	// pick a random connection to test the waters
-	conns := r.conns()
-	if len(conns) == 0 {
-		r.log(LogLevelWarning, "no connection available to resume")
-		r.log(LogLevelWarning, "backing off for %s", time.Second)
-		r.backoff(time.Second)
+	if b.timer != nil {
 		return
 	}
-	r.rngMtx.Lock()
-	idx := r.rng.Intn(len(conns))
-	r.rngMtx.Unlock()
-	choice := conns[idx]
 
-	r.log(LogLevelWarning,
-		"(%s) backoff timeout expired, sending RDY 1",
-		choice.String())
+	backoffUpdated := false
+	switch signal {
+	case resumeFlag:
+		if b.counter > 0 {
+			b.counter--
+			backoffUpdated = true
+		}
+	case backoffFlag:
+		if r.canIncreaseBackoff(b.counter) {
+			b.counter++
+			backoffUpdated = true
+		}
+	}
 
-	// while in backoff only ever let 1 message at a time through
-	err := r.updateRDY(choice, 1)
-	if err != nil {
-		r.log(LogLevelWarning, "(%s) error resuming RDY 1 - %s", choice.String(), err)
-		r.log(LogLevelWarning, "backing off for %s", time.Second)
-		r.backoff(time.Second)
+	if b.counter == 0 {
+		delete(r.connBackoffs, conn.String())
+		if backoffUpdated {
+			count := r.perConnMaxInFlight()
+			r.log(LogLevelWarning, "(%s) exiting backoff, returning to RDY %d", conn, count)
+			r.updateRDY(conn, count)
+			hook = r.getHooks().OnResume
+		}
 		return
 	}
+	r.connBackoffs[conn.String()] = b
 
-	atomic.StoreInt64(&r.backoffDuration, 0)
+	backoffDuration := r.config.BackoffStrategy.Calculate(int(b.counter))
+	if backoffDuration > r.config.MaxBackoffDuration {
+		backoffDuration = r.config.MaxBackoffDuration
+	}
+	backoffDuration = r.applyBackoffJitter(backoffDuration)
+
+	r.log(LogLevelWarning, "(%s) backing off for %s (backoff level %d), setting RDY 0",
+		conn, backoffDuration, b.counter)
+	r.updateRDY(conn, 0)
+	atomic.AddInt64(&r.backoffTime, backoffDuration.Nanoseconds())
+	b.timer = time.AfterFunc(backoffDuration, func() {
+		r.resumeConn(conn)
+	})
+	if f := r.getHooks().OnBackoff; f != nil {
+		hook = func() { f(backoffDuration) }
+	}
 }
 
-func (r *Consumer) inBackoff() bool {
+// resumeConn lets one message at a time through conn after its backoff duration
+func (r *Consumer) resumeConn(conn *Conn) {
+	r.backoffMtx.Lock()
+	b, ok := r.connBackoffs[conn.String()]
+	if ok {
+		b.timer = nil
+	}
+	r.backoffMtx.Unlock()
+	if !ok || atomic.LoadInt32(&r.stopFlag) == 1 {
+		return
+	}
+
+	r.log(LogLevelWarning, "(%s) backoff timeout expired, sending RDY 1", conn)
+	r.updateRDY(conn, 1)
+}
+
+// resumeConns sends RDY 1 to the connections whose backoff timeout expired
+// while paused (see resumeConn)
+func (r *Consumer) resumeConns() {
+	conns := r.conns()
+	var expired []*Conn
+	r.backoffMtx.Lock()
+	for _, c := range conns {
+		if b, ok := r.connBackoffs[c.String()]; ok && b.timer == nil {
+			expired = append(expired, c)
+		}
+	}
+	r.backoffMtx.Unlock()
+
+	for _, c := range expired {
+		r.log(LogLevelWarning, "(%s) backoff timeout expired while paused, sending RDY 1", c)
+		r.updateRDY(c, 1)
+	}
+}
+
+// connInBackoff indicates whether conn is backing off (see Config.BackoffPerConnection)
+func (r *Consumer) connInBackoff(conn *Conn) bool {
+	r.backoffMtx.Lock()
+	_, ok := r.connBackoffs[conn.String()]
+	r.backoffMtx.Unlock()
+	return ok
+}
+
+// applyBackoffJitter randomly shortens d by up to BackoffJitter of its length
+func (r *Consumer) applyBackoffJitter(d time.Duration) time.Duration {
+	if r.config.BackoffJitter <= 0 || d <= 0 {
+		return d
+	}
+	r.rngMtx.Lock()
+	f := r.rng.Float64()
+	r.rngMtx.Unlock()
+	return d - time.Duration(f*r.config.BackoffJitter*float64(d))
+}
+
+func (r *Consumer) backoff(d time.Duration) {
+	atomic.StoreInt64(&r.backoffDuration, d.Nanoseconds())
+	atomic.AddInt64(&r.backoffTime, d.Nanoseconds())
+	time.AfterFunc(d, r.resume)
+}
+
+func (r *Consumer) resume() {
+	if atomic.LoadInt32(&r.stopFlag) == 1 {
+		atomic.StoreInt64(&r.backoffDuration, 0)
+		return
+	}
+
+	// pick a random connection to test the waters
+	conns := r.conns()
+	if len(conns) == 0 {
+		r.log(LogLevelWarning, "no connection available to resume")
+		r.log(LogLevelWarning, "backing off for %s", time.Second)
+		r.backoff(time.Second)
+		return
+	}
+	r.rngMtx.Lock()
+	idx := r.rng.Intn(len(conns))
+	r.rngMtx.Unlock()
+	choice := conns[idx]
+
+	r.log(LogLevelWarning,
+		"(%s) backoff timeout expired, sending RDY 1",
+		choice.String())
+
+	// while in backoff only ever let 1 message at a time through
+	err := r.updateRDY(choice, 1)
+	if err != nil {
+		r.log(LogLevelWarning, "(%s) error resuming RDY 1 - %s", choice.String(), err)
+		r.log(LogLevelWarning, "backing off for %s", time.Second)
+		r.backoff(time.Second)
+		return
+	}
+
+	atomic.StoreInt64(&r.backoffDuration, 0)
+}
+
+func (r *Consumer) inBackoff() bool {
 	return atomic.LoadInt32(&r.backoffCounter) > 0
 }
 
@@ -886,19 +1593,72 @@ func (r *Consumer) maybeUpdateRDY(conn *Conn) {
 			conn, inBackoff, inBackoffTimeout)
 		return
 	}
+	if r.connInBackoff(conn) {
+		r.log(LogLevelDebug, "(%s) skip sending RDY connection in backoff", conn)
+		return
+	}
 
 	count := r.perConnMaxInFlight()
 	r.log(LogLevelDebug, "(%s) sending RDY %d", conn, count)
 	r.updateRDY(conn, count)
 }
 
+// updateAllRDY updates the RDY count of every connection to its share of
+// max in flight, lowering connections above it before raising the others
+// (which would otherwise be refused for exceeding max in flight)
+func (r *Consumer) updateAllRDY() {
+	conns := r.conns()
+	count := r.perConnMaxInFlight()
+	for _, c := range conns {
+		if c.RDY() > count {
+			r.maybeUpdateRDY(c)
+		}
+	}
+	for _, c := range conns {
+		if c.RDY() <= count {
+			r.maybeUpdateRDY(c)
+		}
+	}
+}
+
 func (r *Consumer) rdyLoop() {
 	redistributeTicker := time.NewTicker(r.config.RDYRedistributeInterval)
 
+	var starvationChan <-chan time.Time
+	var starvedSince time.Time
+	var starved bool
+	if r.config.StarvationThreshold > 0 {
+		interval := r.config.StarvationThreshold / 10
+		if interval < 10*time.Millisecond {
+			interval = 10 * time.Millisecond
+		}
+		starvationTicker := time.NewTicker(interval)
+		defer starvationTicker.Stop()
+		starvationChan = starvationTicker.C
+	}
+
 	for {
 		select {
 		case <-redistributeTicker.C:
 			r.redistributeRDY()
+		case now := <-starvationChan:
+			if !r.IsStarved() {
+				if starved {
+					r.log(LogLevelInfo, "no longer starved")
+					r.onStarvation(false)
+				}
+				starvedSince = time.Time{}
+				starved = false
+				continue
+			}
+			if starvedSince.IsZero() {
+				starvedSince = now
+			}
+			if !starved && now.Sub(starvedSince) >= r.config.StarvationThreshold {
+				r.log(LogLevelWarning, "starved for %s", now.Sub(starvedSince))
+				starved = true
+				r.onStarvation(true)
+			}
 		case <-r.exitChan:
 			goto exit
 		}
@@ -910,11 +1670,25 @@ exit:
 	r.wg.Done()
 }
 
+func (r *Consumer) onStarvation(starved bool) {
+	r.mtx.RLock()
+	f := r.starvation
+	r.mtx.RUnlock()
+	if f != nil {
+		f(starved)
+	}
+}
+
 func (r *Consumer) updateRDY(c *Conn, count int64) error {
 	if c.IsClosing() {
 		return ErrClosing
 	}
 
+	// while paused only RDY 0 may be sent (see Pause)
+	if count > 0 && r.IsPaused() {
+		return nil
+	}
+
 	// never exceed the nsqd's configured max RDY count
 	if count > c.MaxRDY() {
 		count = c.MaxRDY()
@@ -935,7 +1709,8 @@ func (r *Consumer) updateRDY(c *Conn, count int64) error {
 	if maxPossibleRdy > 0 && maxPossibleRdy < count {
 		count = maxPossibleRdy
 	}
-	if maxPossibleRdy <= 0 && count > 0 {
+	// unless lowering it, which is always possible
+	if maxPossibleRdy <= 0 && count > 0 && count >= rdyCount {
 		if rdyCount == 0 {
 			// we wanted to exit a zero RDY count but we couldn't send it...
 			// in order to prevent eternal starvation we reschedule this attempt
@@ -1019,6 +1794,9 @@ func (r *Consumer) redistributeRDY() {
 				r.updateRDY(c, 0)
 			}
 		}
+		if r.connInBackoff(c) {
+			continue
+		}
 		possibleConns = append(possibleConns, c)
 	}
 
@@ -1027,6 +1805,18 @@ func (r *Consumer) redistributeRDY() {
 		availableMaxInFlight = 1 - atomic.LoadInt64(&r.totalRdyCount)
 	}
 
+	if r.config.RDYRedistributeStrategy == "arrival" {
+		for _, c := range r.arrivalOrder(possibleConns) {
+			if availableMaxInFlight <= 0 {
+				break
+			}
+			availableMaxInFlight--
+			r.log(LogLevelDebug, "(%s) redistributing RDY", c.String())
+			r.updateRDY(c, 1)
+		}
+		return
+	}
+
 	for len(possibleConns) > 0 && availableMaxInFlight > 0 {
 		availableMaxInFlight--
 		r.rngMtx.Lock()
@@ -1040,15 +1830,130 @@ func (r *Consumer) redistributeRDY() {
 	}
 }
 
+// Pause stops receiving messages by setting the RDY count of every
+// connection to 0, until Resume is called.
+//
+// Connections stay open and messages already in-flight are still handled
+// (and responded to) as usual.
+func (r *Consumer) Pause() {
+	if !atomic.CompareAndSwapInt32(&r.pausedFlag, 0, 1) {
+		return
+	}
+
+	r.log(LogLevelInfo, "pausing, setting all to RDY 0")
+	for _, c := range r.conns() {
+		r.updateRDY(c, 0)
+	}
+}
+
+// Resume restores the RDY count of every connection after Pause
+// (respecting any ongoing backoff)
+func (r *Consumer) Resume() {
+	if !atomic.CompareAndSwapInt32(&r.pausedFlag, 1, 0) {
+		return
+	}
+
+	r.log(LogLevelInfo, "resuming")
+	switch {
+	case r.inBackoffTimeout():
+		// the backoff timeout will send RDY when it expires
+	case r.inBackoff():
+		r.resume()
+	default:
+		r.updateAllRDY()
+	}
+	if r.config.BackoffPerConnection {
+		r.resumeConns()
+	}
+}
+
+// Drain stops receiving messages (see Pause) and returns a channel that is
+// closed once every message in flight has been handled and responded to.
+//
+// Unlike Stop, connections stay open and Resume may be called to continue
+// receiving messages.
+func (r *Consumer) Drain() <-chan struct{} {
+	r.Pause()
+
+	drained := make(chan struct{})
+	r.drainMtx.Lock()
+	r.drainChans = append(r.drainChans, drained)
+	r.drainMtx.Unlock()
+
+	r.checkDrained()
+	return drained
+}
+
+// checkDrained signals the Drain channels when no messages are in flight
+func (r *Consumer) checkDrained() {
+	r.drainMtx.Lock()
+	defer r.drainMtx.Unlock()
+	if len(r.drainChans) == 0 || r.messagesInFlight() > 0 {
+		return
+	}
+	r.log(LogLevelInfo, "drained")
+	for _, drained := range r.drainChans {
+		close(drained)
+	}
+	r.drainChans = nil
+}
+
+// messagesInFlight returns the number of messages received and not yet
+// responded to across all connections
+func (r *Consumer) messagesInFlight() int64 {
+	var inFlight int64
+	for _, c := range r.conns() {
+		inFlight += atomic.LoadInt64(&c.messagesInFlight)
+	}
+	return inFlight
+}
+
+// IsPaused indicates whether the Consumer is paused (see Pause)
+func (r *Consumer) IsPaused() bool {
+	return atomic.LoadInt32(&r.pausedFlag) == 1
+}
+
+// arrivalOrder returns the conns without RDY in the order they should be given
+// RDY (see Config.RDYRedistributeStrategy)
+func (r *Consumer) arrivalOrder(conns []*Conn) []*Conn {
+	now := time.Now()
+	overdue := func(c *Conn) bool {
+		return now.Sub(c.LastRdyTime()) > 2*r.config.LowRdyTimeout
+	}
+	delivered := func(c *Conn) bool {
+		return c.LastMessageTime().After(c.LastRdyTime())
+	}
+
+	candidates := make([]*Conn, 0, len(conns))
+	for _, c := range conns {
+		if c.RDY() == 0 {
+			candidates = append(candidates, c)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if overdue(a) != overdue(b) {
+			return overdue(a)
+		}
+		if delivered(a) != delivered(b) {
+			return delivered(a)
+		}
+		return a.LastRdyTime().Before(b.LastRdyTime())
+	})
+	return candidates
+}
+
 // Stop will initiate a graceful stop of the Consumer (permanent)
 //
 // NOTE: receive on StopChan to block until this process completes
+// (or use StopWithTimeout)
 func (r *Consumer) Stop() {
 	if !atomic.CompareAndSwapInt32(&r.stopFlag, 0, 1) {
 		return
 	}
 
 	r.log(LogLevelInfo, "stopping...")
+	r.cancel()
 
 	if len(r.conns()) == 0 {
 		r.stopHandlers()
@@ -1071,6 +1976,79 @@ func (r *Consumer) Stop() {
 	}
 }
 
+// StopWithTimeout initiates a graceful stop of the Consumer (see Stop) and
+// blocks until it completes or timeout expires, whichever happens first.
+//
+// It returns the number of messages still in flight when timeout expired
+// (0 if the stop completed), which nsqd will requeue once they time out or
+// their connections are closed.
+func (r *Consumer) StopWithTimeout(timeout time.Duration) int {
+	r.Stop()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-r.StopChan:
+		return 0
+	case <-timer.C:
+	}
+
+	inFlight := r.messagesInFlight()
+	r.log(LogLevelWarning, "stop timed out after %s with %d messages in flight", timeout, inFlight)
+	// as when Stop times out, bypass the (blocked) handlers
+	r.exit()
+	return int(inFlight)
+}
+
+// Run connects to the nsqlookupd and nsqd addresses (see ConnectToNSQLookupds
+// and ConnectToNSQDs), consumes until ctx is done (or the Consumer is stopped
+// otherwise), then stops the Consumer gracefully (see Stop) and blocks until
+// the stop completes, so that it can be the only call of an errgroup:
+//
+//	g.Go(func() error {
+//		return consumer.Run(ctx, []string{"127.0.0.1:4161"}, nil)
+//	})
+//
+// Handlers must be added before calling Run. Without addresses, the Consumer
+// must already be connected (e.g. with ConnectToNSQDWithConfig), otherwise
+// ErrNotConnected is returned. When connecting fails, the Consumer is stopped
+// and the error returned.
+//
+// It returns nil once stopped, unless the stop was forced with messages still
+// in flight, i.e. handlers were still processing them 30s after stopping (or
+// StopWithTimeout timed out), for which it returns an error.
+func (r *Consumer) Run(ctx context.Context, nsqlookupdAddrs []string, nsqdAddrs []string) error {
+	var err error
+	if len(nsqlookupdAddrs) > 0 {
+		err = r.ConnectToNSQLookupds(nsqlookupdAddrs)
+	}
+	if err == nil && len(nsqdAddrs) > 0 {
+		err = r.ConnectToNSQDs(nsqdAddrs)
+	}
+	if err == nil && atomic.LoadInt32(&r.connectedFlag) == 0 {
+		return ErrNotConnected
+	}
+	if err != nil {
+		r.Stop()
+		if atomic.LoadInt32(&r.runningHandlers) > 0 {
+			<-r.StopChan
+		}
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		r.Stop()
+	case <-r.ctx.Done():
+	}
+	<-r.StopChan
+
+	if inFlight := r.messagesInFlight(); inFlight > 0 {
+		return fmt.Errorf("stopped with %d messages in flight", inFlight)
+	}
+	return nil
+}
+
 func (r *Consumer) stopHandlers() {
 	r.stopHandler.Do(func() {
 		r.log(LogLevelInfo, "stopping handlers")
@@ -1094,67 +2072,417 @@ func (r *Consumer) AddHandler(handler Handler) {
 //
 // This panics if called after connecting to NSQD or NSQ Lookupd
 //
+// The number of goroutines can be changed later with ChangeConcurrentHandlers
+// (or follow max_in_flight, see Config.AutoHandlerConcurrency, in which case
+// concurrency is ignored).
+//
 // (see Handler or HandlerFunc for details on implementing this interface)
 func (r *Consumer) AddConcurrentHandlers(handler Handler, concurrency int) {
 	if atomic.LoadInt32(&r.connectedFlag) == 1 {
 		panic("already connected")
 	}
 
+	if r.config.AutoHandlerConcurrency && r.getMaxInFlight() > 0 {
+		concurrency = int(r.getMaxInFlight())
+	}
+
+	p := &handlerPool{handler: handler}
+	r.poolMtx.Lock()
+	r.handlerPools = append(r.handlerPools, p)
+	r.resizeHandlerPool(p, concurrency)
+	r.poolMtx.Unlock()
+}
+
+// handlerPool is the goroutines running a Handler, each of which stops
+// when its channel is closed
+type handlerPool struct {
+	handler Handler
+	stops   []chan struct{}
+}
+
+// ChangeConcurrentHandlers changes the number of goroutines running the
+// Handler (see AddConcurrentHandlers), starting new ones or stopping existing
+// ones once they have handled their current message.
+//
+// It returns an error unless exactly one Handler was added (with AddHandler or
+// AddConcurrentHandlers).
+func (r *Consumer) ChangeConcurrentHandlers(concurrency int) error {
+	if concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+
+	r.poolMtx.Lock()
+	defer r.poolMtx.Unlock()
+	if len(r.handlerPools) != 1 {
+		return errors.New("ChangeConcurrentHandlers requires exactly one Handler")
+	}
+	if atomic.LoadInt32(&r.stopFlag) == 1 {
+		return ErrStopped
+	}
+	r.resizeHandlerPool(r.handlerPools[0], concurrency)
+	return nil
+}
+
+// resizeHandlerPool starts or stops goroutines of p, r.poolMtx must be held
+func (r *Consumer) resizeHandlerPool(p *handlerPool, concurrency int) {
+	if n := len(p.stops); n != concurrency && n > 0 {
+		r.log(LogLevelInfo, "changing handler concurrency from %d to %d", n, concurrency)
+	}
+	for len(p.stops) < concurrency {
+		stop := make(chan struct{})
+		p.stops = append(p.stops, stop)
+		atomic.AddInt32(&r.runningHandlers, 1)
+		go r.handlerLoop(p.handler, r.incomingMessages, stop)
+	}
+	for len(p.stops) > concurrency {
+		close(p.stops[len(p.stops)-1])
+		p.stops = p.stops[:len(p.stops)-1]
+	}
+}
+
+// KeyFunc returns the key of a message, see AddOrderedHandlers
+type KeyFunc func(message *Message) string
+
+// AddOrderedHandlers sets the Handler for messages received by this Consumer,
+// like AddConcurrentHandlers, but routes each message to one of the concurrency
+// goroutines by the key keyFunc returns for it: messages with the same key are
+// handled serially, in the order they are received, while messages with
+// different keys may be handled in parallel.
+//
+// NOTE: a requeued message is redelivered after messages with the same key
+// received in the meantime.
+//
+// This panics if called after connecting to NSQD or NSQ Lookupd, or if
+// concurrency is less than 1
+func (r *Consumer) AddOrderedHandlers(handler Handler, concurrency int, keyFunc KeyFunc) {
+	if concurrency < 1 {
+		panic("concurrency must be at least 1")
+	}
+	if atomic.LoadInt32(&r.connectedFlag) == 1 {
+		panic("already connected")
+	}
+
+	workers := make([]chan *Message, concurrency)
 	atomic.AddInt32(&r.runningHandlers, int32(concurrency))
-	for i := 0; i < concurrency; i++ {
-		go r.handlerLoop(handler)
+	for i := range workers {
+		// buffered so that a slow key only holds up the dispatching of other
+		// keys once max_in_flight messages are waiting on it
+		workers[i] = make(chan *Message, r.config.MaxInFlight)
+		go r.handlerLoop(handler, workers[i], nil)
 	}
+	go r.dispatchLoop(keyFunc, workers)
 }
 
-func (r *Consumer) handlerLoop(handler Handler) {
+// dispatchLoop routes messages to workers by the hash of their key
+func (r *Consumer) dispatchLoop(keyFunc KeyFunc, workers []chan *Message) {
+	for message := range r.incomingMessages {
+		h := fnv.New32a()
+		h.Write([]byte(keyFunc(message)))
+		workers[h.Sum32()%uint32(len(workers))] <- message
+	}
+	for _, w := range workers {
+		close(w)
+	}
+}
+
+// Messages returns a channel of the messages received by this Consumer, as an
+// alternative to AddHandler (with which it should not be combined).
+//
+// Messages are not responded to automatically (see DisableAutoResponse), the
+// application must Finish or Requeue each message it receives. Messages that
+// exceeded MaxAttempts are not delivered (see AddHandler). The channel is
+// closed when the Consumer stops.
+//
+// This panics if called after connecting to NSQD or NSQ Lookupd
+func (r *Consumer) Messages() <-chan *Message {
+	h := &channelHandler{
+		messages: make(chan *Message),
+		exitChan: r.exitChan,
+	}
+	if atomic.LoadInt32(&r.connectedFlag) == 1 {
+		panic("already connected")
+	}
+	// not added as a handlerPool, a single goroutine must send (and close)
+	atomic.AddInt32(&r.runningHandlers, 1)
+	go r.handlerLoop(h, r.incomingMessages, nil)
+	return h.messages
+}
+
+// channelHandler delivers messages to a channel, see Messages
+type channelHandler struct {
+	messages chan *Message
+	exitChan chan int
+}
+
+func (h *channelHandler) HandleMessage(m *Message) error {
+	m.DisableAutoResponse()
+	select {
+	case h.messages <- m:
+	case <-h.exitChan:
+		// the Consumer exited without waiting for its handlers (see Stop),
+		// nsqd will requeue the message once it times out
+	}
+	return nil
+}
+
+// Use appends middleware wrapping every handler of this Consumer, in order
+// (the first being the outermost). Messages that exceeded MaxAttempts are
+// not passed to it.
+//
+// This panics if called after connecting to NSQD or NSQ Lookupd
+func (r *Consumer) Use(mw ...MiddlewareFunc) {
+	if atomic.LoadInt32(&r.connectedFlag) == 1 {
+		panic("already connected")
+	}
+	r.mtx.Lock()
+	r.middleware = append(r.middleware, mw...)
+	r.mtx.Unlock()
+}
+
+// withMiddleware returns handler wrapped in the middleware
+func (r *Consumer) withMiddleware(handler Handler) Handler {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](handler)
+	}
+	return handler
+}
+
+// AddHandlerWithContext is like AddHandler for a HandlerWithContext
+func (r *Consumer) AddHandlerWithContext(handler HandlerWithContext) {
+	r.AddConcurrentHandlersWithContext(handler, 1)
+}
+
+// AddConcurrentHandlersWithContext is like AddConcurrentHandlers for a HandlerWithContext
+func (r *Consumer) AddConcurrentHandlersWithContext(handler HandlerWithContext, concurrency int) {
+	r.AddConcurrentHandlers(&contextHandler{r, handler}, concurrency)
+}
+
+// contextHandler adapts a HandlerWithContext to a Handler
+type contextHandler struct {
+	r *Consumer
+	h HandlerWithContext
+}
+
+// the deadline of a HandlerWithContext's context leaves 1/handlerTimeoutMargin
+// of the time remaining until the message's server-side timeout expires
+const handlerTimeoutMargin = 10
+
+func (h *contextHandler) HandleMessage(m *Message) error {
+	var deadline time.Time
+	if !m.timeoutAt.IsZero() {
+		margin := time.Until(m.timeoutAt) / handlerTimeoutMargin
+		deadline = m.timeoutAt.Add(-margin)
+	}
+	if timeout := h.r.config.HandlerTimeout; timeout > 0 {
+		if d := time.Now().Add(timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+
+	ctx := h.r.ctx
+	if tc, ok := m.TraceContext(); ok {
+		ctx = ContextWithTraceContext(ctx, tc)
+	}
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	return h.h.HandleMessage(ctx, m)
+}
+
+// LogFailedMessage forwards to the wrapped handler if it is a FailedMessageLogger
+func (h *contextHandler) LogFailedMessage(m *Message) {
+	if logger, ok := h.h.(FailedMessageLogger); ok {
+		logger.LogFailedMessage(m)
+	}
+}
+
+func (r *Consumer) handlerLoop(handler Handler, messages <-chan *Message, stop <-chan struct{}) {
 	r.log(LogLevelDebug, "starting Handler")
 
+	// wrapped once connected (i.e. when Use can no longer be called)
+	var wrapped Handler
 	for {
-		message, ok := <-r.incomingMessages
-		if !ok {
+		var message *Message
+		select {
+		case message = <-messages:
+		case <-stop:
+		}
+		if message == nil {
 			goto exit
 		}
 
-		if r.shouldFailMessage(message, handler) {
-			message.Finish()
-			continue
+		if wrapped == nil {
+			wrapped = r.withMiddleware(handler)
 		}
+		r.processMessage(handler, wrapped, message)
+		// drop the reference held while handling (see Config.PoolMessages)
+		message.Release()
+	}
 
-		err := handler.HandleMessage(message)
-		if err != nil {
-			r.log(LogLevelError, "Handler returned error (%s) for msg %s", err, message.ID)
-			if !message.IsAutoResponseDisabled() {
-				message.Requeue(-1)
-			}
-			continue
+exit:
+	r.log(LogLevelDebug, "stopping Handler")
+	if h, ok := handler.(*channelHandler); ok {
+		// this goroutine is its only sender
+		close(h.messages)
+	}
+	if atomic.AddInt32(&r.runningHandlers, -1) == 0 {
+		r.exit()
+	}
+}
+
+// processMessage filters, deduplicates, dead-letters or handles (with the
+// middleware-wrapped handler) a message, responding to it unless disabled
+func (r *Consumer) processMessage(handler Handler, wrapped Handler, message *Message) {
+	if !r.filterMessage(message) {
+		atomic.AddUint64(&r.messagesFiltered, 1)
+		message.Finish()
+		return
+	}
+
+	if r.isDuplicate(message) {
+		atomic.AddUint64(&r.messagesDeduped, 1)
+		message.Finish()
+		return
+	}
+
+	if r.shouldFailMessage(message) {
+		if err := r.publishDeadLetter(message); err != nil {
+			// not given up yet, the message is redelivered for another try
+			r.log(LogLevelError, "failed to publish msg %s to dead-letter topic - %s", message.ID, err)
+			message.RequeueWithoutBackoff(-1)
+			return
 		}
+		r.giveUp(message, handler)
+		message.Finish()
+		return
+	}
 
+	err := r.handleMessage(wrapped, message)
+	var requeue ErrRequeueWithoutBackoff
+	if errors.As(err, &requeue) {
+		r.log(LogLevelInfo, "Handler requeued msg %s (%s)", message.ID, err)
+		if !message.IsAutoResponseDisabled() {
+			message.RequeueWithoutBackoff(requeue.Delay)
+		}
+		return
+	}
+	if err != nil {
+		r.log(LogLevelError, "Handler returned error (%s) for msg %s", err, message.ID)
 		if !message.IsAutoResponseDisabled() {
-			message.Finish()
+			message.Requeue(-1)
 		}
+		return
 	}
 
-exit:
-	r.log(LogLevelDebug, "stopping Handler")
-	if atomic.AddInt32(&r.runningHandlers, -1) == 0 {
-		r.exit()
+	if !message.IsAutoResponseDisabled() {
+		message.Finish()
+	}
+}
+
+// handleMessage calls handler, returning a recovered panic as an error
+// (when enabled) and requeueing the message if it times out
+func (r *Consumer) handleMessage(handler Handler, message *Message) (err error) {
+	if timeout := r.config.HandlerTimeout; timeout > 0 {
+		start := time.Now()
+		// a sync.Once so that the handler returning waits for the timer's requeue
+		var once sync.Once
+		onTimeout := func() {
+			once.Do(func() {
+				if message.HasResponded() {
+					return
+				}
+				atomic.AddUint64(&r.handlerTimeouts, 1)
+				r.log(LogLevelWarning, "Handler timed out after %s for msg %s, requeueing", timeout, message.ID)
+				message.Requeue(-1)
+			})
+		}
+		timer := time.AfterFunc(timeout, onTimeout)
+		defer func() {
+			timer.Stop()
+			// the handler may return (e.g. on its context's deadline) before the timer fires
+			if time.Since(start) >= timeout {
+				onTimeout()
+			}
+		}()
+	}
+	if r.config.RecoverHandlerPanics {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			stack := debug.Stack()
+			atomic.AddUint64(&r.handlerPanics, 1)
+			r.log(LogLevelError, "Handler panicked for msg %s - %v\n%s", message.ID, p, stack)
+
+			r.mtx.RLock()
+			f := r.panicHandler
+			r.mtx.RUnlock()
+			if f != nil {
+				f(message, p, stack)
+			}
+
+			err = fmt.Errorf("handler panic - %v", p)
+			// requeued by the caller otherwise
+			if message.IsAutoResponseDisabled() && !message.HasResponded() {
+				message.Requeue(-1)
+			}
+		}()
 	}
+	return handler.HandleMessage(message)
 }
 
-func (r *Consumer) shouldFailMessage(message *Message, handler interface{}) bool {
+// filterMessage reports whether message passes the filter (see SetFilter)
+func (r *Consumer) filterMessage(message *Message) bool {
+	r.mtx.RLock()
+	filter := r.filter
+	r.mtx.RUnlock()
+	return filter == nil || filter(message)
+}
+
+// isDuplicate reports whether a message with the same key was finished
+// within the dedupe window (see Config.DedupeWindow)
+func (r *Consumer) isDuplicate(message *Message) bool {
+	if r.dedupe == nil {
+		return false
+	}
+	message.dedupeKey = dedupeKey(message)
+	if !r.dedupe.Seen(message.dedupeKey) {
+		return false
+	}
+	r.log(LogLevelDebug, "msg %s is a duplicate of a finished message (key %q), finishing",
+		message.ID, message.dedupeKey)
+	return true
+}
+
+func (r *Consumer) shouldFailMessage(message *Message) bool {
 	// message passed the max number of attempts
-	if r.config.MaxAttempts > 0 && message.Attempts > r.config.MaxAttempts {
-		r.log(LogLevelWarning, "msg %s attempted %d times, giving up",
-			message.ID, message.Attempts)
+	return r.config.MaxAttempts > 0 && message.Attempts > r.config.MaxAttempts
+}
 
-		logger, ok := handler.(FailedMessageLogger)
-		if ok {
-			logger.LogFailedMessage(message)
-		}
+// giveUp notifies the FailedMessageLogger, give-up handler and OnGiveUp hook
+// of a message that exceeded the max number of attempts
+func (r *Consumer) giveUp(message *Message, handler interface{}) {
+	r.log(LogLevelWarning, "msg %s attempted %d times, giving up",
+		message.ID, message.Attempts)
 
-		return true
+	logger, ok := handler.(FailedMessageLogger)
+	if ok {
+		logger.LogFailedMessage(message)
+	}
+	r.mtx.RLock()
+	giveUp := r.giveUpHandler
+	r.mtx.RUnlock()
+	if giveUp != nil {
+		giveUp(message)
+	}
+	if f := r.getHooks().OnGiveUp; f != nil {
+		f(message)
 	}
-	return false
 }
 
 func (r *Consumer) exit() {
@@ -1166,6 +2494,14 @@ func (r *Consumer) exit() {
 }
 
 func (r *Consumer) log(lvl LogLevel, line string, args ...interface{}) {
+	if l, logLvl := r.getStructuredLogger(); l != nil {
+		if logLvl <= lvl {
+			msg, keyvals := logFields(r.logKeyvals(), line, args)
+			l.Log(lvl, msg, keyvals...)
+		}
+		return
+	}
+
 	logger, logLvl := r.getLogger(lvl)
 
 	if logger == nil {
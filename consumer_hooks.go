@@ -0,0 +1,46 @@
+package nsq
+
+import (
+	"time"
+)
+
+// ConsumerHooks are callbacks invoked by a Consumer (see SetHooks), any of
+// which may be nil
+//
+// They are called synchronously from the Consumer's internal goroutines and
+// must not block. They may read the state of the Consumer (e.g. Stats).
+type ConsumerHooks struct {
+	// OnConnect is called each time a connection to nsqd is established
+	OnConnect func(addr string)
+	// OnDisconnect is called each time a connection to nsqd is closed, with
+	// the error that caused it (nil when closed cleanly)
+	OnDisconnect func(addr string, err error)
+	// OnBackoff is called each time the Consumer (or, with
+	// Config.BackoffPerConnection, a connection) starts backing off
+	OnBackoff func(d time.Duration)
+	// OnResume is called when the Consumer (or a connection) exits backoff
+	OnResume func()
+	// OnGiveUp is called for each message that exceeded Config.MaxAttempts,
+	// once it is given up (see Consumer.SetGiveUpHandler)
+	OnGiveUp func(message *Message)
+	// OnClockSkew is called when the timestamps of the messages from an nsqd
+	// start being skewed from the local time (see Config.ClockSkewThreshold),
+	// with the skew (positive when its clock is behind)
+	OnClockSkew func(addr string, skew time.Duration)
+}
+
+// SetHooks registers hooks, replacing any registered previously
+func (r *Consumer) SetHooks(hooks ConsumerHooks) {
+	r.hooks.Store(&hooks)
+}
+
+// noConsumerHooks is returned by getHooks until SetHooks is called
+var noConsumerHooks = &ConsumerHooks{}
+
+func (r *Consumer) getHooks() *ConsumerHooks {
+	hooks, _ := r.hooks.Load().(*ConsumerHooks)
+	if hooks == nil {
+		return noConsumerHooks
+	}
+	return hooks
+}
@@ -3,6 +3,7 @@ package nsq
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -156,6 +158,338 @@ func TestConsumerLookupdAuthorization(t *testing.T) {
 	}
 }
 
+func TestConsumerLookupdHTTPS(t *testing.T) {
+	var requests int32
+	lookupd := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "user" || password != "secret" {
+			t.Errorf("got Auth header %q", r.Header.Get("Authorization"))
+		}
+		w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+		w.Write([]byte(`{"producers":[]}`))
+	}))
+	defer lookupd.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(lookupd.Certificate())
+
+	config := NewConfig()
+	config.AuthSecret = "AuthSecret"
+	config.LookupdBasicAuth = "user:secret"
+	config.LookupdTLSConfig = &tls.Config{RootCAs: roots}
+	q, _ := NewConsumer("lookupd_https", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+	defer q.Stop()
+
+	if err := q.ConnectToNSQLookupd(lookupd.URL); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("lookupd call not completed")
+	}
+
+	if !strings.Contains(config.String(), "lookupd_basic_auth=<redacted>") {
+		t.Errorf("lookupd_basic_auth not redacted in %s", config)
+	}
+}
+
+type countingRoundTripper struct {
+	requests int32
+}
+
+func (rt *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&rt.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestConsumerLookupdHTTPClient(t *testing.T) {
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+		w.Write([]byte(`{"producers":[]}`))
+	}))
+	defer lookupd.Close()
+
+	rt := &countingRoundTripper{}
+	config := NewConfig()
+	if err := config.Set("lookupd_http_client", rt); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if config.LookupdHTTPClient == nil || config.LookupdHTTPClient.Transport != rt {
+		t.Fatalf("lookupd_http_client not set from a RoundTripper")
+	}
+	q, _ := NewConsumer("lookupd_http_client", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+	defer q.Stop()
+
+	if err := q.ConnectToNSQLookupd(lookupd.URL); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if atomic.LoadInt32(&rt.requests) != 1 {
+		t.Errorf("lookupd query did not use the configured client")
+	}
+}
+
+func TestConsumerLookupdPollFastInterval(t *testing.T) {
+	var requests int32
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+		w.Write([]byte(`{"producers":[]}`))
+	}))
+	defer lookupd.Close()
+
+	config := NewConfig()
+	config.LookupdPollInterval = time.Minute
+	config.LookupdPollJitter = 0
+	config.LookupdPollFastInterval = 20 * time.Millisecond
+	q, _ := NewConsumer("lookupd_poll_fast_interval", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+	defer q.Stop()
+
+	if err := q.ConnectToNSQLookupd(lookupd.URL); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// queried on connecting and after 20ms, 60ms and 140ms, then after 300ms
+	time.Sleep(220 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 4 {
+		t.Errorf("expected 4 lookupd queries, got %d", n)
+	}
+
+	var interval time.Duration
+	fast := 40 * time.Millisecond
+	for _, expected := range []time.Duration{40, 80, 160} {
+		if interval = q.nextLookupdPoll(&fast); interval != expected*time.Millisecond {
+			t.Errorf("poll interval %s != %dms", interval, expected)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		interval = q.nextLookupdPoll(&fast)
+	}
+	if interval != time.Minute || fast != 0 {
+		t.Errorf("poll interval did not decay to lookupd_poll_interval, got %s", interval)
+	}
+}
+
+func TestConsumerDisconnectFromLastNSQLookupd(t *testing.T) {
+	var requests int32
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+		w.Write([]byte(`{"producers":[]}`))
+	}))
+	defer lookupd.Close()
+
+	config := NewConfig()
+	config.LookupdPollInterval = 10 * time.Millisecond
+	config.LookupdPollJitter = 0
+	q, _ := NewConsumer("disconnect_lookupd", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+	defer q.Stop()
+
+	if err := q.ConnectToNSQLookupd(lookupd.URL); err != nil {
+		t.Fatalf(err.Error())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := q.DisconnectFromNSQLookupd(lookupd.URL); err != nil {
+		t.Fatalf("unexpected error disconnecting from the last nsqlookupd - %s", err)
+	}
+	if err := q.DisconnectFromNSQLookupd(lookupd.URL); err != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+
+	// polling stops...
+	time.Sleep(20 * time.Millisecond)
+	polled := atomic.LoadInt32(&requests)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != polled {
+		t.Fatalf("nsqlookupd still polled after disconnecting (%d queries)", n-polled)
+	}
+
+	// ...until it is added again
+	if err := q.ConnectToNSQLookupd(lookupd.URL); err != nil {
+		t.Fatalf(err.Error())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n < polled+2 {
+		t.Fatalf("nsqlookupd not polled after connecting again")
+	}
+}
+
+func TestConsumerApplyConfig(t *testing.T) {
+	config := NewConfig()
+	topicName := "apply_config" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	defer q.Stop()
+
+	reloaded := config.Clone()
+	reloaded.MaxInFlight = 50
+	reloaded.LookupdPollInterval = time.Second
+	reloaded.SampleRate = 10
+	if err := q.ApplyConfig(reloaded); err != nil {
+		t.Fatalf("unexpected error applying config - %s", err)
+	}
+	if q.getMaxInFlight() != 50 {
+		t.Errorf("max_in_flight %d != 50", q.getMaxInFlight())
+	}
+	if interval, _ := q.lookupdPollInterval(); interval != time.Second {
+		t.Errorf("lookupd_poll_interval %s != 1s", interval)
+	}
+
+	unsupported := config.Clone()
+	unsupported.Deflate = true
+	err := q.ApplyConfig(unsupported)
+	if err == nil || !strings.Contains(err.Error(), "deflate") {
+		t.Errorf("expected error changing deflate, got %v", err)
+	}
+
+	invalid := config.Clone()
+	invalid.MaxInFlight = -1
+	if err := q.ApplyConfig(invalid); err == nil {
+		t.Errorf("expected error applying invalid config")
+	}
+	if q.getMaxInFlight() != 50 {
+		t.Errorf("max_in_flight changed by rejected config")
+	}
+
+	// a TLS config holding functions (the certificate reloader of tls_cert)
+	tlsConfig := NewConfig()
+	tlsConfig.Set("tls_v1", true)
+	tlsConfig.Set("tls_cert", "./test/server.pem")
+	tlsConfig.Set("tls_key", "./test/server.key")
+	tq, _ := NewConsumer(topicName, "ch", tlsConfig)
+	tq.SetLogger(nullLogger, LogLevelInfo)
+	defer tq.Stop()
+	reloaded = tlsConfig.Clone()
+	reloaded.MaxInFlight = 50
+	if err := tq.ApplyConfig(reloaded); err != nil {
+		t.Errorf("unexpected error applying config with tls_cert - %s", err)
+	}
+	unsupported = tlsConfig.Clone()
+	unsupported.TlsConfig.InsecureSkipVerify = true
+	err = tq.ApplyConfig(unsupported)
+	if err == nil || !strings.Contains(err.Error(), "tls_config") {
+		t.Errorf("expected error changing tls_config, got %v", err)
+	}
+}
+
+func TestConsumerBackoffJitter(t *testing.T) {
+	config := NewConfig()
+	q, _ := NewConsumer("backoff_jitter", "ch", config)
+	if d := q.applyBackoffJitter(time.Second); d != time.Second {
+		t.Errorf("backoff %s changed without backoff_jitter", d)
+	}
+
+	config.Set("backoff_jitter", 0.5)
+	q, _ = NewConsumer("backoff_jitter", "ch", config)
+	varied := false
+	for i := 0; i < 100; i++ {
+		d := q.applyBackoffJitter(time.Second)
+		if d < 500*time.Millisecond || d > time.Second {
+			t.Fatalf("jittered backoff %s outside [500ms, 1s]", d)
+		}
+		if d != time.Second {
+			varied = true
+		}
+	}
+	if !varied {
+		t.Errorf("backoff_jitter had no effect")
+	}
+
+	if err := config.Set("backoff_jitter", 1.5); err == nil {
+		t.Errorf("no error setting backoff_jitter > 1")
+	}
+}
+
+func TestConsumerChangeConcurrentHandlers(t *testing.T) {
+	waitForHandlers := func(q *Consumer, n int32) {
+		for i := 0; atomic.LoadInt32(&q.runningHandlers) != n; i++ {
+			if i == 100 {
+				t.Fatalf("%d running handlers != %d", atomic.LoadInt32(&q.runningHandlers), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	q, _ := NewConsumer("concurrent_handlers", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	if err := q.ChangeConcurrentHandlers(2); err == nil {
+		t.Errorf("expected error without a handler")
+	}
+	q.AddConcurrentHandlers(HandlerFunc(func(m *Message) error { return nil }), 2)
+	if err := q.ChangeConcurrentHandlers(5); err != nil {
+		t.Fatalf("unexpected error - %s", err)
+	}
+	waitForHandlers(q, 5)
+	if err := q.ChangeConcurrentHandlers(1); err != nil {
+		t.Fatalf("unexpected error - %s", err)
+	}
+	waitForHandlers(q, 1)
+	if err := q.ChangeConcurrentHandlers(0); err == nil {
+		t.Errorf("expected error for concurrency 0")
+	}
+	q.Stop()
+	<-q.StopChan
+	if err := q.ChangeConcurrentHandlers(2); err != ErrStopped {
+		t.Errorf("expected ErrStopped, got %v", err)
+	}
+
+	config := NewConfig()
+	config.MaxInFlight = 4
+	config.AutoHandlerConcurrency = true
+	q, _ = NewConsumer("concurrent_handlers", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	defer q.Stop()
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+	waitForHandlers(q, 4)
+	q.ChangeMaxInFlight(8)
+	waitForHandlers(q, 8)
+	q.ChangeMaxInFlight(2)
+	waitForHandlers(q, 2)
+}
+
+func TestConsumerArrivalOrder(t *testing.T) {
+	config := NewConfig()
+	config.RDYRedistributeStrategy = "arrival"
+	q, _ := NewConsumer("arrival_order", "ch", config)
+	defer q.Stop()
+
+	now := time.Now()
+	conn := func(addr string, lastRdy time.Duration, lastMsg time.Duration, rdy int64) *Conn {
+		c := NewConn(addr, config, &consumerConnDelegate{q})
+		atomic.StoreInt64(&c.lastRdyTimestamp, now.Add(-lastRdy).UnixNano())
+		atomic.StoreInt64(&c.lastMsgTimestamp, now.Add(-lastMsg).UnixNano())
+		atomic.StoreInt64(&c.rdyCount, rdy)
+		return c
+	}
+	conns := []*Conn{
+		conn("idle", 20*time.Second, time.Hour, 0),
+		conn("holding", 10*time.Second, time.Second, 1),
+		conn("delivered", 5*time.Second, 4*time.Second, 0),
+		conn("overdue", time.Hour, time.Hour, 0),
+		conn("idle_older", 30*time.Second, time.Hour, 0),
+	}
+
+	var order []string
+	for _, c := range q.arrivalOrder(conns) {
+		order = append(order, c.String())
+	}
+	if got := strings.Join(order, ","); got != "overdue,delivered,idle_older,idle" {
+		t.Fatalf("unexpected order %s", got)
+	}
+
+	config.RDYRedistributeStrategy = "bogus"
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected invalid rdy_redistribute_strategy error")
+	}
+}
+
 func TestConsumerTLSClientCertViaSet(t *testing.T) {
 	consumerTest(t, func(c *Config) {
 		c.Set("tls_v1", true)
@@ -258,3 +592,52 @@ func consumerTest(t *testing.T, cb func(c *Config)) {
 		t.Fatal("failed message not done")
 	}
 }
+
+func TestTypedHandler(t *testing.T) {
+	type event struct {
+		Name string `json:"name"`
+	}
+
+	var handled []string
+	h := NewTypedHandler(func(e event, m *Message) error {
+		handled = append(handled, e.Name)
+		return nil
+	}, nil)
+
+	good := NewMessage(MessageID{'g', 'o', 'o', 'd'}, []byte(`{"name":"created"}`))
+	if err := h.HandleMessage(good); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if strings.Join(handled, ",") != "created" {
+		t.Fatalf("unexpected handled values %v", handled)
+	}
+
+	bad := NewMessage(MessageID{'b', 'a', 'd'}, []byte(`not json`))
+	if err := h.HandleMessage(bad); err == nil {
+		t.Fatalf("expected decoding error without a poison handler")
+	}
+
+	var poisoned []*Message
+	h.SetPoisonHandler(func(m *Message, err error) error {
+		poisoned = append(poisoned, m)
+		return nil
+	})
+	if err := h.HandleMessage(bad); err != nil {
+		t.Fatalf("unexpected error with a poison handler - %s", err)
+	}
+	if len(poisoned) != 1 || poisoned[0] != bad || len(handled) != 1 {
+		t.Fatalf("bad payload not passed to the poison handler")
+	}
+
+	upper := NewTypedHandler(func(s string, m *Message) error {
+		handled = append(handled, s)
+		return nil
+	}, func(data []byte, v *string) error {
+		*v = strings.ToUpper(string(data))
+		return nil
+	})
+	upper.HandleMessage(NewMessage(MessageID{'r', 'a', 'w'}, []byte("raw")))
+	if handled[len(handled)-1] != "RAW" {
+		t.Fatalf("custom unmarshaler not used, got %v", handled)
+	}
+}
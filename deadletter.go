@@ -0,0 +1,69 @@
+package nsq
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+)
+
+// Headers of the envelopes published to a dead-letter topic (see Consumer.SetDeadLetter)
+const (
+	HeaderOriginalTopic   = "original-topic"
+	HeaderOriginalChannel = "original-channel"
+	HeaderMessageID       = "message-id"
+	HeaderAttempts        = "attempts"
+	HeaderNSQDAddress     = "nsqd-address"
+	HeaderFailureReason   = "failure-reason"
+)
+
+// SetDeadLetter makes the Consumer publish messages that exceeded MaxAttempts
+// to topic with producer before FINishing them, rather than only discarding
+// them (see FailedMessageLogger).
+//
+// The body is published in an envelope (see PublishWithHeaders) with the
+// HeaderOriginalTopic, HeaderOriginalChannel, HeaderMessageID, HeaderAttempts,
+// HeaderNSQDAddress, HeaderFailureReason and HeaderTimestamp (of the original
+// message) headers. A message that fails to be published is requeued (without
+// backoff) and only given up (see SetGiveUpHandler) once it is published.
+//
+// This panics if called after connecting to NSQD or NSQ Lookupd
+func (r *Consumer) SetDeadLetter(producer *Producer, topic string) error {
+	if atomic.LoadInt32(&r.connectedFlag) == 1 {
+		panic("already connected")
+	}
+	if !IsValidTopicName(topic) {
+		return errors.New("invalid dead-letter topic name")
+	}
+	r.mtx.Lock()
+	r.deadLetterProducer = producer
+	r.deadLetterTopic = topic
+	r.mtx.Unlock()
+	return nil
+}
+
+// publishDeadLetter publishes message to the dead-letter topic (if any)
+func (r *Consumer) publishDeadLetter(message *Message) error {
+	r.mtx.RLock()
+	producer, topic := r.deadLetterProducer, r.deadLetterTopic
+	r.mtx.RUnlock()
+	if producer == nil {
+		return nil
+	}
+
+	headers := map[string]string{
+		HeaderOriginalTopic:   r.topic,
+		HeaderOriginalChannel: r.channel,
+		HeaderMessageID:       string(message.ID[:]),
+		HeaderAttempts:        strconv.Itoa(int(message.Attempts)),
+		HeaderNSQDAddress:     message.NSQDAddress,
+		HeaderFailureReason:   "max_attempts exceeded",
+		HeaderTimestamp:       strconv.FormatInt(message.Timestamp, 10),
+	}
+	// keep the headers of an envelope unwrapped by the EnvelopeCodec
+	for k, v := range message.Headers {
+		if _, ok := headers[k]; !ok {
+			headers[k] = v
+		}
+	}
+	return producer.PublishWithHeaders(topic, headers, message.Body)
+}
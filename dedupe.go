@@ -0,0 +1,114 @@
+package nsq
+
+import (
+	"sync"
+	"time"
+)
+
+// Deduplicator remembers the keys of messages handled within a time window,
+// so that duplicates (e.g. from publish retries or redeliveries) can be dropped
+type Deduplicator struct {
+	window  time.Duration
+	maxKeys int
+
+	mtx   sync.Mutex
+	seen  map[string]time.Time
+	order []dedupeEntry
+}
+
+type dedupeEntry struct {
+	key string
+	at  time.Time
+}
+
+// NewDeduplicator returns a Deduplicator that remembers keys for window
+func NewDeduplicator(window time.Duration) *Deduplicator {
+	return &Deduplicator{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// NewDeduplicatorWithMaxKeys returns a Deduplicator that remembers keys for
+// window, but no more than maxKeys of them (forgetting the oldest first)
+func NewDeduplicatorWithMaxKeys(window time.Duration, maxKeys int) *Deduplicator {
+	d := NewDeduplicator(window)
+	d.maxKeys = maxKeys
+	return d
+}
+
+// Seen returns true if key was added within the window
+func (d *Deduplicator) Seen(key string) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.expire(time.Now())
+	_, ok := d.seen[key]
+	return ok
+}
+
+// Add records key as seen
+func (d *Deduplicator) Add(key string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	now := time.Now()
+	d.seen[key] = now
+	d.order = append(d.order, dedupeEntry{key, now})
+	d.expire(now)
+}
+
+// expire forgets keys older than the window (and the oldest keys over
+// maxKeys), d.mtx must be held
+func (d *Deduplicator) expire(now time.Time) {
+	var i int
+	for ; i < len(d.order); i++ {
+		e := d.order[i]
+		overLimit := d.maxKeys > 0 && len(d.seen) > d.maxKeys
+		if now.Sub(e.at) < d.window && !overLimit {
+			break
+		}
+		// the key may have been added again since
+		if d.seen[e.key].Equal(e.at) {
+			delete(d.seen, e.key)
+		}
+	}
+	d.order = d.order[i:]
+}
+
+// Handler wraps h so that duplicate messages are finished without being
+// handled.
+//
+// A message is keyed by the dedupe ID of its envelope (see PublishWithDedupeID),
+// or by its ID when it isn't enveloped, and the key is only recorded once h
+// succeeds (so that a failed message can be retried). Enveloped messages are
+// passed to h with the envelope removed from their Body.
+func (d *Deduplicator) Handler(h Handler) Handler {
+	return HandlerFunc(func(m *Message) error {
+		key := dedupeKey(m)
+		if env, err := DecodeEnvelope(m.Body); err == nil {
+			m.Body = env.Body
+		}
+
+		if d.Seen(key) {
+			return nil
+		}
+		err := h.HandleMessage(m)
+		if err == nil {
+			d.Add(key)
+		}
+		return err
+	})
+}
+
+// dedupeKey returns the dedupe ID of the envelope of m (see PublishWithDedupeID),
+// or its ID when it isn't enveloped
+func dedupeKey(m *Message) string {
+	if id := m.Headers[HeaderDedupeID]; id != "" {
+		return id
+	}
+	if env, err := DecodeEnvelope(m.Body); err == nil {
+		if id := env.DedupeID(); id != "" {
+			return id
+		}
+	}
+	return string(m.ID[:])
+}
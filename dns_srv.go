@@ -0,0 +1,155 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// lookupSRV resolves DNS SRV records (replaceable in tests)
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// resolveSRV returns the "host:port" addresses of the SRV records of name,
+// ordered by priority and weight
+func resolveSRV(name string, timeout time.Duration) ([]string, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	_, records, err := lookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no SRV records for %s", name)
+	}
+	return addrs, nil
+}
+
+// ConnectToDNSSRV discovers the nsqd to connect to by resolving the DNS SRV
+// records of name (e.g. "_nsqd._tcp.example.com") and connects to each of them.
+//
+// A goroutine is spawned which resolves name again every LookupdPollInterval,
+// connecting to nsqd that were added to the record set and disconnecting from
+// those that were removed from it.
+func (r *Consumer) ConnectToDNSSRV(name string) error {
+	if atomic.LoadInt32(&r.stopFlag) == 1 {
+		return errors.New("consumer stopped")
+	}
+	if atomic.LoadInt32(&r.runningHandlers) == 0 {
+		return errors.New("no handlers")
+	}
+
+	addrs, err := resolveSRV(name, r.config.DialTimeout)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&r.connectedFlag, 1)
+
+	addrs = r.syncSRVAddrs(name, nil, addrs)
+
+	r.wg.Add(1)
+	go r.dnsSRVLoop(name, addrs)
+
+	return nil
+}
+
+// syncSRVAddrs connects to every allowed nsqd in addrs and disconnects from
+// those in previous that are no longer in it, returning the allowed addrs
+func (r *Consumer) syncSRVAddrs(name string, previous, addrs []string) []string {
+	addrs = filterNSQDAddrs(&r.config, addrs)
+	for _, addr := range addrs {
+		err := r.ConnectToNSQD(addr)
+		if err != nil && err != ErrAlreadyConnected {
+			r.log(LogLevelError, "(%s) error connecting to nsqd - %s", addr, err)
+		}
+	}
+	for _, addr := range previous {
+		if indexOf(addr, addrs) != -1 {
+			continue
+		}
+		r.log(LogLevelInfo, "(%s) removed from SRV records of %s, disconnecting", addr, name)
+		err := r.DisconnectFromNSQD(addr)
+		if err != nil && err != ErrNotConnected {
+			r.log(LogLevelError, "(%s) error disconnecting from nsqd - %s", addr, err)
+		}
+	}
+	return addrs
+}
+
+func (r *Consumer) dnsSRVLoop(name string, addrs []string) {
+	interval, _ := r.lookupdPollInterval()
+	ticker := time.NewTicker(interval)
+
+	for {
+		select {
+		case <-ticker.C:
+			resolved, err := resolveSRV(name, r.config.DialTimeout)
+			if err != nil {
+				r.log(LogLevelError, "error resolving SRV records of %s - %s", name, err)
+				continue
+			}
+			addrs = r.syncSRVAddrs(name, addrs, resolved)
+		case <-r.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	ticker.Stop()
+	r.log(LogLevelInfo, "exiting dnsSRVLoop")
+	r.wg.Done()
+}
+
+// producerDNSSRV discovers the nsqd a Producer publishes to via DNS SRV records
+type producerDNSSRV struct {
+	name string
+}
+
+// NewProducerFromDNSSRV returns an instance of Producer that discovers the
+// nsqd to publish to by resolving the DNS SRV records of name
+// (e.g. "_nsqd._tcp.example.com").
+//
+// Each time the Producer (re)connects it resolves name again and tries the
+// nsqd in the order of the records (by priority and weight), so that changes
+// to the record set are picked up and publishing moves on from an nsqd that
+// has failed. String returns the address of the nsqd currently in use.
+func NewProducerFromDNSSRV(name string, config *Config) (*Producer, error) {
+	if name == "" {
+		return nil, errors.New("empty SRV name")
+	}
+
+	w, err := NewProducer("", config)
+	if err != nil {
+		return nil, err
+	}
+	w.discoverer = &producerDNSSRV{name: name}
+	return w, nil
+}
+
+func (d *producerDNSSRV) discover(config *Config, previous string) ([]string, error) {
+	addrs, err := resolveSRV(d.name, config.DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve SRV records - %s", err)
+	}
+	addrs = filterNSQDAddrs(config, addrs)
+	if len(addrs) == 0 {
+		return nil, errors.New("no allowed nsqd in SRV records")
+	}
+	return moveToEnd(addrs, previous), nil
+}
@@ -0,0 +1,229 @@
+package nsq
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Well-known envelope headers
+const (
+	// HeaderDedupeID identifies a message across publish retries
+	// (see Producer.PublishWithDedupeID)
+	HeaderDedupeID = "dedupe-id"
+	// HeaderTimestamp is the time of the publish, in nanoseconds since the epoch
+	HeaderTimestamp = "timestamp"
+	// HeaderContentType is the media type of the body (e.g. ContentTypeJSON)
+	HeaderContentType = "content-type"
+	// HeaderSchemaVersion is the version of the schema of the body
+	HeaderSchemaVersion = "schema-version"
+)
+
+// ContentTypeJSON is the HeaderContentType of bodies published with PublishJSON
+const ContentTypeJSON = "application/json"
+
+// envelopeMagic prefixes an enveloped message body, its leading NUL
+// ensures that text (including JSON) bodies are never mistaken for one
+var envelopeMagic = []byte{0x00, 'N', 'E', 0x01}
+
+// ErrNotEnveloped is returned from DecodeEnvelope for a
+// message body that is not an envelope
+var ErrNotEnveloped = errors.New("not an envelope")
+
+// Envelope is a message body along with headers describing it
+//
+// On the wire it is the magic bytes 0x00 'N' 'E' 0x01, followed by the
+// 2-byte number of headers, each encoded as a 2-byte key length, key,
+// 4-byte value length and value, followed by the body (sizes are big endian).
+type Envelope struct {
+	Headers map[string]string
+	Body    []byte
+}
+
+// EncodeEnvelope returns body wrapped in an envelope with headers
+func EncodeEnvelope(headers map[string]string, body []byte) ([]byte, error) {
+	if len(headers) > 0xffff {
+		return nil, errors.New("too many envelope headers")
+	}
+	keys := make([]string, 0, len(headers))
+	size := len(envelopeMagic) + 2 + len(body)
+	for k, v := range headers {
+		if len(k) > 0xffff {
+			return nil, errors.New("envelope header key too long")
+		}
+		keys = append(keys, k)
+		size += 6 + len(k) + len(v)
+	}
+	// encode deterministically
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.Grow(size)
+	buf.Write(envelopeMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(len(keys)))
+	for _, k := range keys {
+		binary.Write(&buf, binary.BigEndian, uint16(len(k)))
+		buf.WriteString(k)
+		binary.Write(&buf, binary.BigEndian, uint32(len(headers[k])))
+		buf.WriteString(headers[k])
+	}
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// DecodeEnvelope decodes an enveloped message body, returning
+// ErrNotEnveloped if data does not start with the envelope magic bytes
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	if !bytes.HasPrefix(data, envelopeMagic) {
+		return nil, ErrNotEnveloped
+	}
+	data = data[len(envelopeMagic):]
+	errTruncated := errors.New("truncated envelope")
+
+	if len(data) < 2 {
+		return nil, errTruncated
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+
+	env := &Envelope{Headers: make(map[string]string, n)}
+	for i := 0; i < n; i++ {
+		if len(data) < 2 {
+			return nil, errTruncated
+		}
+		l := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+l+4 {
+			return nil, errTruncated
+		}
+		k := string(data[2 : 2+l])
+		data = data[2+l:]
+
+		vl := binary.BigEndian.Uint32(data)
+		if uint64(len(data)-4) < uint64(vl) {
+			return nil, errTruncated
+		}
+		env.Headers[k] = string(data[4 : 4+vl])
+		data = data[4+vl:]
+	}
+	env.Body = data
+	return env, nil
+}
+
+// ContentType returns the HeaderContentType header (if any)
+func (e *Envelope) ContentType() string {
+	return e.Headers[HeaderContentType]
+}
+
+// SchemaVersion returns the HeaderSchemaVersion header (if any)
+func (e *Envelope) SchemaVersion() string {
+	return e.Headers[HeaderSchemaVersion]
+}
+
+// DedupeID returns the HeaderDedupeID header (if any)
+func (e *Envelope) DedupeID() string {
+	return e.Headers[HeaderDedupeID]
+}
+
+// Timestamp returns the HeaderTimestamp header as a time.Time, ok is false
+// when the header is missing or invalid
+func (e *Envelope) Timestamp() (time.Time, bool) {
+	ns, err := strconv.ParseInt(e.Headers[HeaderTimestamp], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// EnvelopeCodec encodes and decodes enveloped message bodies, a Consumer
+// decodes them before dispatching messages to handlers (see
+// Consumer.SetEnvelopeCodec) to populate Message.Headers
+type EnvelopeCodec interface {
+	// Encode returns body wrapped in an envelope with headers
+	Encode(headers map[string]string, body []byte) ([]byte, error)
+	// Decode returns the headers and body of an enveloped message body, or
+	// ErrNotEnveloped if data isn't one
+	Decode(data []byte) (headers map[string]string, body []byte, err error)
+}
+
+// DefaultEnvelopeCodec is the EnvelopeCodec for the envelopes published with
+// PublishWithHeaders (see EncodeEnvelope and DecodeEnvelope)
+var DefaultEnvelopeCodec EnvelopeCodec = defaultEnvelopeCodec{}
+
+type defaultEnvelopeCodec struct{}
+
+func (defaultEnvelopeCodec) Encode(headers map[string]string, body []byte) ([]byte, error) {
+	return EncodeEnvelope(headers, body)
+}
+
+func (defaultEnvelopeCodec) Decode(data []byte) (map[string]string, []byte, error) {
+	env, err := DecodeEnvelope(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return env.Headers, env.Body, nil
+}
+
+// Envelope decodes the message body as an envelope (see PublishWithHeaders),
+// returning ErrNotEnveloped if it isn't one (as is the case once a Consumer's
+// EnvelopeCodec unwrapped it, see Message.Headers)
+//
+// The Body of the returned Envelope shares memory with the message Body.
+func (m *Message) Envelope() (*Envelope, error) {
+	return DecodeEnvelope(m.Body)
+}
+
+// NewDedupeID returns a random identifier suitable for PublishWithDedupeID
+func NewDedupeID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// PublishWithDedupeID synchronously publishes a message body to the specified
+// topic in an envelope stamped with dedupeID and the current time, returning
+// an error if publish failed.
+//
+// Reusing the same dedupeID when retrying a publish (whether after an error,
+// or because the outcome is unknown) allows consumers to drop the duplicates
+// (see Deduplicator). Use NewDedupeID to generate one.
+func (w *Producer) PublishWithDedupeID(topic string, dedupeID string, body []byte) error {
+	if dedupeID == "" {
+		return errors.New("empty dedupe ID")
+	}
+	return w.PublishWithHeaders(topic, map[string]string{
+		HeaderDedupeID:  dedupeID,
+		HeaderTimestamp: strconv.FormatInt(time.Now().UnixNano(), 10),
+	}, body)
+}
+
+// PublishJSON marshals v to JSON and synchronously publishes it to the specified
+// topic in an envelope with the HeaderContentType ContentTypeJSON, returning an
+// error if marshaling or publish failed
+func (w *Producer) PublishJSON(topic string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.PublishWithHeaders(topic, map[string]string{HeaderContentType: ContentTypeJSON}, body)
+}
+
+// PublishWithHeaders synchronously publishes a message body to the specified
+// topic in an envelope with headers, returning an error if publish failed.
+//
+// Consumers decode it with Message.Envelope (or DecodeEnvelope). Use the
+// well-known Header* keys where they apply.
+func (w *Producer) PublishWithHeaders(topic string, headers map[string]string, body []byte) error {
+	data, err := EncodeEnvelope(headers, body)
+	if err != nil {
+		return err
+	}
+	return w.Publish(topic, data)
+}
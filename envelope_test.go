@@ -0,0 +1,123 @@
+package nsq
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEnvelope(t *testing.T) {
+	data, err := EncodeEnvelope(map[string]string{
+		HeaderDedupeID:  "abc",
+		HeaderTimestamp: "1000000000",
+		"empty":         "",
+	}, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := DecodeEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(env.Body) != "payload" || env.DedupeID() != "abc" || len(env.Headers) != 3 {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+	if ts, ok := env.Timestamp(); !ok || !ts.Equal(time.Unix(1, 0)) {
+		t.Fatalf("unexpected timestamp %v", ts)
+	}
+
+	if _, err := DecodeEnvelope([]byte(`{"json":true}`)); err != ErrNotEnveloped {
+		t.Fatalf("expected ErrNotEnveloped, got %v", err)
+	}
+	for i := len(envelopeMagic); i < len(data)-len("payload"); i++ {
+		if _, err := DecodeEnvelope(data[:i]); err == nil {
+			t.Fatalf("expected error decoding envelope truncated to %d bytes", i)
+		}
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	d := NewDeduplicator(50 * time.Millisecond)
+
+	var handled [][]byte
+	fail := true
+	h := d.Handler(HandlerFunc(func(m *Message) error {
+		if fail {
+			return errors.New("failed")
+		}
+		handled = append(handled, m.Body)
+		return nil
+	}))
+
+	data, _ := EncodeEnvelope(map[string]string{HeaderDedupeID: "abc"}, []byte("payload"))
+	newMsg := func(id byte) *Message {
+		return NewMessage(MessageID{id}, append([]byte(nil), data...))
+	}
+
+	// failed messages aren't recorded
+	if err := h.HandleMessage(newMsg(1)); err == nil {
+		t.Fatal("expected error")
+	}
+	fail = false
+	h.HandleMessage(newMsg(1))
+	// different message ID, same dedupe ID
+	h.HandleMessage(newMsg(2))
+	if len(handled) != 1 || !bytes.Equal(handled[0], []byte("payload")) {
+		t.Fatalf("unexpected handled messages %q", handled)
+	}
+
+	// not enveloped, keyed by message ID
+	h.HandleMessage(NewMessage(MessageID{3}, []byte("raw")))
+	h.HandleMessage(NewMessage(MessageID{3}, []byte("raw")))
+	if len(handled) != 2 {
+		t.Fatalf("expected duplicate message ID to be dropped, handled %q", handled)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	h.HandleMessage(newMsg(4))
+	if len(handled) != 3 {
+		t.Fatalf("expected dedupe ID to be forgotten after the window")
+	}
+}
+
+func TestDeduplicatorMaxKeys(t *testing.T) {
+	d := NewDeduplicatorWithMaxKeys(time.Minute, 2)
+	d.Add("a")
+	d.Add("b")
+	d.Add("a")
+	d.Add("c")
+	if d.Seen("b") {
+		t.Fatal("expected the oldest key to be forgotten")
+	}
+	if !d.Seen("a") || !d.Seen("c") {
+		t.Fatal("expected the newest keys to be remembered")
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for _, traceparent := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceparent(traceparent, ""); err == nil {
+			t.Errorf("expected an error for %q", traceparent)
+		}
+	}
+
+	// future versions may append fields
+	tc, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.IsSampled() || tc.Traceparent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00" {
+		t.Fatalf("unexpected trace context %+v", tc)
+	}
+}
@@ -3,6 +3,9 @@ package nsq
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 )
 
 // ErrNotConnected is returned when a publish command is made
@@ -13,6 +16,34 @@ var ErrNotConnected = errors.New("not connected")
 // made against a Producer that has been stopped
 var ErrStopped = errors.New("stopped")
 
+// ErrRateLimited is returned when a publish command is made against a
+// Producer that is over its rate limit (see Config.PublishRateLimitFailFast)
+var ErrRateLimited = errors.New("rate limited")
+
+// ErrConnectionLost is the error of the publish commands pending on a Producer's
+// connection to nsqd when it fails (e.g. after missed heartbeats)
+//
+// It matches ErrNotConnected with errors.Is.
+type ErrConnectionLost struct {
+	Addr string
+	Err  error // the cause
+}
+
+// Error returns a stringified error
+func (e ErrConnectionLost) Error() string {
+	return fmt.Sprintf("connection to %s lost - %s", e.Addr, e.Err)
+}
+
+// Unwrap returns the cause
+func (e ErrConnectionLost) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true for ErrNotConnected
+func (e ErrConnectionLost) Is(target error) bool {
+	return target == ErrNotConnected
+}
+
 // ErrClosing is returned when a connection is closing
 var ErrClosing = errors.New("closing")
 
@@ -22,6 +53,28 @@ var ErrAlreadyConnected = errors.New("already connected")
 // ErrOverMaxInFlight is returned from Consumer if over max-in-flight
 var ErrOverMaxInFlight = errors.New("over configure max-inflight")
 
+// ErrRequeueWithoutBackoff can be returned from a Handler (or BatchHandler)
+// for an expected, non-fatal condition (e.g. "not ready yet, retry in 30s") to
+// requeue the message after Delay without triggering backoff, as with
+// Message.RequeueWithoutBackoff
+type ErrRequeueWithoutBackoff struct {
+	Delay time.Duration // -1 calculates it as for Message.Requeue
+	Err   error         // the cause, if any
+}
+
+// Error returns a stringified error
+func (e ErrRequeueWithoutBackoff) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("requeue without backoff after %s", e.Delay)
+	}
+	return fmt.Sprintf("requeue without backoff after %s - %s", e.Delay, e.Err)
+}
+
+// Unwrap returns the cause
+func (e ErrRequeueWithoutBackoff) Unwrap() error {
+	return e.Err
+}
+
 // ErrIdentify is returned from Conn as part of the IDENTIFY handshake
 type ErrIdentify struct {
 	Reason string
@@ -42,3 +95,36 @@ type ErrProtocol struct {
 func (e ErrProtocol) Error() string {
 	return e.Reason
 }
+
+// ErrInvalidConfig is returned from Config.Validate and Config.SetMany
+// and collects every violation found rather than just the first
+type ErrInvalidConfig struct {
+	Errors []error
+}
+
+// Error returns a stringified error
+func (e ErrInvalidConfig) Error() string {
+	reasons := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		reasons = append(reasons, err.Error())
+	}
+	return fmt.Sprintf("invalid config - %s", strings.Join(reasons, "; "))
+}
+
+// TopicErrors is returned from Producer.PublishToTopics and maps
+// each topic that could not be published to with its error
+type TopicErrors map[string]error
+
+// Error returns a stringified error
+func (e TopicErrors) Error() string {
+	topics := make([]string, 0, len(e))
+	for topic := range e {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	reasons := make([]string, 0, len(e))
+	for _, topic := range topics {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", topic, e[topic]))
+	}
+	return fmt.Sprintf("failed to publish to %d topics - %s", len(e), strings.Join(reasons, "; "))
+}
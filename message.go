@@ -22,12 +22,33 @@ type Message struct {
 	Timestamp int64
 	Attempts  uint16
 
+	// where and when the message was received from: the nsqd, the connection
+	// to it (see Conn.ID, which changes on reconnecting) and the local time
 	NSQDAddress string
+	ConnID      int64
+	ReceivedAt  time.Time
+
+	// Headers of the envelope the Body was unwrapped from by the Consumer's
+	// EnvelopeCodec (see Consumer.SetEnvelopeCodec), nil if none
+	Headers map[string]string
 
 	Delegate MessageDelegate
 
 	autoResponseDisabled int32
 	responded            int32
+
+	// when the server-side message timeout expires, as of its delivery
+	timeoutAt  time.Time
+	msgTimeout time.Duration
+
+	// recorded by the consumer's Deduplicator when finished (see Config.DedupeWindow)
+	dedupeKey string
+
+	// recycled once refs drops to 0, along with the read buffer its Body
+	// references (see Config.PoolMessages)
+	pooled bool
+	refs   int32
+	buf    *[]byte
 }
 
 // NewMessage creates a Message, initializes some metadata,
@@ -40,12 +61,24 @@ func NewMessage(id MessageID, body []byte) *Message {
 	}
 }
 
+// Time returns when the message was published, per the clock of nsqd
+func (m *Message) Time() time.Time {
+	return time.Unix(0, m.Timestamp)
+}
+
+// Age returns how long ago the message was published, which includes any
+// difference between the clocks of nsqd and this host (see
+// Config.ClockSkewThreshold)
+func (m *Message) Age() time.Duration {
+	return time.Since(m.Time())
+}
+
 // DisableAutoResponse disables the automatic response that
 // would normally be sent when a handler.HandleMessage
 // returns (FIN/REQ based on the error value returned).
 //
 // This is useful if you want to batch, buffer, or asynchronously
-// respond to messages.
+// respond to messages (see MessageBatch).
 func (m *Message) DisableAutoResponse() {
 	atomic.StoreInt32(&m.autoResponseDisabled, 1)
 }
@@ -84,7 +117,8 @@ func (m *Message) Touch() {
 //
 // A delay of -1 will automatically calculate
 // based on the number of attempts and the
-// configured default_requeue_delay
+// configured default_requeue_delay (see
+// Config.RequeueDelayStrategy)
 func (m *Message) Requeue(delay time.Duration) {
 	m.doRequeue(delay, true)
 }
@@ -148,11 +182,21 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 //                         (uint16)
 //                          2-byte
 //                         attempts
+//
+// The Body of the message is a slice of b rather than a copy, so b must not be
+// modified (or reused) while the message is in use.
 func DecodeMessage(b []byte) (*Message, error) {
 	var msg Message
+	if err := decodeMessage(b, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
 
+// decodeMessage deserializes b into msg (e.g. a pooled one)
+func decodeMessage(b []byte, msg *Message) error {
 	if len(b) < 10+MsgIDLength {
-		return nil, errors.New("not enough data to decode valid message")
+		return errors.New("not enough data to decode valid message")
 	}
 
 	msg.Timestamp = int64(binary.BigEndian.Uint64(b[:8]))
@@ -160,5 +204,5 @@ func DecodeMessage(b []byte) (*Message, error) {
 	copy(msg.ID[:], b[10:10+MsgIDLength])
 	msg.Body = b[10+MsgIDLength:]
 
-	return &msg, nil
+	return nil
 }
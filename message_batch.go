@@ -0,0 +1,114 @@
+package nsq
+
+import (
+	"sync"
+	"time"
+)
+
+// MessageBatch holds messages whose response is deferred, e.g. until they
+// were written together with a bulk insert, to FIN or REQ them together
+//
+// It is safe for concurrent use, the zero value is an empty batch.
+type MessageBatch struct {
+	mtx     sync.Mutex
+	entries []batchEntry
+}
+
+type batchEntry struct {
+	message  *Message
+	deadline time.Time
+}
+
+// Add disables the automatic response of m (see Message.DisableAutoResponse)
+// and adds it to the batch
+func (b *MessageBatch) Add(m *Message) {
+	m.DisableAutoResponse()
+	b.mtx.Lock()
+	b.entries = append(b.entries, batchEntry{m, m.timeoutAt})
+	b.mtx.Unlock()
+}
+
+// Len returns the number of messages in the batch
+func (b *MessageBatch) Len() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return len(b.entries)
+}
+
+// Messages returns the messages in the batch, in the order they were added
+func (b *MessageBatch) Messages() []*Message {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	messages := make([]*Message, 0, len(b.entries))
+	for _, e := range b.entries {
+		messages = append(messages, e.message)
+	}
+	return messages
+}
+
+// Deadline returns when the server-side timeout of the first message of the
+// batch expires (as of its delivery or the last Touch), after which nsqd
+// requeues it, so the batch should be responded to (or touched) before then.
+//
+// It is the zero time for an empty batch, or when the timeout is unknown.
+func (b *MessageBatch) Deadline() time.Time {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	var deadline time.Time
+	for _, e := range b.entries {
+		if !e.deadline.IsZero() && (deadline.IsZero() || e.deadline.Before(deadline)) {
+			deadline = e.deadline
+		}
+	}
+	return deadline
+}
+
+// Touch sends a TOUCH for every message in the batch, resetting their
+// server-side timeouts
+func (b *MessageBatch) Touch() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := time.Now()
+	for i, e := range b.entries {
+		e.message.Touch()
+		if e.message.msgTimeout > 0 {
+			b.entries[i].deadline = now.Add(e.message.msgTimeout)
+		}
+	}
+}
+
+// Finish sends a FIN for every message in the batch and empties it
+func (b *MessageBatch) Finish() {
+	for _, m := range b.take() {
+		m.Finish()
+	}
+}
+
+// Requeue sends a REQ with delay for every message in the batch (see
+// Message.Requeue) and empties it
+func (b *MessageBatch) Requeue(delay time.Duration) {
+	for _, m := range b.take() {
+		m.Requeue(delay)
+	}
+}
+
+// RequeueWithoutBackoff sends a REQ with delay for every message in the batch
+// without triggering backoff (see Message.RequeueWithoutBackoff) and empties it
+func (b *MessageBatch) RequeueWithoutBackoff(delay time.Duration) {
+	for _, m := range b.take() {
+		m.RequeueWithoutBackoff(delay)
+	}
+}
+
+// take empties the batch, returning its messages
+func (b *MessageBatch) take() []*Message {
+	b.mtx.Lock()
+	entries := b.entries
+	b.entries = nil
+	b.mtx.Unlock()
+	messages := make([]*Message, 0, len(entries))
+	for _, e := range entries {
+		messages = append(messages, e.message)
+	}
+	return messages
+}
@@ -0,0 +1,90 @@
+package nsq
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// messagePool recycles the messages of consumers with Config.PoolMessages
+var messagePool = sync.Pool{
+	New: func() interface{} {
+		return &Message{}
+	},
+}
+
+// bufferPool recycles the buffers frames are read into by the connections of
+// consumers with Config.PoolMessages, which the Body of their messages reference
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// acquireMessage returns a pooled Message holding two references, released
+// by the Consumer once its handler returned and once it was responded to
+func acquireMessage() *Message {
+	m := messagePool.Get().(*Message)
+	m.pooled = true
+	m.refs = 2
+	return m
+}
+
+// Retain adds a reference to a pooled message (see Config.PoolMessages), so
+// that it isn't recycled until Release is called, e.g. to keep using it once
+// it was responded to.
+//
+// It is a no-op for messages that aren't pooled.
+func (m *Message) Retain() {
+	if !m.pooled {
+		return
+	}
+	atomic.AddInt32(&m.refs, 1)
+}
+
+// Release drops a reference added with Retain, returning the message (and
+// the read buffer its Body references) to the pool once it was responded to
+// and no longer referenced. The message (and its Body and Headers) must not
+// be used after that.
+//
+// It is a no-op for messages that aren't pooled.
+func (m *Message) Release() {
+	if !m.pooled {
+		return
+	}
+	refs := atomic.AddInt32(&m.refs, -1)
+	if refs > 0 {
+		return
+	}
+	if refs < 0 {
+		panic("nsq: Message released more times than retained")
+	}
+	if m.buf != nil {
+		bufferPool.Put(m.buf)
+	}
+	*m = Message{}
+	messagePool.Put(m)
+}
+
+// Copy returns a copy of the message, including its Body and Headers, which
+// isn't pooled (so it can be kept indefinitely) and can't be responded to
+func (m *Message) Copy() *Message {
+	c := &Message{
+		ID:          m.ID,
+		Timestamp:   m.Timestamp,
+		Attempts:    m.Attempts,
+		NSQDAddress: m.NSQDAddress,
+		ConnID:      m.ConnID,
+		ReceivedAt:  m.ReceivedAt,
+		responded:   1,
+	}
+	if m.Body != nil {
+		c.Body = append([]byte(nil), m.Body...)
+	}
+	if m.Headers != nil {
+		c.Headers = make(map[string]string, len(m.Headers))
+		for k, v := range m.Headers {
+			c.Headers[k] = v
+		}
+	}
+	return c
+}
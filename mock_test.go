@@ -3,12 +3,19 @@ package nsq
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -39,7 +46,9 @@ type instruction struct {
 type mockNSQD struct {
 	t           *testing.T
 	script      []instruction
+	mtx         sync.Mutex // for clients connecting more than once
 	got         [][]byte
+	identify    []byte
 	tcpAddr     *net.TCPAddr
 	tcpListener net.Listener
 	exitChan    chan int
@@ -113,7 +122,9 @@ func (n *mockNSQD) handle(conn net.Conn) {
 		select {
 		case line := <-readChan:
 			n.t.Logf("mock: %s", line)
+			n.mtx.Lock()
 			n.got = append(n.got, line)
+			n.mtx.Unlock()
 			params := bytes.Split(line, []byte(" "))
 			switch {
 			case bytes.Equal(params[0], []byte("IDENTIFY")):
@@ -131,6 +142,26 @@ func (n *mockNSQD) handle(conn net.Conn) {
 					goto exit
 				}
 				n.t.Logf("%s", b)
+				n.mtx.Lock()
+				n.identify = b
+				n.mtx.Unlock()
+			case bytes.Equal(params[0], []byte("AUTH")):
+				l := make([]byte, 4)
+				_, err := io.ReadFull(rdr, l)
+				if err != nil {
+					n.t.Log(err)
+					goto exit
+				}
+				b := make([]byte, int32(binary.BigEndian.Uint32(l)))
+				_, err = io.ReadFull(rdr, b)
+				if err != nil {
+					n.t.Log(err)
+					goto exit
+				}
+				// record the secret along with the command
+				n.mtx.Lock()
+				n.got[len(n.got)-1] = []byte(fmt.Sprintf("AUTH %s", b))
+				n.mtx.Unlock()
 			case bytes.Equal(params[0], []byte("RDY")):
 				rdy, _ := strconv.Atoi(string(params[1]))
 				rdyCount = rdy
@@ -538,3 +569,2541 @@ done:
 		}
 	}
 }
+
+// wrappedConn hides the half-close methods of the underlying *net.TCPConn
+type wrappedConn struct {
+	net.Conn
+}
+
+type testDialer struct {
+	addrs []string
+}
+
+func (d *testDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.addrs = append(d.addrs, addr)
+	if _, ok := ctx.Deadline(); !ok {
+		return nil, errors.New("expected dial_timeout deadline on context")
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return wrappedConn{conn}, nil
+}
+
+func TestConsumerDialer(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_dialer" + strconv.Itoa(int(time.Now().Unix()))
+	dialer := &testDialer{}
+	config := NewConfig()
+	config.Set("dialer", dialer)
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+	q.AddHandler(&testHandler{})
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	if len(dialer.addrs) != 1 || dialer.addrs[0] != n.tcpAddr.String() {
+		t.Fatalf("dialer was not used - %v", dialer.addrs)
+	}
+	if len(n.got) < 2 || string(n.got[0]) != "IDENTIFY" || string(n.got[1]) != "SUB "+topicName+" ch" {
+		t.Fatalf("unexpected commands %s", n.got)
+	}
+}
+
+func TestConsumerAuthSecretProvider(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte(`{"auth_required":true}`)},
+		// AUTH
+		instruction{0, FrameTypeResponse, []byte(`{"identity":"test"}`)},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_auth_provider" + strconv.Itoa(int(time.Now().Unix()))
+	var calls int
+	config := NewConfig()
+	config.AuthSecret = "static"
+	config.AuthSecretProvider = func() (string, error) {
+		calls++
+		return fmt.Sprintf("token%d", calls), nil
+	}
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+	q.AddHandler(&testHandler{})
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	expected := []string{
+		"IDENTIFY",
+		"AUTH token1",
+		"SUB " + topicName + " ch",
+	}
+	if len(n.got) < len(expected) {
+		t.Fatalf("we got %d commands < %d expected", len(n.got), len(expected))
+	}
+	for i, r := range expected {
+		if string(n.got[i]) != r {
+			t.Fatalf("cmd %d bad %s != %s", i, n.got[i], r)
+		}
+	}
+
+	config.AuthSecretProvider = func() (string, error) {
+		return "", errors.New("token expired")
+	}
+	n = newMockNSQD(t, script, addr.String())
+	q, _ = NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+	q.AddHandler(&testHandler{})
+	err = q.ConnectToNSQD(n.tcpAddr.String())
+	if err == nil || !strings.Contains(err.Error(), "token expired") {
+		t.Fatalf("expected provider error, got %v", err)
+	}
+}
+
+func TestConsumerConnectToNSQDWithConfig(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_conn_config" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+	q.AddHandler(&testHandler{})
+
+	invalid := NewConfig()
+	invalid.MaxInFlight = -1
+	if err := q.ConnectToNSQDWithConfig(n.tcpAddr.String(), invalid); err == nil {
+		t.Fatalf("expected error connecting with an invalid config")
+	}
+
+	dialer := &testDialer{}
+	override := NewConfig()
+	override.Dialer = dialer
+	err := q.ConnectToNSQDWithConfig(n.tcpAddr.String(), override)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	if len(dialer.addrs) != 1 {
+		t.Fatalf("override config was not used - %v", dialer.addrs)
+	}
+	if config.Dialer != nil {
+		t.Fatalf("consumer config was modified")
+	}
+}
+
+func TestConsumerApplyConfigSampleRate(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{300 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	// without lookupd, a closed connection is only reconnected after the poll interval
+	config := NewConfig()
+	config.LookupdPollInterval = time.Minute
+	q, _ := NewConsumer("test_sample_rate", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(&testHandler{})
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	reloaded := NewConfig()
+	reloaded.LookupdPollInterval = time.Minute
+	reloaded.SampleRate = 10
+	if err := q.ApplyConfig(reloaded); err != nil {
+		t.Fatal(err)
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	var identifies int
+	for _, cmd := range n.got {
+		if bytes.Equal(cmd, []byte("IDENTIFY")) {
+			identifies++
+		}
+	}
+	if identifies != 2 {
+		t.Fatalf("expected an immediate reconnection, got %d IDENTIFY", identifies)
+	}
+	var identify struct {
+		SampleRate int32 `json:"sample_rate"`
+	}
+	json.Unmarshal(n.identify, &identify)
+	if identify.SampleRate != 10 {
+		t.Fatalf("expected sample_rate 10 on reconnecting, got %d", identify.SampleRate)
+	}
+}
+
+func TestConsumerIdentifyExtra(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_identify_extra" + strconv.Itoa(int(time.Now().Unix()))
+	extra := map[string]interface{}{
+		"region":    "us-east-1",
+		"client_id": "ignored",
+	}
+	config := NewConfig()
+	config.ClientID = "consumer"
+	config.SetIdentifyExtra(extra)
+	extra["region"] = "changed"
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+	q.AddHandler(&testHandler{})
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	var identify map[string]interface{}
+	if err := json.Unmarshal(n.identify, &identify); err != nil {
+		t.Fatalf("failed to decode IDENTIFY body %q - %s", n.identify, err)
+	}
+	if identify["region"] != "us-east-1" {
+		t.Errorf("region %v != us-east-1", identify["region"])
+	}
+	if identify["client_id"] != "consumer" {
+		t.Errorf("built-in client_id was overridden by %v", identify["client_id"])
+	}
+}
+
+func TestProducerFromLookupd(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	var paths []string
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+		fmt.Fprintf(w, `{"producers":[
+			{"broadcast_address":"127.0.0.1","tcp_port":1,"hostname":"other-az"},
+			{"broadcast_address":"127.0.0.1","tcp_port":%d,"hostname":"same-az"}]}`, n.tcpAddr.Port)
+	}))
+	defer lookupd.Close()
+
+	var hostnames []string
+	selector := func(nodes []*PeerInfo) []*PeerInfo {
+		for _, node := range nodes {
+			hostnames = append(hostnames, node.Hostname)
+		}
+		return nodes
+	}
+
+	if _, err := NewProducerFromLookupd(nil, NewConfig(), selector); err == nil {
+		t.Fatal("expected error for empty nsqlookupd list")
+	}
+
+	w, err := NewProducerFromLookupd([]string{lookupd.URL}, NewConfig(), selector)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	w.SetLogger(newTestLogger(t), LogLevelDebug)
+
+	// the unreachable nsqd is skipped
+	if err := w.Ping(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	w.Stop()
+	<-n.exitChan
+
+	if w.String() != n.tcpAddr.String() {
+		t.Fatalf("connected to %s, expected %s", w.String(), n.tcpAddr.String())
+	}
+	if len(paths) != 1 || paths[0] != "/nodes" {
+		t.Fatalf("unexpected nsqlookupd requests %v", paths)
+	}
+	if len(hostnames) != 2 || hostnames[0] != "other-az" || hostnames[1] != "same-az" {
+		t.Fatalf("selector got unexpected nodes %v", hostnames)
+	}
+}
+
+func TestProducerLookupdDiscover(t *testing.T) {
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+		w.Write([]byte(`{"producers":[
+			{"broadcast_address":"a","tcp_port":4150},
+			{"broadcast_address":"b","tcp_port":4150},
+			{"broadcast_address":"c","tcp_port":4150}]}`))
+	}))
+	defer lookupd.Close()
+
+	selector := func(nodes []*PeerInfo) []*PeerInfo {
+		return nodes[1:]
+	}
+	w, err := NewProducerFromLookupd([]string{"127.0.0.1:1", lookupd.URL}, NewConfig(), selector)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer w.Stop()
+
+	// the first nsqlookupd is down, the nsqd last connected to is tried last
+	addrs, err := w.discoverer.discover(&w.config, "b:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if strings.Join(addrs, ",") != "c:4150,b:4150" {
+		t.Fatalf("unexpected nsqd order %v", addrs)
+	}
+}
+
+func TestProducerOnReconnect(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// close the connection
+		instruction{50 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	w, _ := NewProducer(n.tcpAddr.String(), NewConfig())
+	w.SetLogger(nullLogger, LogLevelInfo)
+	reconnects := make(chan string, 2)
+	w.SetHooks(ProducerHooks{
+		OnReconnect: func(addr string) {
+			reconnects <- addr
+		},
+	})
+
+	if err := w.Connect(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	<-n.exitChan
+	for atomic.LoadInt32(&w.state) != StateInit {
+		time.Sleep(time.Millisecond)
+	}
+
+	n = newMockNSQD(t, script, n.tcpAddr.String())
+	if err := w.Connect(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	w.Stop()
+	<-n.exitChan
+
+	if len(reconnects) != 1 {
+		t.Fatalf("expected 1 OnReconnect call, got %d", len(reconnects))
+	}
+	if addr := <-reconnects; addr != n.tcpAddr.String() {
+		t.Fatalf("OnReconnect got %s, expected %s", addr, n.tcpAddr.String())
+	}
+}
+
+func TestProducerReconnectOnHeartbeatLoss(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// no heartbeats are sent, so the producer's read times out before this
+		instruction{300 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.HeartbeatInterval = 50 * time.Millisecond
+	config.ReadTimeout = 100 * time.Millisecond
+	config.ReconnectBackoff = 500 * time.Millisecond
+	w, _ := NewProducer(n.tcpAddr.String(), config)
+	w.SetLogger(nullLogger, LogLevelInfo)
+	reconnects := make(chan string, 1)
+	w.SetHooks(ProducerHooks{
+		OnReconnect: func(addr string) {
+			reconnects <- addr
+		},
+	})
+
+	if err := w.Connect(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	<-n.exitChan
+	if atomic.LoadInt32(&w.state) == StateConnected {
+		t.Fatal("expected connection to be closed after missed heartbeats")
+	}
+
+	// the producer re-dials on its own, without a publish
+	n = newMockNSQD(t, script, n.tcpAddr.String())
+	select {
+	case <-reconnects:
+	case <-time.After(5 * time.Second):
+		t.Fatal("producer did not reconnect")
+	}
+	w.Stop()
+	<-n.exitChan
+}
+
+func TestConsumerHandlerWithContext(t *testing.T) {
+	msg := NewMessage(MessageID{'c', 't', 'x'}, []byte("body"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte(`{"max_rdy_count":2500,"msg_timeout":1000}`)},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{500 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	q, _ := NewConsumer("test_context", "ch", NewConfig())
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+	started := make(chan time.Time, 1)
+	errChan := make(chan error, 1)
+	q.AddHandlerWithContext(HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+		deadline, _ := ctx.Deadline()
+		started <- deadline
+		<-ctx.Done()
+		errChan <- ctx.Err()
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// the deadline falls before the server-side timeout of 1s
+	deadline := <-started
+	if remaining := time.Until(deadline); remaining <= 0 || remaining >= time.Second {
+		t.Fatalf("unexpected deadline in %s", remaining)
+	}
+
+	q.Stop()
+	if err := <-errChan; err != context.Canceled {
+		t.Fatalf("expected context to be cancelled by Stop, got %v", err)
+	}
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+	<-n.exitChan
+}
+
+func TestConsumerUse(t *testing.T) {
+	msg := NewMessage(MessageID{'m', 'w'}, []byte("body"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	q, _ := NewConsumer("test_middleware", "ch", NewConfig())
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+	calls := make(chan string, 3)
+	middleware := func(name string) MiddlewareFunc {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(m *Message) error {
+				calls <- name
+				return next.HandleMessage(m)
+			})
+		}
+	}
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		calls <- "handler"
+		return nil
+	}))
+	// may be called after AddHandler, until connected
+	q.Use(middleware("outer"), middleware("inner"))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	var order []string
+	for i := 0; i < 3; i++ {
+		order = append(order, <-calls)
+	}
+	if strings.Join(order, ",") != "outer,inner,handler" {
+		t.Fatalf("unexpected call order %v", order)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected Use to panic once connected")
+			}
+		}()
+		q.Use(middleware("late"))
+	}()
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+	if got := fmt.Sprintf("%s", n.got[len(n.got)-1]); !strings.HasPrefix(got, "FIN ") {
+		t.Fatalf("expected message to be finished, got %s", got)
+	}
+}
+
+func TestConsumerRecoverHandlerPanics(t *testing.T) {
+	msg := NewMessage(MessageID{'p', 'a', 'n', 'i', 'c'}, []byte("body"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.RecoverHandlerPanics = true
+	q, _ := NewConsumer("test_panic", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	recovered := make(chan interface{}, 1)
+	q.SetPanicHandler(func(m *Message, p interface{}, stack []byte) {
+		if m.ID != msg.ID || !bytes.Contains(stack, []byte("TestConsumerRecoverHandlerPanics")) {
+			t.Errorf("unexpected panic handler arguments %s %s", m.ID, stack)
+		}
+		recovered <- p
+	})
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		panic("boom")
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if p := <-recovered; p != "boom" {
+		t.Fatalf("unexpected recovered value %v", p)
+	}
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	if stats := q.Stats(); stats.HandlerPanics != 1 || stats.MessagesRequeued != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	var requeued bool
+	for _, cmd := range n.got {
+		requeued = requeued || bytes.HasPrefix(cmd, []byte(fmt.Sprintf("REQ %s ", msg.ID)))
+	}
+	if !requeued {
+		t.Fatalf("expected message to be requeued, got %s", n.got)
+	}
+}
+
+func TestConsumerHandlerTimeout(t *testing.T) {
+	msg := NewMessage(MessageID{'s', 't', 'u', 'c', 'k'}, []byte("body"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{200 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.HandlerTimeout = 50 * time.Millisecond
+	q, _ := NewConsumer("test_handler_timeout", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	errChan := make(chan error, 1)
+	q.AddHandlerWithContext(HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+		<-ctx.Done()
+		errChan <- ctx.Err()
+		// the message has already been requeued
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if err := <-errChan; err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	if stats := q.Stats(); stats.HandlerTimeouts != 1 || stats.MessagesRequeued != 1 || stats.MessagesFinished != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	var requeued bool
+	for _, cmd := range n.got {
+		if bytes.HasPrefix(cmd, []byte("FIN ")) {
+			t.Fatalf("unexpected %s", cmd)
+		}
+		requeued = requeued || bytes.HasPrefix(cmd, []byte(fmt.Sprintf("REQ %s ", msg.ID)))
+	}
+	if !requeued {
+		t.Fatalf("expected message to be requeued, got %s", n.got)
+	}
+}
+
+func TestConsumerDeadLetter(t *testing.T) {
+	msg := NewMessage(MessageID{'d', 'e', 'a', 'd'}, []byte("body"))
+	msg.Attempts = 3
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	w := newMockProducer(t)
+	defer w.Stop()
+
+	config := NewConfig()
+	config.MaxAttempts = 2
+	q, _ := NewConsumer("test_dead_letter", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	if err := q.SetDeadLetter(w, "test_dead_letter#"); err == nil {
+		t.Fatalf("expected invalid topic error")
+	}
+	if err := q.SetDeadLetter(w, "test_dead_letter_dlq"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		t.Errorf("handler called for message exceeding max_attempts")
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	bodies := publishedBodies(w)
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 dead-letter publish, got %d", len(bodies))
+	}
+	env, err := DecodeEnvelope([]byte(bodies[0]))
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if string(env.Body) != "body" ||
+		env.Headers[HeaderOriginalTopic] != "test_dead_letter" ||
+		env.Headers[HeaderOriginalChannel] != "ch" ||
+		env.Headers[HeaderMessageID] != string(msg.ID[:]) ||
+		env.Headers[HeaderAttempts] != "3" ||
+		env.Headers[HeaderFailureReason] == "" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+	if ts, ok := env.Timestamp(); !ok || ts.UnixNano() != msg.Timestamp {
+		t.Fatalf("unexpected timestamp %s", ts)
+	}
+	var finished bool
+	for _, cmd := range n.got {
+		finished = finished || bytes.Equal(cmd, []byte(fmt.Sprintf("FIN %s", msg.ID)))
+	}
+	if !finished {
+		t.Fatalf("expected message to be finished, got %s", n.got)
+	}
+}
+
+func TestConsumerDeadLetterPublishError(t *testing.T) {
+	msg := NewMessage(MessageID{'d', 'e', 'a', 'd'}, []byte("body"))
+	msg.Attempts = 3
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	// nothing listens there, publishing fails
+	w, _ := NewProducer("127.0.0.1:1", NewConfig())
+	w.SetLogger(nullLogger, LogLevelInfo)
+	defer w.Stop()
+
+	config := NewConfig()
+	config.MaxAttempts = 2
+	q, _ := NewConsumer("test_dead_letter", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.SetDeadLetter(w, "test_dead_letter_dlq")
+	var givenUp int32
+	q.SetGiveUpHandler(func(m *Message) {
+		atomic.AddInt32(&givenUp, 1)
+	})
+	q.AddHandler(&testHandler{})
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	if atomic.LoadInt32(&givenUp) != 0 {
+		t.Fatalf("expected message not to be given up before its dead-letter publish")
+	}
+	// requeued without backing off (i.e. without RDY 0)
+	expected := []string{
+		"IDENTIFY",
+		"SUB test_dead_letter ch",
+		"RDY 1",
+		fmt.Sprintf("REQ %s ", msg.ID),
+	}
+	if len(n.got) != len(expected) {
+		t.Fatalf("expected %s, got %s", expected, n.got)
+	}
+	for i, r := range n.got {
+		if !strings.HasPrefix(string(r), expected[i]) {
+			t.Fatalf("cmd %d bad %s != %s", i, r, expected[i])
+		}
+	}
+}
+
+func TestConsumerChangeMaxInFlight(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{200 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n1 := newMockNSQD(t, script, addr.String())
+	n2 := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 10
+	q, _ := NewConsumer("test_change_max_in_flight", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+	if err := q.ConnectToNSQD(n1.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := q.ConnectToNSQD(n2.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+	q.ChangeMaxInFlight(4)
+	q.ChangeMaxInFlight(20)
+
+	<-n1.exitChan
+	<-n2.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	rdy := func(n *mockNSQD) string {
+		var cmds []string
+		for _, cmd := range n.got {
+			if bytes.HasPrefix(cmd, []byte("RDY ")) {
+				cmds = append(cmds, string(cmd))
+			}
+		}
+		return strings.Join(cmds, ", ")
+	}
+	if got := rdy(n1); got != "RDY 10, RDY 5, RDY 2, RDY 10" {
+		t.Fatalf("unexpected RDY commands %s", got)
+	}
+	if got := rdy(n2); got != "RDY 5, RDY 2, RDY 10" {
+		t.Fatalf("unexpected RDY commands %s", got)
+	}
+}
+
+func TestConsumerPauseResume(t *testing.T) {
+	msg := NewMessage(MessageID{'p', 'a', 'u', 's', 'e'}, []byte("body"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{200 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 5
+	q, _ := NewConsumer("test_pause", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	received := make(chan struct{})
+	release := make(chan struct{})
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		close(received)
+		<-release
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-received
+	stats := q.Stats()
+	if stats.MessagesInFlight != 1 || stats.RDY[n.tcpAddr.String()] != 5 || stats.Paused {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	q.Pause()
+	if !q.IsPaused() {
+		t.Fatalf("expected consumer to be paused")
+	}
+	stats = q.Stats()
+	if stats.MessagesInFlight != 1 || stats.RDY[n.tcpAddr.String()] != 0 || !stats.Paused || stats.InBackoff {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	// the in-flight message is still handled while paused
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	q.Resume()
+	if q.IsPaused() {
+		t.Fatalf("expected consumer to be resumed")
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	expected := []string{
+		"IDENTIFY",
+		"SUB test_pause ch",
+		"RDY 5",
+		"RDY 0",
+		fmt.Sprintf("FIN %s", msg.ID),
+		"RDY 5",
+	}
+	if len(n.got) != len(expected) {
+		t.Fatalf("we got %d commands != %d expected (%s)", len(n.got), len(expected), n.got)
+	}
+	for i, r := range n.got {
+		if string(r) != expected[i] {
+			t.Fatalf("cmd %d bad %s != %s", i, r, expected[i])
+		}
+	}
+}
+
+func TestConsumerPauseConnBackoff(t *testing.T) {
+	msgBad := NewMessage(MessageID{'b', 'a', 'd'}, []byte("bad"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgBad)},
+		// needed to exit test
+		instruction{400 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 5
+	// a backoff of 100ms at level 1
+	config.BackoffMultiplier = 50 * time.Millisecond
+	config.BackoffPerConnection = true
+	q, _ := NewConsumer("test_pause_conn_backoff", "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+	received := make(chan struct{})
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		close(received)
+		return errors.New("bad")
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// the backoff timeout of the connection expires while paused
+	<-received
+	time.Sleep(20 * time.Millisecond)
+	q.Pause()
+	time.Sleep(150 * time.Millisecond)
+	q.Resume()
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	var rdy []string
+	for _, cmd := range n.got {
+		if bytes.HasPrefix(cmd, []byte("RDY ")) {
+			rdy = append(rdy, string(cmd))
+		}
+	}
+	if got := strings.Join(rdy, ", "); got != "RDY 5, RDY 0, RDY 1" {
+		t.Fatalf("unexpected RDY commands %s", got)
+	}
+}
+
+func TestConsumerStopWithTimeout(t *testing.T) {
+	msg := NewMessage(MessageID{'s', 't', 'o', 'p'}, []byte("body"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{500 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	q, _ := NewConsumer("test_stop_timeout", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	received := make(chan struct{})
+	release := make(chan struct{})
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		close(received)
+		<-release
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-received
+	start := time.Now()
+	if inFlight := q.StopWithTimeout(100 * time.Millisecond); inFlight != 1 {
+		t.Fatalf("expected 1 message in flight, got %d", inFlight)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("StopWithTimeout took %s", elapsed)
+	}
+	select {
+	case <-q.StopChan:
+	default:
+		t.Fatalf("expected consumer to be stopped")
+	}
+	close(release)
+	<-n.exitChan
+
+	q, _ = NewConsumer("test_stop_timeout", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+	if inFlight := q.StopWithTimeout(time.Second); inFlight != 0 {
+		t.Fatalf("expected no message in flight, got %d", inFlight)
+	}
+}
+
+func TestConsumerDrain(t *testing.T) {
+	msg := NewMessage(MessageID{'d', 'r', 'a', 'i', 'n'}, []byte("body"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{200 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 5
+	q, _ := NewConsumer("test_drain", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	received := make(chan struct{})
+	release := make(chan struct{})
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		close(received)
+		<-release
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-received
+	drained := q.Drain()
+	select {
+	case <-drained:
+		t.Fatalf("drained with a message in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatalf("not drained")
+	}
+	if stats := q.Stats(); stats.Connections != 1 || stats.MessagesFinished != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	q.Resume()
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	expected := []string{
+		"IDENTIFY",
+		"SUB test_drain ch",
+		"RDY 5",
+		"RDY 0",
+		fmt.Sprintf("FIN %s", msg.ID),
+		"RDY 5",
+	}
+	if len(n.got) != len(expected) {
+		t.Fatalf("we got %d commands != %d expected (%s)", len(n.got), len(expected), n.got)
+	}
+	for i, r := range n.got {
+		if string(r) != expected[i] {
+			t.Fatalf("cmd %d bad %s != %s", i, r, expected[i])
+		}
+	}
+}
+
+func TestConsumerMessages(t *testing.T) {
+	msg1 := NewMessage(MessageID{'c', 'h', 'a', 'n', '1'}, []byte("one"))
+	msg2 := NewMessage(MessageID{'c', 'h', 'a', 'n', '2'}, []byte("two"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg1)},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg2)},
+		// needed to exit test
+		instruction{200 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 5
+	q, _ := NewConsumer("test_messages", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	messages := q.Messages()
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	var bodies []string
+	for len(bodies) < 2 {
+		select {
+		case m := <-messages:
+			if !m.IsAutoResponseDisabled() {
+				t.Fatalf("expected auto-response to be disabled")
+			}
+			bodies = append(bodies, string(m.Body))
+			m.Finish()
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for messages")
+		}
+	}
+	if strings.Join(bodies, ",") != "one,two" {
+		t.Fatalf("unexpected messages %v", bodies)
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Fatalf("unexpected message")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("messages channel not closed")
+	}
+	<-q.StopChan
+
+	var finished int
+	for _, cmd := range n.got {
+		if bytes.HasPrefix(cmd, []byte("FIN ")) {
+			finished++
+		}
+	}
+	if finished != 2 {
+		t.Fatalf("expected 2 messages to be finished, got %s", n.got)
+	}
+}
+
+func TestConsumerFilter(t *testing.T) {
+	msgKeep := NewMessage(MessageID{'k', 'e', 'e', 'p'}, []byte("keep"))
+	msgDrop := NewMessage(MessageID{'d', 'r', 'o', 'p'}, []byte("drop"))
+	msgDrop.Attempts = 10
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgDrop)},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgKeep)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 5
+	config.MaxAttempts = 5
+	q, _ := NewConsumer("test_filter", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.SetFilter(func(m *Message) bool {
+		return string(m.Body) != "drop"
+	})
+	var handled []string
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		handled = append(handled, string(m.Body))
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	if len(handled) != 1 || handled[0] != "keep" {
+		t.Fatalf("unexpected handled messages %v", handled)
+	}
+	if stats := q.Stats(); stats.MessagesFiltered != 1 || stats.MessagesFinished != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestConsumerDedupe(t *testing.T) {
+	data, _ := EncodeEnvelope(map[string]string{HeaderDedupeID: "abc"}, []byte("enveloped"))
+	msg := NewMessage(MessageID{'d', 'u', 'p'}, []byte("raw"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// redelivered
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(MessageID{'e', '1'}, data))},
+		// published twice
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(MessageID{'e', '2'}, data))},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 5
+	config.DedupeWindow = time.Minute
+	q, _ := NewConsumer("test_dedupe", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	var handled int
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		handled++
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	if handled != 2 {
+		t.Fatalf("expected 2 messages to be handled, got %d", handled)
+	}
+	if stats := q.Stats(); stats.MessagesDeduped != 2 || stats.MessagesFinished != 4 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestConsumerOrderedHandlers(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+	}
+	for i, body := range []string{"a1", "b1", "a2", "b2", "a3", "b3"} {
+		msg := NewMessage(MessageID{'o', 'r', 'd', byte('0' + i)}, []byte(body))
+		script = append(script, instruction{5 * time.Millisecond, FrameTypeMessage, frameMessage(msg)})
+	}
+	// needed to exit test
+	script = append(script, instruction{200 * time.Millisecond, -1, []byte("exit")})
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 10
+	q, _ := NewConsumer("test_ordered", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected a panic for a concurrency of 0")
+			}
+		}()
+		q.AddOrderedHandlers(&testHandler{}, 0, func(m *Message) string { return "" })
+	}()
+
+	var mtx sync.Mutex
+	active := make(map[string]int)
+	handled := make(map[string][]string)
+	q.AddOrderedHandlers(HandlerFunc(func(m *Message) error {
+		key := string(m.Body[:1])
+		mtx.Lock()
+		active[key]++
+		if active[key] > 1 {
+			t.Errorf("messages with key %s handled concurrently", key)
+		}
+		mtx.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mtx.Lock()
+		active[key]--
+		handled[key] = append(handled[key], string(m.Body))
+		mtx.Unlock()
+		return nil
+	}), 4, func(m *Message) string {
+		return string(m.Body[:1])
+	})
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if got := strings.Join(handled["a"], ","); got != "a1,a2,a3" {
+		t.Fatalf("unexpected order %s", got)
+	}
+	if got := strings.Join(handled["b"], ","); got != "b1,b2,b3" {
+		t.Fatalf("unexpected order %s", got)
+	}
+}
+
+func TestConsumerStarvationHandler(t *testing.T) {
+	msg := NewMessage(MessageID{'s', 't', 'a', 'r', 'v', 'e'}, []byte("body"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{400 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.StarvationThreshold = 50 * time.Millisecond
+	q, _ := NewConsumer("test_starvation", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	events := make(chan bool, 2)
+	q.SetStarvationHandler(func(starved bool) {
+		events <- starved
+	})
+	release := make(chan struct{})
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		<-release
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	start := time.Now()
+	select {
+	case starved := <-events:
+		if !starved {
+			t.Fatalf("expected starvation event")
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Fatalf("starvation reported after %s", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no starvation event")
+	}
+	close(release)
+	select {
+	case starved := <-events:
+		if starved {
+			t.Fatalf("expected recovery event")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no recovery event")
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+}
+
+func TestConsumerBackoffPerConnection(t *testing.T) {
+	msgGood := NewMessage(MessageID{'g', 'o', 'o', 'd'}, []byte("good"))
+	msgBad := NewMessage(MessageID{'b', 'a', 'd'}, []byte("bad"))
+
+	script1 := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgBad)},
+		instruction{100 * time.Millisecond, FrameTypeMessage, frameMessage(msgGood)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+	script2 := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgGood)},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgGood)},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgGood)},
+		// needed to exit test
+		instruction{200 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n1 := newMockNSQD(t, script1, addr.String())
+	n2 := newMockNSQD(t, script2, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 10
+	config.BackoffMultiplier = 10 * time.Millisecond
+	config.BackoffPerConnection = true
+	q, _ := NewConsumer("test_backoff_per_connection", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	backoffLevels := make(chan int32, 2)
+	q.SetHooks(ConsumerHooks{
+		OnBackoff: func(d time.Duration) {
+			backoffLevels <- q.Stats().BackoffLevel
+		},
+	})
+	q.AddHandler(&testHandler{})
+	if err := q.ConnectToNSQD(n1.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := q.ConnectToNSQD(n2.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// until the good message, only the first connection is in backoff
+	time.Sleep(70 * time.Millisecond)
+	if level := <-backoffLevels; level != 1 {
+		t.Fatalf("unexpected backoff level %d", level)
+	}
+	stats := q.Stats()
+	if !stats.InBackoff || stats.BackoffLevel != 1 || len(stats.BackoffLevels) != 1 ||
+		stats.BackoffLevels[n1.tcpAddr.String()] != 1 {
+		t.Fatalf("unexpected backoff stats %+v", stats)
+	}
+
+	<-n1.exitChan
+	<-n2.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	rdy := func(n *mockNSQD) string {
+		var cmds []string
+		for _, cmd := range n.got {
+			if bytes.HasPrefix(cmd, []byte("RDY ")) {
+				cmds = append(cmds, string(cmd))
+			}
+		}
+		return strings.Join(cmds, ", ")
+	}
+	if got := rdy(n1); got != "RDY 10, RDY 5, RDY 0, RDY 1, RDY 5" {
+		t.Fatalf("unexpected RDY commands %s", got)
+	}
+	// the healthy nsqd is not backed off
+	if got := rdy(n2); got != "RDY 5" {
+		t.Fatalf("unexpected RDY commands %s", got)
+	}
+}
+
+func TestConsumerHooks(t *testing.T) {
+	msgBad := NewMessage(MessageID{'b', 'a', 'd'}, []byte("bad"))
+	msgGood := NewMessage(MessageID{'g', 'o', 'o', 'd'}, []byte("good"))
+	msgGiveUp := NewMessage(MessageID{'g', 'i', 'v', 'e', 'u', 'p'}, []byte("good"))
+	msgGiveUp.Attempts = 10
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgBad)},
+		instruction{100 * time.Millisecond, FrameTypeMessage, frameMessage(msgGood)},
+		instruction{50 * time.Millisecond, FrameTypeMessage, frameMessage(msgGiveUp)},
+		// needed to exit test
+		instruction{50 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 5
+	config.BackoffMultiplier = 10 * time.Millisecond
+	q, _ := NewConsumer("test_hooks", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	var mtx sync.Mutex
+	var events []string
+	event := func(e string) {
+		mtx.Lock()
+		events = append(events, e)
+		mtx.Unlock()
+	}
+	disconnected := make(chan error, 1)
+	q.SetHooks(ConsumerHooks{
+		OnConnect: func(addr string) {
+			event("connect " + addr)
+		},
+		OnDisconnect: func(addr string, err error) {
+			event("disconnect " + addr)
+			disconnected <- err
+		},
+		// the hooks may read the stats of the Consumer
+		OnBackoff: func(d time.Duration) {
+			event(fmt.Sprintf("backoff %s level %d", d, q.Stats().BackoffLevel))
+		},
+		OnResume: func() {
+			event(fmt.Sprintf("resume level %d", q.Stats().BackoffLevel))
+		},
+		OnGiveUp: func(m *Message) {
+			event(fmt.Sprintf("give up %s", m.ID))
+		},
+	})
+	q.AddHandler(&testHandler{})
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	select {
+	case err := <-disconnected:
+		if err == nil {
+			t.Fatalf("expected disconnect error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no disconnect")
+	}
+	q.Stop()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	expected := []string{
+		"connect " + n.tcpAddr.String(),
+		"backoff 20ms level 1",
+		"resume level 0",
+		fmt.Sprintf("give up %s", msgGiveUp.ID),
+		"disconnect " + n.tcpAddr.String(),
+	}
+	if strings.Join(events, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected events %q", events)
+	}
+}
+
+func fakeLookupSRV(records func() []*net.SRV) func() {
+	original := lookupSRV
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		return name, records(), nil
+	}
+	return func() { lookupSRV = original }
+}
+
+func srvRecord(addr string) *net.SRV {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	return &net.SRV{Target: host + ".", Port: uint16(p)}
+}
+
+func TestConsumerConnectToDNSSRV(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{300 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n1 := newMockNSQD(t, script, addr.String())
+	n2 := newMockNSQD(t, script, addr.String())
+
+	// the record set moves from n1 to n2 after the first resolution
+	var resolutions int32
+	defer fakeLookupSRV(func() []*net.SRV {
+		if atomic.AddInt32(&resolutions, 1) == 1 {
+			return []*net.SRV{srvRecord(n1.tcpAddr.String())}
+		}
+		return []*net.SRV{srvRecord(n2.tcpAddr.String())}
+	})()
+
+	config := NewConfig()
+	config.LookupdPollInterval = 50 * time.Millisecond
+	q, _ := NewConsumer("test_dns_srv", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+	if err := q.ConnectToDNSSRV("_nsqd._tcp.example.com"); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	addrs := func() string {
+		q.mtx.RLock()
+		defer q.mtx.RUnlock()
+		return strings.Join(q.nsqdTCPAddrs, ",")
+	}
+	if got := addrs(); got != n1.tcpAddr.String() {
+		t.Fatalf("unexpected nsqd %s", got)
+	}
+	deadline := time.Now().Add(time.Second)
+	for addrs() != n2.tcpAddr.String() {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected nsqd %s after SRV records changed", addrs())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	<-n1.exitChan
+	<-n2.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+}
+
+func TestProducerDNSSRVDiscover(t *testing.T) {
+	defer fakeLookupSRV(func() []*net.SRV {
+		return []*net.SRV{srvRecord("a:4150"), srvRecord("b:4150"), srvRecord("c:4150")}
+	})()
+
+	w, err := NewProducerFromDNSSRV("_nsqd._tcp.example.com", NewConfig())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer w.Stop()
+
+	// the nsqd last connected to is tried last
+	addrs, err := w.discoverer.discover(&w.config, "a:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if strings.Join(addrs, ",") != "b:4150,c:4150,a:4150" {
+		t.Fatalf("unexpected nsqd order %v", addrs)
+	}
+}
+
+func TestConsumerNodeSelector(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+		fmt.Fprintf(w, `{"producers":[
+			{"hostname":"canary","broadcast_address":"127.0.0.1","tcp_port":1},
+			{"hostname":"prod","broadcast_address":"127.0.0.1","tcp_port":%d}]}`,
+			n.tcpAddr.Port)
+	}))
+	defer lookupd.Close()
+
+	q, _ := NewConsumer("test_node_selector", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+	var hostnames []string
+	q.SetNodeSelector(func(nodes []*PeerInfo) []*PeerInfo {
+		var selected []*PeerInfo
+		for _, node := range nodes {
+			hostnames = append(hostnames, node.Hostname)
+			if node.Hostname != "canary" {
+				selected = append(selected, node)
+			}
+		}
+		return selected
+	})
+	if err := q.ConnectToNSQLookupd(lookupd.URL); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	if strings.Join(hostnames, ",") != "canary,prod" {
+		t.Fatalf("selector got unexpected nodes %v", hostnames)
+	}
+	q.mtx.RLock()
+	addrs := strings.Join(q.nsqdTCPAddrs, ",")
+	q.mtx.RUnlock()
+	if addrs != n.tcpAddr.String() {
+		t.Fatalf("connected to %s, expected %s", addrs, n.tcpAddr.String())
+	}
+}
+
+func TestConsumerLookupdRemoveQuorum(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{300 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	// both lookupd list n at first, then only the stale one does
+	var queries int32
+	lookupd := func(stale bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+			if !stale && atomic.AddInt32(&queries, 1) > 1 {
+				w.Write([]byte(`{"producers":[]}`))
+				return
+			}
+			fmt.Fprintf(w, `{"producers":[{"broadcast_address":"127.0.0.1","tcp_port":%d}]}`,
+				n.tcpAddr.Port)
+		}))
+	}
+	lookupd1 := lookupd(false)
+	defer lookupd1.Close()
+	lookupd2 := lookupd(true)
+	defer lookupd2.Close()
+
+	config := NewConfig()
+	config.LookupdPollInterval = 20 * time.Millisecond
+	config.LookupdPollJitter = 0
+	config.LookupdRemoveQuorum = 1
+	q, _ := NewConsumer("test_lookupd_remove_quorum", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+	if err := q.ConnectToNSQLookupds([]string{lookupd1.URL, lookupd2.URL}); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	addrs := func() string {
+		q.mtx.RLock()
+		defer q.mtx.RUnlock()
+		return strings.Join(q.nsqdTCPAddrs, ",")
+	}
+	if got := addrs(); got != n.tcpAddr.String() {
+		t.Fatalf("unexpected nsqd %s", got)
+	}
+	deadline := time.Now().Add(time.Second)
+	for addrs() != "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("still connected to %s after a quorum of nsqlookupd stopped listing it", addrs())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.Stats().LookupdStaleness <= 0 {
+		t.Errorf("LookupdStaleness not set after nsqlookupd was queried")
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+}
+
+func TestConsumerLookupdCachedNSQD(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	q, _ := NewConsumer("test_lookupd_cached_nsqd", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+
+	// the nsqd listed by an nsqlookupd that can no longer be queried
+	q.mtx.Lock()
+	q.lookupdResults["http://127.0.0.1:1/lookup?topic=test_lookupd_cached_nsqd"] = []string{n.tcpAddr.String()}
+	q.lookupdLastSuccess = time.Now()
+	q.mtx.Unlock()
+	if err := q.ConnectToNSQLookupd("127.0.0.1:1"); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	if len(n.got) == 0 || !bytes.HasPrefix(n.got[0], []byte("IDENTIFY")) {
+		t.Fatalf("did not connect to the cached nsqd")
+	}
+}
+
+func TestConsumerRun(t *testing.T) {
+	msg := NewMessage(MessageID{'r', 'u', 'n'}, []byte("body"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	q, _ := NewConsumer("test_run", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	received := make(chan struct{})
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		close(received)
+		return nil
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := q.Run(ctx, nil, nil); err != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected without addresses, got %v", err)
+	}
+	noHandlers, _ := NewConsumer("test_run", "ch", NewConfig())
+	noHandlers.SetLogger(nullLogger, LogLevelInfo)
+	if err := noHandlers.Run(ctx, nil, []string{n.tcpAddr.String()}); err == nil {
+		t.Fatalf("expected error connecting without handlers")
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- q.Run(ctx, nil, []string{n.tcpAddr.String()})
+	}()
+	<-received
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error from Run - %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return")
+	}
+	select {
+	case <-q.StopChan:
+	default:
+		t.Fatalf("expected consumer to be stopped")
+	}
+	<-n.exitChan
+
+	var cls bool
+	for _, cmd := range n.got {
+		cls = cls || bytes.Equal(cmd, []byte("CLS"))
+	}
+	if !cls {
+		t.Fatalf("expected CLS on stopping")
+	}
+}
+
+func TestConsumerGiveUpHandler(t *testing.T) {
+	msg := NewMessage(MessageID{'g', 'i', 'v', 'e', 'u', 'p'}, []byte("persist me"))
+	msg.Attempts = 6
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxAttempts = 5
+	q, _ := NewConsumer("test_give_up_handler", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	gaveUp := make(chan *Message, 1)
+	q.SetGiveUpHandler(func(m *Message) {
+		gaveUp <- m
+	})
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		t.Errorf("handler called for msg %s that exceeded max_attempts", m.ID)
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	select {
+	case m := <-gaveUp:
+		if m.ID != msg.ID || string(m.Body) != "persist me" || m.Attempts != 6 {
+			t.Fatalf("give up handler got unexpected msg %s %q (%d attempts)", m.ID, m.Body, m.Attempts)
+		}
+	default:
+		t.Fatalf("give up handler not called")
+	}
+	if !bytes.Equal(n.got[len(n.got)-1], []byte("FIN "+string(msg.ID[:]))) {
+		t.Fatalf("expected FIN after giving up, got %s", n.got[len(n.got)-1])
+	}
+}
+
+func TestConsumerEnvelopeCodec(t *testing.T) {
+	body, _ := EncodeEnvelope(map[string]string{
+		HeaderContentType:   ContentTypeJSON,
+		HeaderSchemaVersion: "2",
+	}, []byte(`{"a":1}`))
+	enveloped := NewMessage(MessageID{'e', 'n', 'v'}, body)
+	plain := NewMessage(MessageID{'p', 'l', 'a', 'i', 'n'}, []byte("plain"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(enveloped)},
+		instruction{0, FrameTypeMessage, frameMessage(plain)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 2
+	q, _ := NewConsumer("test_envelope_codec", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.SetEnvelopeCodec(DefaultEnvelopeCodec)
+	var mtx sync.Mutex
+	var got []string
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		got = append(got, fmt.Sprintf("%s %s %s/%s", m.ID[:len("env")], m.Body,
+			m.Headers[HeaderContentType], m.Headers[HeaderSchemaVersion]))
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if strings.Join(got, ", ") != `env {"a":1} application/json/2, pla plain /` {
+		t.Fatalf("unexpected messages %v", got)
+	}
+}
+
+func TestConsumerMessageBatch(t *testing.T) {
+	msg1 := NewMessage(MessageID{'b', '1'}, []byte("one"))
+	msg2 := NewMessage(MessageID{'b', '2'}, []byte("two"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte(`{"max_rdy_count":2500,"msg_timeout":60000}`)},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg1)},
+		instruction{0, FrameTypeMessage, frameMessage(msg2)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 2
+	q, _ := NewConsumer("test_message_batch", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	var batch MessageBatch
+	full := make(chan struct{})
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		batch.Add(m)
+		if batch.Len() == 2 {
+			close(full)
+		}
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-full
+	deadline := batch.Deadline()
+	if until := time.Until(deadline); until <= 59*time.Second || until > time.Minute {
+		t.Fatalf("unexpected batch deadline in %s", until)
+	}
+	time.Sleep(10 * time.Millisecond)
+	batch.Touch()
+	if !batch.Deadline().After(deadline) {
+		t.Fatalf("batch deadline not extended by Touch")
+	}
+	batch.Finish()
+	if batch.Len() != 0 {
+		t.Fatalf("batch not emptied by Finish")
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	var responses []string
+	for _, cmd := range n.got {
+		if bytes.HasPrefix(cmd, []byte("TOUCH ")) || bytes.HasPrefix(cmd, []byte("FIN ")) {
+			responses = append(responses, string(bytes.TrimRight(cmd, "\x00")))
+		}
+	}
+	if strings.Join(responses, ", ") != "TOUCH b1, TOUCH b2, FIN b1, FIN b2" {
+		t.Fatalf("unexpected responses %v", responses)
+	}
+}
+
+func TestConsumerBatchHandler(t *testing.T) {
+	var script []instruction
+	script = append(script,
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")})
+	for _, id := range []string{"b1", "b2", "b3"} {
+		var msgID MessageID
+		copy(msgID[:], id)
+		script = append(script, instruction{10 * time.Millisecond, FrameTypeMessage,
+			frameMessage(NewMessage(msgID, []byte(id)))})
+	}
+	// needed to exit test
+	script = append(script, instruction{200 * time.Millisecond, -1, []byte("exit")})
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 3
+	q, _ := NewConsumer("test_batch_handler", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	var mtx sync.Mutex
+	var batches []string
+	q.AddBatchHandler(BatchHandlerFunc(func(messages []*Message) error {
+		var bodies []string
+		for _, m := range messages {
+			bodies = append(bodies, string(m.Body))
+		}
+		mtx.Lock()
+		batches = append(batches, strings.Join(bodies, "+"))
+		mtx.Unlock()
+		if len(messages) == 1 {
+			return errors.New("fail")
+		}
+		return nil
+	}), 2, 50*time.Millisecond)
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	// a full batch, then one flushed after lingering
+	mtx.Lock()
+	defer mtx.Unlock()
+	if strings.Join(batches, ", ") != "b1+b2, b3" {
+		t.Fatalf("unexpected batches %v", batches)
+	}
+	var responses []string
+	for _, cmd := range n.got {
+		if bytes.HasPrefix(cmd, []byte("FIN ")) || bytes.HasPrefix(cmd, []byte("REQ ")) {
+			responses = append(responses, string(bytes.TrimRight(cmd[:6], "\x00")))
+		}
+	}
+	if strings.Join(responses, ", ") != "FIN b1, FIN b2, REQ b3" {
+		t.Fatalf("unexpected responses %v", responses)
+	}
+}
+
+func TestConsumerBatchHandlerPanic(t *testing.T) {
+	var script []instruction
+	script = append(script,
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")})
+	for _, id := range []string{"b1", "b2"} {
+		var msgID MessageID
+		copy(msgID[:], id)
+		script = append(script, instruction{10 * time.Millisecond, FrameTypeMessage,
+			frameMessage(NewMessage(msgID, []byte(id)))})
+	}
+	// needed to exit test
+	script = append(script, instruction{100 * time.Millisecond, -1, []byte("exit")})
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.MaxInFlight = 2
+	config.RecoverHandlerPanics = true
+	q, _ := NewConsumer("test_batch_handler_panic", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	var recovered int32
+	q.SetPanicHandler(func(m *Message, p interface{}, stack []byte) {
+		atomic.AddInt32(&recovered, 1)
+	})
+	q.AddBatchHandler(BatchHandlerFunc(func(messages []*Message) error {
+		panic("boom")
+	}), 2, 50*time.Millisecond)
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	if stats := q.Stats(); stats.HandlerPanics != 1 || atomic.LoadInt32(&recovered) != 2 {
+		t.Fatalf("unexpected stats %+v (panic handler called %d times)", stats, recovered)
+	}
+	var responses []string
+	for _, cmd := range n.got {
+		if bytes.HasPrefix(cmd, []byte("FIN ")) || bytes.HasPrefix(cmd, []byte("REQ ")) {
+			responses = append(responses, string(bytes.TrimRight(cmd[:6], "\x00")))
+		}
+	}
+	if strings.Join(responses, ", ") != "REQ b1, REQ b2" {
+		t.Fatalf("unexpected responses %v", responses)
+	}
+}
+
+func TestConsumerErrRequeueWithoutBackoff(t *testing.T) {
+	msg := NewMessage(MessageID{'l', 'a', 't', 'e', 'r'}, []byte("not ready"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	q, _ := NewConsumer("test_requeue_without_backoff", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	var backoffs int32
+	q.SetHooks(ConsumerHooks{
+		OnBackoff: func(d time.Duration) {
+			atomic.AddInt32(&backoffs, 1)
+		},
+	})
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		return fmt.Errorf("wrapped - %w", ErrRequeueWithoutBackoff{Delay: 30 * time.Second})
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	if atomic.LoadInt32(&backoffs) != 0 || q.Stats().BackoffLevel != 0 {
+		t.Fatalf("requeue triggered backoff")
+	}
+	var requeued bool
+	for _, cmd := range n.got {
+		requeued = requeued || bytes.Equal(cmd, []byte("REQ later"+strings.Repeat("\x00", 11)+" 30000"))
+	}
+	if !requeued {
+		t.Fatalf("msg not requeued with the requested delay")
+	}
+}
+
+func TestConsumerMessageProvenance(t *testing.T) {
+	msg := NewMessage(MessageID{'p', 'r', 'o', 'v'}, []byte("body"))
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	q, _ := NewConsumer("test_message_provenance", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	received := make(chan *Message, 1)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		received <- m
+		return nil
+	}))
+	start := time.Now()
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	m := <-received
+	q.mtx.RLock()
+	conn := q.connections[n.tcpAddr.String()]
+	q.mtx.RUnlock()
+	if m.NSQDAddress != n.tcpAddr.String() {
+		t.Errorf("unexpected NSQDAddress %s", m.NSQDAddress)
+	}
+	if conn == nil || m.ConnID != conn.ID() || m.ConnID == 0 {
+		t.Errorf("unexpected ConnID %d", m.ConnID)
+	}
+	if m.ReceivedAt.Before(start) || m.ReceivedAt.After(time.Now()) {
+		t.Errorf("unexpected ReceivedAt %s", m.ReceivedAt)
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+}
+
+func TestConsumerPoolMessages(t *testing.T) {
+	var msgs []*Message
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+	}
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(MessageID{'p', 'o', 'o', 'l', byte('0' + i)}, []byte(fmt.Sprintf("pooled %d", i)))
+		msgs = append(msgs, msg)
+		script = append(script, instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)})
+	}
+	// needed to exit test
+	script = append(script, instruction{100 * time.Millisecond, -1, []byte("exit")})
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.PoolMessages = true
+	config.MaxInFlight = 5
+	q, _ := NewConsumer("test_pool_messages", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	var retained, copied *Message
+	var count int
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		switch count {
+		case 0:
+			m.Retain()
+			retained = m
+		case 1:
+			copied = m.Copy()
+		}
+		count++
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	if count != 3 {
+		t.Fatalf("expected 3 messages handled, got %d", count)
+	}
+	if retained.ID != msgs[0].ID || string(retained.Body) != "pooled 0" || !retained.HasResponded() {
+		t.Errorf("retained message was recycled: %s %q", retained.ID, retained.Body)
+	}
+	retained.Release()
+	if copied.ID != msgs[1].ID || string(copied.Body) != "pooled 1" || copied.pooled {
+		t.Errorf("unexpected copy: %s %q", copied.ID, copied.Body)
+	}
+	copied.Finish() // a no-op for a copy
+
+	var fins int
+	for _, cmd := range n.got {
+		if bytes.HasPrefix(cmd, []byte("FIN")) {
+			fins++
+		}
+	}
+	if fins != 3 {
+		t.Errorf("expected 3 FIN, got %d (%s)", fins, n.got)
+	}
+}
+
+func TestConsumerClockSkew(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+	}
+	// requeued messages keep their (old) timestamp and don't count
+	for i := 0; i < 2; i++ {
+		msg := NewMessage(MessageID{'r', 'e', 'q', byte('0' + i)}, []byte("body"))
+		msg.Timestamp = time.Now().Add(-2 * time.Hour).UnixNano()
+		msg.Attempts = 2
+		script = append(script, instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)})
+	}
+	ahead := time.Now().Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		msg := NewMessage(MessageID{'s', 'k', 'e', 'w', byte('0' + i)}, []byte("body"))
+		msg.Timestamp = ahead.UnixNano()
+		script = append(script, instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)})
+	}
+	// needed to exit test
+	script = append(script, instruction{100 * time.Millisecond, -1, []byte("exit")})
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.ClockSkewThreshold = time.Minute
+	config.ClockSkewSamples = 2
+	config.MaxInFlight = 5
+	q, _ := NewConsumer("test_clock_skew", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	skews := make(chan time.Duration, 2)
+	q.SetHooks(ConsumerHooks{
+		OnClockSkew: func(addr string, skew time.Duration) {
+			skews <- skew
+		},
+	})
+	ages := make(chan time.Duration, 2)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		if m.Attempts > 1 {
+			return nil
+		}
+		if !m.Time().Equal(time.Unix(0, ahead.UnixNano())) {
+			t.Errorf("unexpected Time %s", m.Time())
+		}
+		ages <- m.Age()
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	if age := <-ages; age > -59*time.Minute {
+		t.Errorf("unexpected Age %s", age)
+	}
+	select {
+	case skew := <-skews:
+		if skew > -59*time.Minute || skew < -time.Hour {
+			t.Errorf("unexpected skew %s", skew)
+		}
+	default:
+		t.Fatalf("clock skew was not reported")
+	}
+	if len(skews) != 0 {
+		t.Errorf("clock skew reported more than once")
+	}
+}
+
+func TestConsumerTraceContext(t *testing.T) {
+	tc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "vendor=value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]string{}
+	InjectTraceContext(ContextWithTraceContext(context.Background(), tc), headers)
+	body, _ := EncodeEnvelope(headers, []byte("traced"))
+	msg := NewMessage(MessageID{'t', 'r', 'a', 'c', 'e'}, body)
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	q, _ := NewConsumer("test_trace_context", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.SetEnvelopeCodec(DefaultEnvelopeCodec)
+	received := make(chan TraceContext, 1)
+	q.AddHandlerWithContext(HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+		got, ok := TraceContextFromContext(ctx)
+		if !ok {
+			t.Errorf("no trace context for msg %s", m.ID)
+		}
+		received <- got
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer did not stop")
+	}
+
+	got := <-received
+	if got != tc || got.Traceparent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" || !got.IsSampled() {
+		t.Fatalf("unexpected trace context %+v", got)
+	}
+}
@@ -0,0 +1,134 @@
+// Package nsqprom exposes the stats of Consumers and Producers (see
+// nsq.Consumer.Stats and nsq.Producer.Stats) as Prometheus metrics.
+//
+// The collectors read the stats when scraped, for example:
+//
+//	prometheus.MustRegister(nsqprom.NewConsumerCollector(consumer, prometheus.Labels{
+//		"topic":   "events",
+//		"channel": "archive",
+//	}))
+//	prometheus.MustRegister(nsqprom.NewProducerCollector(producer, nil))
+package nsqprom
+
+import (
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Namespace prefixes the names of the metrics
+const Namespace = "nsq"
+
+// ConsumerCollector is a prometheus.Collector for the stats of a nsq.Consumer
+type ConsumerCollector struct {
+	consumer *nsq.Consumer
+
+	received    *prometheus.Desc
+	finished    *prometheus.Desc
+	requeued    *prometheus.Desc
+	inFlight    *prometheus.Desc
+	backoff     *prometheus.Desc
+	backoffLvl  *prometheus.Desc
+	connections *prometheus.Desc
+}
+
+// NewConsumerCollector returns a ConsumerCollector for consumer, whose metrics
+// have the constant labels (e.g. its topic and channel)
+func NewConsumerCollector(consumer *nsq.Consumer, labels prometheus.Labels) *ConsumerCollector {
+	desc := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(Namespace, "consumer", name), help, nil, labels)
+	}
+	return &ConsumerCollector{
+		consumer:    consumer,
+		received:    desc("messages_received_total", "Number of messages received from nsqd."),
+		finished:    desc("messages_finished_total", "Number of messages finished."),
+		requeued:    desc("requeues_total", "Number of messages requeued."),
+		inFlight:    desc("in_flight", "Number of messages received and not yet responded to."),
+		backoff:     desc("backoff_seconds_total", "Total duration of the backoffs started after failures."),
+		backoffLvl:  desc("backoff_level", "Number of consecutive failures backed off for, 0 when not in backoff."),
+		connections: desc("connections", "Number of connections to nsqd."),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *ConsumerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.received
+	ch <- c.finished
+	ch <- c.requeued
+	ch <- c.inFlight
+	ch <- c.backoff
+	ch <- c.backoffLvl
+	ch <- c.connections
+}
+
+// Collect implements prometheus.Collector
+func (c *ConsumerCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.consumer.Stats()
+	ch <- prometheus.MustNewConstMetric(c.received, prometheus.CounterValue, float64(stats.MessagesReceived))
+	ch <- prometheus.MustNewConstMetric(c.finished, prometheus.CounterValue, float64(stats.MessagesFinished))
+	ch <- prometheus.MustNewConstMetric(c.requeued, prometheus.CounterValue, float64(stats.MessagesRequeued))
+	ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue, float64(stats.MessagesInFlight))
+	ch <- prometheus.MustNewConstMetric(c.backoff, prometheus.CounterValue, stats.BackoffTime.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.backoffLvl, prometheus.GaugeValue, float64(stats.BackoffLevel))
+	ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(stats.Connections))
+}
+
+// ProducerCollector is a prometheus.Collector for the stats of a nsq.Producer
+type ProducerCollector struct {
+	producer *nsq.Producer
+
+	published *prometheus.Desc
+	bytes     *prometheus.Desc
+	errors    *prometheus.Desc
+	retries   *prometheus.Desc
+	pending   *prometheus.Desc
+	latency   *prometheus.Desc
+}
+
+// NewProducerCollector returns a ProducerCollector for producer, whose metrics
+// have the constant labels
+func NewProducerCollector(producer *nsq.Producer, labels prometheus.Labels) *ProducerCollector {
+	desc := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(Namespace, "producer", name), help, nil, labels)
+	}
+	return &ProducerCollector{
+		producer:  producer,
+		published: desc("messages_published_total", "Number of messages acknowledged by nsqd."),
+		bytes:     desc("bytes_published_total", "Number of bytes of message bodies acknowledged by nsqd."),
+		errors:    desc("errors_total", "Number of publish commands rejected by nsqd or abandoned without a response."),
+		retries:   desc("retries_total", "Number of publish commands retried."),
+		pending:   desc("pending", "Number of publish commands awaiting a response."),
+		latency:   desc("publish_latency_seconds", "Time between sending a publish command and receiving its response."),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *ProducerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.published
+	ch <- c.bytes
+	ch <- c.errors
+	ch <- c.retries
+	ch <- c.pending
+	ch <- c.latency
+}
+
+// Collect implements prometheus.Collector
+func (c *ProducerCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.producer.Stats()
+	ch <- prometheus.MustNewConstMetric(c.published, prometheus.CounterValue, float64(stats.MessagesPublished))
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.CounterValue, float64(stats.BytesPublished))
+	ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, float64(stats.Errors))
+	ch <- prometheus.MustNewConstMetric(c.retries, prometheus.CounterValue, float64(stats.Retries))
+	ch <- prometheus.MustNewConstMetric(c.pending, prometheus.GaugeValue, float64(stats.Pending))
+
+	// the buckets of nsq.ProducerStats aren't cumulative, the last one
+	// (without an upper bound) is only counted in the total
+	var count uint64
+	buckets := make(map[float64]uint64, len(stats.Latency))
+	for _, b := range stats.Latency {
+		count += b.Count
+		if b.UpperBound > 0 {
+			buckets[b.UpperBound.Seconds()] = count
+		}
+	}
+	ch <- prometheus.MustNewConstHistogram(c.latency, count, stats.LatencySum.Seconds(), buckets)
+}
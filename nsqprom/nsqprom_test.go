@@ -0,0 +1,67 @@
+package nsqprom
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollectors(t *testing.T) {
+	consumer, err := nsq.NewConsumer("events", "archive", nsq.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer, err := nsq.NewProducer("127.0.0.1:4150", nsq.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(
+		NewConsumerCollector(consumer, prometheus.Labels{"topic": "events", "channel": "archive"}),
+		NewProducerCollector(producer, nil),
+	)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range families {
+		names = append(names, f.GetName())
+		switch f.GetName() {
+		case "nsq_consumer_messages_received_total":
+			labels := f.GetMetric()[0].GetLabel()
+			if len(labels) != 2 || labels[0].GetName() != "channel" || labels[1].GetValue() != "events" {
+				t.Errorf("unexpected labels %v", labels)
+			}
+		case "nsq_producer_publish_latency_seconds":
+			h := f.GetMetric()[0].GetHistogram()
+			if h.GetSampleCount() != 0 || len(h.GetBucket()) == 0 {
+				t.Errorf("unexpected histogram %v", h)
+			}
+		}
+	}
+	sort.Strings(names)
+	expected := []string{
+		"nsq_consumer_backoff_level",
+		"nsq_consumer_backoff_seconds_total",
+		"nsq_consumer_connections",
+		"nsq_consumer_in_flight",
+		"nsq_consumer_messages_finished_total",
+		"nsq_consumer_messages_received_total",
+		"nsq_consumer_requeues_total",
+		"nsq_producer_bytes_published_total",
+		"nsq_producer_errors_total",
+		"nsq_producer_messages_published_total",
+		"nsq_producer_pending",
+		"nsq_producer_publish_latency_seconds",
+		"nsq_producer_retries_total",
+	}
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Fatalf("unexpected metrics %v", names)
+	}
+}
@@ -0,0 +1,12 @@
+module github.com/nsqio/go-nsq/nsqproto
+
+go 1.18
+
+require (
+	github.com/nsqio/go-nsq v1.0.9-0.20261016032858-b8a8ea33c256
+	google.golang.org/protobuf v1.33.0
+)
+
+require github.com/golang/snappy v0.0.1 // indirect
+
+replace github.com/nsqio/go-nsq => ../
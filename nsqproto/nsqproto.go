@@ -0,0 +1,59 @@
+// Package nsqproto publishes and decodes protocol buffer messages.
+//
+// Messages are published in an nsq.Envelope with the nsq.HeaderContentType
+// ContentType, for example:
+//
+//	err := nsqproto.Publish(producer, "events", &pb.Event{Name: "signup"})
+//
+// and decoded in a handler with:
+//
+//	var event pb.Event
+//	err := nsqproto.Unmarshal(message.Body, &event)
+package nsqproto
+
+import (
+	"fmt"
+
+	"github.com/nsqio/go-nsq"
+	"google.golang.org/protobuf/proto"
+)
+
+// ContentType is the nsq.HeaderContentType of messages published by this package
+const ContentType = "application/x-protobuf"
+
+// Marshal encodes m in an nsq.Envelope with the nsq.HeaderContentType ContentType
+func Marshal(m proto.Message) ([]byte, error) {
+	body, err := proto.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return nsq.EncodeEnvelope(map[string]string{nsq.HeaderContentType: ContentType}, body)
+}
+
+// Publish marshals m (see Marshal) and synchronously publishes it to the
+// specified topic, returning an error if marshaling or publish failed
+func Publish(w *nsq.Producer, topic string, m proto.Message) error {
+	data, err := Marshal(m)
+	if err != nil {
+		return err
+	}
+	return w.Publish(topic, data)
+}
+
+// Unmarshal decodes a message body into m. The body may be a bare protocol
+// buffer or one enveloped by Marshal, an envelope with a different
+// nsq.HeaderContentType is an error.
+func Unmarshal(data []byte, m proto.Message) error {
+	env, err := nsq.DecodeEnvelope(data)
+	switch {
+	case err == nsq.ErrNotEnveloped:
+	case err != nil:
+		return err
+	default:
+		if ct := env.ContentType(); ct != "" && ct != ContentType {
+			return fmt.Errorf("unexpected content-type %q", ct)
+		}
+		data = env.Body
+	}
+	return proto.Unmarshal(data, m)
+}
@@ -0,0 +1,50 @@
+package nsqproto
+
+import (
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestMarshalUnmarshal(t *testing.T) {
+	data, err := Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := nsq.DecodeEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.ContentType() != ContentType {
+		t.Fatalf("content-type %q != %q", env.ContentType(), ContentType)
+	}
+
+	var got wrapperspb.StringValue
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.GetValue() != "hello" {
+		t.Fatalf("got %q", got.GetValue())
+	}
+}
+
+func TestUnmarshalBare(t *testing.T) {
+	data, _ := proto.Marshal(wrapperspb.String("bare"))
+	var got wrapperspb.StringValue
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.GetValue() != "bare" {
+		t.Fatalf("got %q", got.GetValue())
+	}
+}
+
+func TestUnmarshalContentType(t *testing.T) {
+	data, _ := nsq.EncodeEnvelope(map[string]string{nsq.HeaderContentType: nsq.ContentTypeJSON}, []byte(`{}`))
+	var got wrapperspb.StringValue
+	if err := Unmarshal(data, &got); err == nil {
+		t.Fatal("expected error for JSON content-type")
+	}
+}
@@ -0,0 +1,232 @@
+// Package nsqstatsd periodically sends the stats of Consumers and Producers
+// (see nsq.Consumer.Stats and nsq.Producer.Stats) to statsd, like nsqd does
+// for its own stats.
+//
+// Counters are sent as the increments since the previous flush, for example:
+//
+//	client, err := nsqstatsd.NewUDPClient("127.0.0.1:8125")
+//	emitter := nsqstatsd.NewEmitter(client, nsqstatsd.WithPrefix("nsq.myapp."))
+//	emitter.AddConsumer("events.archive", consumer)
+//	emitter.Start()
+//	defer emitter.Stop()
+//
+// sends nsq.myapp.events.archive.messages_received and so on every 60s.
+package nsqstatsd
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// Client sends statsd metrics
+type Client interface {
+	// Incr increments the counter stat by count
+	Incr(stat string, count int64) error
+	// Gauge sets the gauge stat to value
+	Gauge(stat string, value int64) error
+	// Timing records a duration for the timer stat
+	Timing(stat string, d time.Duration) error
+}
+
+// UDPClient is a Client sending each metric in a UDP packet
+type UDPClient struct {
+	conn net.Conn
+}
+
+// NewUDPClient returns a UDPClient sending metrics to the statsd at addr
+func NewUDPClient(addr string) (*UDPClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPClient{conn: conn}, nil
+}
+
+// Incr implements Client
+func (c *UDPClient) Incr(stat string, count int64) error {
+	return c.send(stat, count, "c")
+}
+
+// Gauge implements Client
+func (c *UDPClient) Gauge(stat string, value int64) error {
+	return c.send(stat, value, "g")
+}
+
+// Timing implements Client
+func (c *UDPClient) Timing(stat string, d time.Duration) error {
+	return c.send(stat, int64(d/time.Millisecond), "ms")
+}
+
+func (c *UDPClient) send(stat string, value int64, kind string) error {
+	_, err := fmt.Fprintf(c.conn, "%s:%d|%s", stat, value, kind)
+	return err
+}
+
+// Close closes the connection of the client
+func (c *UDPClient) Close() error {
+	return c.conn.Close()
+}
+
+// Option configures an Emitter
+type Option func(e *Emitter)
+
+// WithPrefix sets the prefix of the names of the metrics, "nsq." by default
+func WithPrefix(prefix string) Option {
+	return func(e *Emitter) {
+		e.prefix = prefix
+	}
+}
+
+// WithInterval sets the interval between flushes, 60s by default
+func WithInterval(d time.Duration) Option {
+	return func(e *Emitter) {
+		e.interval = d
+	}
+}
+
+// Emitter periodically sends the stats of the Consumers and Producers added to
+// it with a Client
+type Emitter struct {
+	client   Client
+	prefix   string
+	interval time.Duration
+
+	mtx     sync.Mutex
+	sources []source
+
+	stopOnce sync.Once
+	exitChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// source is a Consumer or Producer, with its stats as of the previous flush
+type source struct {
+	name     string
+	consumer *nsq.Consumer
+	producer *nsq.Producer
+
+	lastConsumer nsq.ConsumerStats
+	lastProducer nsq.ProducerStats
+}
+
+// NewEmitter returns an Emitter sending metrics with client
+func NewEmitter(client Client, opts ...Option) *Emitter {
+	e := &Emitter{
+		client:   client,
+		prefix:   "nsq.",
+		interval: 60 * time.Second,
+		exitChan: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// AddConsumer adds consumer, whose metrics are prefixed with name (e.g. its
+// topic and channel)
+func (e *Emitter) AddConsumer(name string, consumer *nsq.Consumer) {
+	e.mtx.Lock()
+	e.sources = append(e.sources, source{name: name, consumer: consumer})
+	e.mtx.Unlock()
+}
+
+// AddProducer adds producer, whose metrics are prefixed with name
+func (e *Emitter) AddProducer(name string, producer *nsq.Producer) {
+	e.mtx.Lock()
+	e.sources = append(e.sources, source{name: name, producer: producer})
+	e.mtx.Unlock()
+}
+
+// Start spawns a goroutine which flushes the stats every interval, until Stop
+func (e *Emitter) Start() {
+	e.wg.Add(1)
+	go e.loop()
+}
+
+// Stop flushes the stats one last time and stops the goroutine spawned by Start
+func (e *Emitter) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.exitChan)
+	})
+	e.wg.Wait()
+}
+
+func (e *Emitter) loop() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.Flush()
+		case <-e.exitChan:
+			e.Flush()
+			return
+		}
+	}
+}
+
+// Flush sends the stats of every Consumer and Producer, returning the first
+// error of the Client (if any)
+func (e *Emitter) Flush() error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	var firstErr error
+	send := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for i := range e.sources {
+		s := &e.sources[i]
+		prefix := e.prefix + s.name + "."
+		if s.consumer != nil {
+			e.flushConsumer(prefix, s, send)
+		} else {
+			e.flushProducer(prefix, s, send)
+		}
+	}
+	return firstErr
+}
+
+func (e *Emitter) flushConsumer(prefix string, s *source, send func(error)) {
+	stats := s.consumer.Stats()
+	last := s.lastConsumer
+	send(e.client.Incr(prefix+"messages_received", int64(stats.MessagesReceived-last.MessagesReceived)))
+	send(e.client.Incr(prefix+"messages_finished", int64(stats.MessagesFinished-last.MessagesFinished)))
+	send(e.client.Incr(prefix+"messages_requeued", int64(stats.MessagesRequeued-last.MessagesRequeued)))
+	send(e.client.Incr(prefix+"backoff_ms", int64((stats.BackoffTime-last.BackoffTime)/time.Millisecond)))
+	send(e.client.Gauge(prefix+"in_flight", stats.MessagesInFlight))
+	send(e.client.Gauge(prefix+"connections", int64(stats.Connections)))
+	send(e.client.Gauge(prefix+"backoff_level", int64(stats.BackoffLevel)))
+	s.lastConsumer = *stats
+}
+
+func (e *Emitter) flushProducer(prefix string, s *source, send func(error)) {
+	stats := s.producer.Stats()
+	last := s.lastProducer
+	send(e.client.Incr(prefix+"messages_published", int64(stats.MessagesPublished-last.MessagesPublished)))
+	send(e.client.Incr(prefix+"bytes_published", int64(stats.BytesPublished-last.BytesPublished)))
+	send(e.client.Incr(prefix+"errors", int64(stats.Errors-last.Errors)))
+	send(e.client.Incr(prefix+"retries", int64(stats.Retries-last.Retries)))
+	send(e.client.Gauge(prefix+"pending", int64(stats.Pending)))
+
+	// the mean latency of the publishes since the previous flush
+	var count, lastCount uint64
+	for _, b := range stats.Latency {
+		count += b.Count
+	}
+	for _, b := range last.Latency {
+		lastCount += b.Count
+	}
+	if count > lastCount {
+		mean := (stats.LatencySum - last.LatencySum) / time.Duration(count-lastCount)
+		send(e.client.Timing(prefix+"publish_latency", mean))
+	}
+	s.lastProducer = *stats
+}
@@ -0,0 +1,95 @@
+package nsqstatsd
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+type recordingClient struct {
+	mtx   sync.Mutex
+	stats []string
+}
+
+func (c *recordingClient) record(stat string, kind string) error {
+	c.mtx.Lock()
+	c.stats = append(c.stats, stat+"|"+kind)
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *recordingClient) Incr(stat string, count int64) error       { return c.record(stat, "c") }
+func (c *recordingClient) Gauge(stat string, value int64) error      { return c.record(stat, "g") }
+func (c *recordingClient) Timing(stat string, d time.Duration) error { return c.record(stat, "ms") }
+
+func TestEmitter(t *testing.T) {
+	consumer, err := nsq.NewConsumer("events", "archive", nsq.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer, err := nsq.NewProducer("127.0.0.1:4150", nsq.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &recordingClient{}
+	e := NewEmitter(client, WithPrefix("test."), WithInterval(time.Hour))
+	e.AddConsumer("events.archive", consumer)
+	e.AddProducer("events", producer)
+	e.Start()
+	// flushes once when stopped
+	e.Stop()
+
+	sort.Strings(client.stats)
+	expected := []string{
+		"test.events.archive.backoff_level|g",
+		"test.events.archive.backoff_ms|c",
+		"test.events.archive.connections|g",
+		"test.events.archive.in_flight|g",
+		"test.events.archive.messages_finished|c",
+		"test.events.archive.messages_received|c",
+		"test.events.archive.messages_requeued|c",
+		"test.events.bytes_published|c",
+		"test.events.errors|c",
+		"test.events.messages_published|c",
+		"test.events.pending|g",
+		"test.events.retries|c",
+	}
+	if strings.Join(client.stats, " ") != strings.Join(expected, " ") {
+		t.Fatalf("unexpected stats %v", client.stats)
+	}
+}
+
+func TestUDPClient(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := NewUDPClient(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Incr("a", 3)
+	client.Gauge("b", 4)
+	client.Timing("c", 1500*time.Millisecond)
+
+	buf := make([]byte, 512)
+	for _, expected := range []string{"a:3|c", "b:4|g", "c:1500|ms"} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != expected {
+			t.Errorf("expected %q, got %q", expected, buf[:n])
+		}
+	}
+}
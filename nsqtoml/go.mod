@@ -0,0 +1,12 @@
+module github.com/nsqio/go-nsq/nsqtoml
+
+go 1.18
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/nsqio/go-nsq v1.0.9-0.20261016032858-b8a8ea33c256
+)
+
+require github.com/golang/snappy v0.0.1 // indirect
+
+replace github.com/nsqio/go-nsq => ../
@@ -0,0 +1,48 @@
+// Package nsqtoml loads nsq.Config options from TOML documents.
+//
+// The document's top level keys are the option names accepted by
+// nsq.Config.Set, for example:
+//
+//	max_in_flight = 200
+//	read_timeout = "30s"
+//	tls_v1 = true
+//
+// Values are coerced following the same rules as nsq.Config.Set (numbers
+// for durations are interpreted as milliseconds).
+package nsqtoml
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nsqio/go-nsq"
+)
+
+// NewConfigFromFile returns a new nsq configuration initialized with
+// defaults and then updated with the options found in the TOML document
+// at the supplied path.
+func NewConfigFromFile(path string) (*nsq.Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := nsq.NewConfig()
+	if err := Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("config file %s - %s", path, err)
+	}
+	return c, nil
+}
+
+// Unmarshal applies the options in the TOML document data to c and then
+// validates it (see nsq.Config.Validate).
+func Unmarshal(data []byte, c *nsq.Config) error {
+	var opts map[string]interface{}
+	if _, err := toml.Decode(string(data), &opts); err != nil {
+		return err
+	}
+	if err := c.SetMany(opts); err != nil {
+		return err
+	}
+	return c.Validate()
+}
@@ -0,0 +1,15 @@
+module github.com/nsqio/go-nsq/nsqyaml
+
+go 1.18
+
+require (
+	github.com/nsqio/go-nsq v1.0.9-0.20261016032858-b8a8ea33c256
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/kr/text v0.2.0 // indirect
+)
+
+replace github.com/nsqio/go-nsq => ../
@@ -0,0 +1,55 @@
+package nsqyaml
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestUnmarshal(t *testing.T) {
+	c := nsq.NewConfig()
+	err := Unmarshal([]byte(`
+max_in_flight: 200
+read_timeout: 45s
+write_timeout: 500
+lookupd_poll_jitter: 0.5
+tls_v1: true
+`), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MaxInFlight != 200 {
+		t.Errorf("max_in_flight %d != 200", c.MaxInFlight)
+	}
+	if c.ReadTimeout != 45*time.Second {
+		t.Errorf("read_timeout %s != 45s", c.ReadTimeout)
+	}
+	if c.WriteTimeout != 500*time.Millisecond {
+		t.Errorf("write_timeout %s != 500ms", c.WriteTimeout)
+	}
+	if c.LookupdPollJitter != 0.5 {
+		t.Errorf("lookupd_poll_jitter %v != 0.5", c.LookupdPollJitter)
+	}
+	if !c.TlsV1 {
+		t.Errorf("tls_v1 not enabled")
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	err := Unmarshal([]byte("not_an_option: 1\n"), nsq.NewConfig())
+	if err == nil || !strings.Contains(err.Error(), "not_an_option") {
+		t.Errorf("expected unknown option error, got %v", err)
+	}
+
+	err = Unmarshal([]byte("heartbeat_interval: 90s\n"), nsq.NewConfig())
+	if err == nil {
+		t.Errorf("expected validation error for heartbeat_interval >= read_timeout")
+	}
+
+	err = Unmarshal([]byte("- max_in_flight\n"), nsq.NewConfig())
+	if err == nil {
+		t.Errorf("expected error for a document that isn't a mapping")
+	}
+}
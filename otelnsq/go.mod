@@ -0,0 +1,21 @@
+module github.com/nsqio/go-nsq/otelnsq
+
+go 1.19
+
+require (
+	github.com/nsqio/go-nsq v1.0.9-0.20261016032858-b8a8ea33c256
+	go.opentelemetry.io/otel v1.16.0
+	go.opentelemetry.io/otel/metric v1.16.0
+	go.opentelemetry.io/otel/sdk v1.16.0
+	go.opentelemetry.io/otel/sdk/metric v0.39.0
+	go.opentelemetry.io/otel/trace v1.16.0
+)
+
+require (
+	github.com/go-logr/logr v1.2.4 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/golang/snappy v0.0.1 // indirect
+	golang.org/x/sys v0.8.0 // indirect
+)
+
+replace github.com/nsqio/go-nsq => ../
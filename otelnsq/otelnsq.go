@@ -0,0 +1,308 @@
+// Package otelnsq instruments Producers and Consumers with OpenTelemetry,
+// emitting spans and metrics that follow the messaging semantic conventions.
+//
+// Publishing through a Producer propagates the trace context to consumers in
+// the message envelope (see nsq.Producer.PublishWithHeadersContext), for example:
+//
+//	producer := otelnsq.NewProducer(w)
+//	err := producer.Publish(ctx, "events", body)
+//
+// and handling the messages with a Handler continues the trace, the Consumer
+// decoding the envelopes (see nsq.Consumer.SetEnvelopeCodec):
+//
+//	consumer.SetEnvelopeCodec(nsq.DefaultEnvelopeCodec)
+//	consumer.AddHandlerWithContext(otelnsq.NewHandler("events", "archive", handler))
+//
+// Handlers without a context are instrumented with Middleware instead.
+package otelnsq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the tracer and meter of this package
+const instrumentationName = "github.com/nsqio/go-nsq/otelnsq"
+
+// attribute keys, per the messaging semantic conventions where they apply
+const (
+	messagingSystem     = attribute.Key("messaging.system")
+	messagingOperation  = attribute.Key("messaging.operation")
+	messagingDestName   = attribute.Key("messaging.destination.name")
+	messagingMessageID  = attribute.Key("messaging.message.id")
+	messagingBodySize   = attribute.Key("messaging.message.body.size")
+	messagingBatchCount = attribute.Key("messaging.batch.message_count")
+	nsqChannel          = attribute.Key("messaging.nsq.channel")
+	nsqAttempts         = attribute.Key("messaging.nsq.message.attempts")
+	errorType           = attribute.Key("error.type")
+)
+
+// Option configures the instrumentation
+type Option func(c *config)
+
+type config struct {
+	tracerProvider trace.TracerProvider
+	meterProvider  metric.MeterProvider
+}
+
+// WithTracerProvider sets the TracerProvider spans are created with,
+// otel.GetTracerProvider() by default
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = tp
+	}
+}
+
+// WithMeterProvider sets the MeterProvider metrics are recorded with,
+// otel.GetMeterProvider() by default
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(c *config) {
+		c.meterProvider = mp
+	}
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		tracerProvider: otel.GetTracerProvider(),
+		meterProvider:  otel.GetMeterProvider(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// instruments are the metrics of an operation (publish or process)
+type instruments struct {
+	duration metric.Float64Histogram
+	messages metric.Int64Counter
+}
+
+func newInstruments(meter metric.Meter, operation string) instruments {
+	var ins instruments
+	var err error
+	ins.duration, err = meter.Float64Histogram("messaging."+operation+".duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of the "+operation+" operations"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	ins.messages, err = meter.Int64Counter("messaging."+operation+".messages",
+		metric.WithUnit("{message}"),
+		metric.WithDescription("Number of messages of the "+operation+" operations"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	return ins
+}
+
+// record records an operation on n messages which took d and failed with err
+// (if not nil), with attrs
+func (ins instruments) record(ctx context.Context, n int, d time.Duration, err error, attrs ...attribute.KeyValue) {
+	if err != nil {
+		attrs = append(attrs, errorType.String(fmt.Sprintf("%T", err)))
+	}
+	opt := metric.WithAttributes(attrs...)
+	if ins.duration != nil {
+		ins.duration.Record(ctx, d.Seconds(), opt)
+	}
+	if ins.messages != nil {
+		ins.messages.Add(ctx, int64(n), opt)
+	}
+}
+
+// endSpan ends span, recording err (if not nil)
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Producer publishes with a nsq.Producer, emitting a span and metrics for
+// each publish and propagating the trace context to consumers
+type Producer struct {
+	w           *nsq.Producer
+	tracer      trace.Tracer
+	instruments instruments
+}
+
+// NewProducer returns a Producer instrumenting w
+func NewProducer(w *nsq.Producer, opts ...Option) *Producer {
+	c := newConfig(opts)
+	return &Producer{
+		w:           w,
+		tracer:      c.tracerProvider.Tracer(instrumentationName),
+		instruments: newInstruments(c.meterProvider.Meter(instrumentationName), "publish"),
+	}
+}
+
+// Publish is like PublishWithHeaders without headers
+func (p *Producer) Publish(ctx context.Context, topic string, body []byte) error {
+	return p.PublishWithHeaders(ctx, topic, nil, body)
+}
+
+// PublishWithHeaders synchronously publishes body to topic in an envelope with
+// headers and the trace context of the publish span (see
+// nsq.Producer.PublishWithHeadersContext), returning an error if publish failed
+func (p *Producer) PublishWithHeaders(ctx context.Context, topic string, headers map[string]string, body []byte) error {
+	attrs := []attribute.KeyValue{
+		messagingSystem.String("nsq"),
+		messagingDestName.String(topic),
+		messagingOperation.String("publish"),
+	}
+	ctx, span := p.tracer.Start(ctx, topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attrs...),
+		trace.WithAttributes(messagingBodySize.Int(len(body))))
+
+	start := time.Now()
+	err := p.w.PublishWithHeadersContext(nsq.ContextWithTraceContext(ctx, toTraceContext(span.SpanContext())),
+		topic, headers, body)
+	p.instruments.record(ctx, 1, time.Since(start), err, attrs...)
+	endSpan(span, err)
+	return err
+}
+
+// MultiPublish synchronously publishes bodies to topic as a single MPUB (see
+// nsq.Producer.MultiPublishContext), returning an error if publish failed.
+//
+// The bodies are published as they are, without the trace context.
+func (p *Producer) MultiPublish(ctx context.Context, topic string, bodies [][]byte) error {
+	attrs := []attribute.KeyValue{
+		messagingSystem.String("nsq"),
+		messagingDestName.String(topic),
+		messagingOperation.String("publish"),
+	}
+	ctx, span := p.tracer.Start(ctx, topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attrs...),
+		trace.WithAttributes(messagingBatchCount.Int(len(bodies))))
+
+	start := time.Now()
+	err := p.w.MultiPublishContext(ctx, topic, bodies)
+	p.instruments.record(ctx, len(bodies), time.Since(start), err, attrs...)
+	endSpan(span, err)
+	return err
+}
+
+// handler instruments a nsq.HandlerWithContext, see NewHandler
+type handler struct {
+	h           nsq.HandlerWithContext
+	topic       string
+	tracer      trace.Tracer
+	instruments instruments
+	retries     metric.Int64Counter
+	attrs       []attribute.KeyValue
+}
+
+// NewHandler returns a nsq.HandlerWithContext emitting a span and metrics for
+// each message of topic and channel handled by h, whose context carries the
+// span. The span is a child of the one the message was published from, if
+// any (see nsq.TraceContextFromContext and nsq.Message.TraceContext).
+//
+// Messages delivered more than once are counted as retries.
+func NewHandler(topic string, channel string, h nsq.HandlerWithContext, opts ...Option) nsq.HandlerWithContext {
+	c := newConfig(opts)
+	meter := c.meterProvider.Meter(instrumentationName)
+	retries, err := meter.Int64Counter("messaging.nsq.process.retries",
+		metric.WithUnit("{message}"),
+		metric.WithDescription("Number of messages handled again after a previous attempt"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	return &handler{
+		h:           h,
+		topic:       topic,
+		tracer:      c.tracerProvider.Tracer(instrumentationName),
+		instruments: newInstruments(meter, "process"),
+		retries:     retries,
+		attrs: []attribute.KeyValue{
+			messagingSystem.String("nsq"),
+			messagingDestName.String(topic),
+			nsqChannel.String(channel),
+			messagingOperation.String("process"),
+		},
+	}
+}
+
+// Middleware is like NewHandler for the Handlers of a Consumer (see
+// nsq.Consumer.Use), whose span isn't passed to the Handler
+func Middleware(topic string, channel string, opts ...Option) nsq.MiddlewareFunc {
+	return func(next nsq.Handler) nsq.Handler {
+		h := NewHandler(topic, channel, nsq.HandlerWithContextFunc(func(ctx context.Context, m *nsq.Message) error {
+			return next.HandleMessage(m)
+		}), opts...)
+		return nsq.HandlerFunc(func(m *nsq.Message) error {
+			return h.HandleMessage(context.Background(), m)
+		})
+	}
+}
+
+func (h *handler) HandleMessage(ctx context.Context, m *nsq.Message) error {
+	tc, ok := nsq.TraceContextFromContext(ctx)
+	if !ok {
+		tc, ok = m.TraceContext()
+	}
+	if ok {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, toSpanContext(tc))
+	}
+
+	ctx, span := h.tracer.Start(ctx, h.topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(h.attrs...),
+		trace.WithAttributes(
+			messagingMessageID.String(string(m.ID[:])),
+			messagingBodySize.Int(len(m.Body)),
+			nsqAttempts.Int(int(m.Attempts)),
+		))
+
+	if m.Attempts > 1 && h.retries != nil {
+		h.retries.Add(ctx, 1, metric.WithAttributes(h.attrs...))
+	}
+
+	if sc := span.SpanContext(); sc.IsValid() {
+		// for the messages published by the handler
+		ctx = nsq.ContextWithTraceContext(ctx, toTraceContext(sc))
+	}
+
+	start := time.Now()
+	err := h.h.HandleMessage(ctx, m)
+	h.instruments.record(ctx, 1, time.Since(start), err, h.attrs...)
+	endSpan(span, err)
+	return err
+}
+
+// toTraceContext converts an OpenTelemetry span context to a nsq.TraceContext
+func toTraceContext(sc trace.SpanContext) nsq.TraceContext {
+	return nsq.TraceContext{
+		TraceID: sc.TraceID(),
+		SpanID:  sc.SpanID(),
+		Flags:   byte(sc.TraceFlags()),
+		State:   sc.TraceState().String(),
+	}
+}
+
+// toSpanContext converts a nsq.TraceContext to a remote OpenTelemetry span context
+func toSpanContext(tc nsq.TraceContext) trace.SpanContext {
+	state, err := trace.ParseTraceState(tc.State)
+	if err != nil {
+		otel.Handle(err)
+	}
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    tc.TraceID,
+		SpanID:     tc.SpanID,
+		TraceFlags: trace.TraceFlags(tc.Flags),
+		TraceState: state,
+		Remote:     true,
+	})
+}
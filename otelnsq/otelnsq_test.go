@@ -0,0 +1,107 @@
+package otelnsq
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestHandler(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	parent, err := nsq.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := nsq.NewMessage(nsq.MessageID{'o', 't', 'e', 'l'}, []byte("body"))
+	m.Attempts = 2
+	m.Headers = map[string]string{nsq.HeaderTraceparent: parent.Traceparent()}
+
+	var handled nsq.TraceContext
+	h := NewHandler("events", "archive", nsq.HandlerWithContextFunc(func(ctx context.Context, m *nsq.Message) error {
+		handled, _ = nsq.TraceContextFromContext(ctx)
+		if !trace.SpanFromContext(ctx).IsRecording() {
+			t.Errorf("no span in the handler context")
+		}
+		return errors.New("boom")
+	}), WithTracerProvider(tp), WithMeterProvider(mp))
+	if err := h.HandleMessage(context.Background(), m); err == nil {
+		t.Fatalf("expected the handler error")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "events process" || span.SpanKind() != trace.SpanKindConsumer {
+		t.Errorf("unexpected span %s (%s)", span.Name(), span.SpanKind())
+	}
+	if span.Parent().TraceID() != parent.TraceID || span.Parent().SpanID() != parent.SpanID || !span.Parent().IsRemote() {
+		t.Errorf("unexpected parent %v", span.Parent())
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("unexpected status %v", span.Status())
+	}
+	if handled.TraceID != parent.TraceID || handled.SpanID != span.SpanContext().SpanID() {
+		t.Errorf("unexpected handler trace context %+v", handled)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, dp := range data.DataPoints {
+					got[m.Name] += dp.Value
+				}
+			case metricdata.Histogram[float64]:
+				for _, dp := range data.DataPoints {
+					got[m.Name] += int64(dp.Count)
+				}
+			}
+		}
+	}
+	for _, name := range []string{"messaging.process.duration", "messaging.process.messages", "messaging.nsq.process.retries"} {
+		if got[name] != 1 {
+			t.Errorf("expected 1 for %s, got %d", name, got[name])
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	var called bool
+	h := Middleware("events", "archive", WithTracerProvider(tp))(nsq.HandlerFunc(func(m *nsq.Message) error {
+		called = true
+		return nil
+	}))
+	if err := h.HandleMessage(nsq.NewMessage(nsq.MessageID{'m'}, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := recorder.Ended()
+	if !called || len(spans) != 1 {
+		t.Fatalf("expected the handler to be called with 1 span, got %d", len(spans))
+	}
+	if spans[0].Parent().IsValid() || spans[0].Status().Code == codes.Error {
+		t.Errorf("unexpected span %v %v", spans[0].Parent(), spans[0].Status())
+	}
+}
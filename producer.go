@@ -1,9 +1,12 @@
 package nsq
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,6 +20,8 @@ type producerConn interface {
 	Connect() (*IdentifyResponse, error)
 	Close() error
 	WriteCommand(*Command) error
+	WriteCommandBuffered(*Command) error
+	FlushCommands() error
 }
 
 // Producer is a high-level type to publish to NSQ.
@@ -24,15 +29,50 @@ type producerConn interface {
 // A Producer instance is 1:1 with a destination `nsqd`
 // and will lazily connect to that instance (and re-connect)
 // when Publish commands are executed.
+//
+// A Producer is safe for concurrent use. Commands from concurrent publishers
+// are pipelined on its single connection, without waiting for the responses
+// to those sent before them (nsqd responds in order), so synchronous
+// publishes from many goroutines aren't limited to one per round trip.
 type Producer struct {
-	id     int64
-	addr   string
-	conn   producerConn
-	config Config
-
-	logger   []logger
-	logLvl   LogLevel
-	logGuard sync.RWMutex
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	pendingCount      int64
+	abandonedCount    int64
+	messagesPublished uint64
+	bytesPublished    uint64
+	publishErrors     uint64
+	publishRetries    uint64
+	latencyCounts     [len(producerLatencyBuckets) + 1]uint64
+	latencySum        int64
+
+	id         int64
+	addr       string
+	addrMtx    sync.RWMutex
+	discoverer nsqdDiscoverer
+	conn       producerConn
+	config     Config
+	limiter    atomic.Value // *rateLimiter
+	hooks      atomic.Value // *ProducerHooks
+
+	connectedOnce bool // guarded by guard
+
+	closeErrMtx sync.Mutex
+	closeErr    error // the cause of the connection being lost
+
+	spillMtx      sync.Mutex
+	spill         SpillQueue
+	spilling      bool
+	reconnectChan chan int // notifies spillLoop of a connection
+
+	watermarkMtx      sync.Mutex
+	highWatermark     int
+	highWatermarkFunc func(pending int)
+	aboveWatermark    bool // only accessed by router
+
+	logger           []logger
+	structuredLogger StructuredLogger
+	logLvl           LogLevel
+	logGuard         sync.RWMutex
 
 	responseChan chan []byte
 	errorChan    chan []byte
@@ -53,8 +93,10 @@ type Producer struct {
 // to retrieve metadata about the command after the
 // response is received.
 type ProducerTransaction struct {
-	cmd      *Command
+	cmd      *Command // nil for a flush of the buffered commands
+	buffered bool     // write cmd without flushing
 	doneChan chan *ProducerTransaction
+	start    time.Time
 	Error    error         // the error (or nil) of the publish command
 	Args     []interface{} // the slice of variadic arguments passed to PublishAsync or MultiPublishAsync
 }
@@ -65,6 +107,40 @@ func (t *ProducerTransaction) finish() {
 	}
 }
 
+// producerLatencyBuckets are the upper bounds of the publish latency histogram
+var producerLatencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// ProducerStats represents a snapshot of the publishes made by a Producer
+type ProducerStats struct {
+	MessagesPublished uint64 // messages acknowledged by nsqd
+	BytesPublished    uint64 // bytes of message bodies acknowledged by nsqd
+	Errors            uint64 // publish commands rejected by nsqd or abandoned without a response
+	Retries           uint64 // publish commands retried (see Config.PublishMaxAttempts)
+	Pending           int    // publish commands awaiting a response (see PendingTransactions)
+
+	// the distribution of the time between sending a publish command
+	// and receiving its response, and the sum of these times
+	Latency    []LatencyBucket
+	LatencySum time.Duration
+}
+
+// LatencyBucket counts the publish commands whose latency was at most UpperBound
+// (and more than the UpperBound of the previous bucket), the last bucket has no
+// upper bound and reports it as 0
+type LatencyBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
 // NewProducer returns an instance of Producer for the specified address
 //
 // The only valid way to create a Config is via NewConfig, using a struct literal will panic.
@@ -85,11 +161,14 @@ func NewProducer(addr string, config *Config) (*Producer, error) {
 		logLvl: LogLevelInfo,
 
 		transactionChan: make(chan *ProducerTransaction),
+		reconnectChan:   make(chan int, 1),
 		exitChan:        make(chan int),
 		responseChan:    make(chan []byte),
 		errorChan:       make(chan []byte),
 	}
 
+	p.limiter.Store(newRateLimiter(config))
+
 	// Set default logger for all log levels
 	l := log.New(os.Stderr, "", log.Flags())
 	for index, _ := range p.logger {
@@ -98,12 +177,29 @@ func NewProducer(addr string, config *Config) (*Producer, error) {
 	return p, nil
 }
 
+// Connect causes the Producer to connect to it's configured nsqd (if not
+// already connected), returning any error that might occur.
+//
+// Use it at startup so that a misconfigured Producer is detected immediately
+// rather than on the first Publish.
+func (w *Producer) Connect() error {
+	if atomic.LoadInt32(&w.state) == StateConnected {
+		return nil
+	}
+	return w.connect()
+}
+
 // Ping causes the Producer to connect to it's configured nsqd (if not already
 // connected) and send a `Nop` command, returning any error that might occur.
 //
 // This method can be used to verify that a newly-created Producer instance is
 // configured correctly, rather than relying on the lazy "connect on Publish"
-// behavior of a Producer.
+// behavior of a Producer, and as a readiness check thereafter.
+//
+// nsqd does not respond to `Nop`, so a successful Ping means that the connection
+// was established (including the IDENTIFY round trip) and is writable. When the
+// write fails the connection is closed, so that the next Ping (or publish)
+// reconnects.
 func (w *Producer) Ping() error {
 	if atomic.LoadInt32(&w.state) != StateConnected {
 		err := w.connect()
@@ -112,7 +208,34 @@ func (w *Producer) Ping() error {
 		}
 	}
 
-	return w.conn.WriteCommand(Nop())
+	err := w.conn.WriteCommand(Nop())
+	if err != nil {
+		w.log(LogLevelError, "(%s) sending NOP - %s", w, err)
+		w.guard.Lock()
+		w.closeWithError(err)
+		w.guard.Unlock()
+	}
+	return err
+}
+
+// ApplyConfig replaces the configuration of this Producer.
+//
+// Any option may be changed. If currently connected, the connection is closed
+// so that the next publish (or Ping) reconnects (and re-IDENTIFYs) using the
+// new configuration. Commands still awaiting a response when the connection
+// closes fail with ErrNotConnected.
+func (w *Producer) ApplyConfig(config *Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	w.guard.Lock()
+	w.config = *config
+	w.limiter.Store(newRateLimiter(config))
+	w.guard.Unlock()
+
+	w.close()
+	return nil
 }
 
 // SetLogger assigns the logger to use as well as a level
@@ -162,8 +285,68 @@ func (w *Producer) getLogLevel() LogLevel {
 	return w.logLvl
 }
 
+// Stats retrieves the current publish statistics from the Producer
+func (w *Producer) Stats() *ProducerStats {
+	stats := &ProducerStats{
+		MessagesPublished: atomic.LoadUint64(&w.messagesPublished),
+		BytesPublished:    atomic.LoadUint64(&w.bytesPublished),
+		Errors:            atomic.LoadUint64(&w.publishErrors),
+		Retries:           atomic.LoadUint64(&w.publishRetries),
+		Pending:           w.PendingTransactions(),
+		Latency:           make([]LatencyBucket, len(w.latencyCounts)),
+		LatencySum:        time.Duration(atomic.LoadInt64(&w.latencySum)),
+	}
+	for i := range w.latencyCounts {
+		if i < len(producerLatencyBuckets) {
+			stats.Latency[i].UpperBound = producerLatencyBuckets[i]
+		}
+		stats.Latency[i].Count = atomic.LoadUint64(&w.latencyCounts[i])
+	}
+	return stats
+}
+
+// PendingTransactions returns the number of commands sent to nsqd
+// that are awaiting a response
+func (w *Producer) PendingTransactions() int {
+	return int(atomic.LoadInt64(&w.pendingCount))
+}
+
+// SetHighWatermark registers f to be called whenever the number of pending
+// transactions (see PendingTransactions) rises above watermark, so that
+// applications can shed load when nsqd isn't keeping up. It is called again
+// only once the number has fallen back to (or below) watermark.
+//
+// f is called from the Producer's internal goroutine and must not block
+// (nor publish). A nil f removes the callback.
+func (w *Producer) SetHighWatermark(watermark int, f func(pending int)) {
+	w.watermarkMtx.Lock()
+	w.highWatermark = watermark
+	w.highWatermarkFunc = f
+	w.watermarkMtx.Unlock()
+}
+
+func (w *Producer) checkHighWatermark(pending int) {
+	w.watermarkMtx.Lock()
+	watermark, f := w.highWatermark, w.highWatermarkFunc
+	w.watermarkMtx.Unlock()
+	if f == nil {
+		return
+	}
+
+	if pending <= watermark {
+		w.aboveWatermark = false
+		return
+	}
+	if !w.aboveWatermark {
+		w.aboveWatermark = true
+		f(pending)
+	}
+}
+
 // String returns the address of the Producer
 func (w *Producer) String() string {
+	w.addrMtx.RLock()
+	defer w.addrMtx.RUnlock()
 	return w.addr
 }
 
@@ -183,13 +366,47 @@ func (w *Producer) Stop() {
 	w.wg.Wait()
 }
 
+// StopWithTimeout is like Stop but first waits (for at most timeout) for the
+// responses to every publish already sent to `nsqd`, including those made
+// concurrently with the wait.
+//
+// It returns the number of publishes that were abandoned, i.e. that completed
+// with ErrNotConnected because no response was received in time.
+//
+// NOTE: this blocks until completion
+func (w *Producer) StopWithTimeout(timeout time.Duration) int {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+wait:
+	for atomic.LoadInt64(&w.pendingCount) > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			w.log(LogLevelWarning, "timed out waiting for %d pending publishes",
+				atomic.LoadInt64(&w.pendingCount))
+			break wait
+		}
+	}
+
+	before := atomic.LoadInt64(&w.abandonedCount)
+	w.Stop()
+	return int(atomic.LoadInt64(&w.abandonedCount) - before)
+}
+
 // PublishAsync publishes a message body to the specified topic
 // but does not wait for the response from `nsqd`.
 //
 // When the Producer eventually receives the response from `nsqd`,
 // the supplied `doneChan` (if specified)
 // will receive a `ProducerTransaction` instance with the supplied variadic arguments
-// and the response error if present
+// and the response error if present. Transactions are delivered in the order
+// they were published.
+//
+// If PublishAsync itself returns an error the message was not sent and
+// nothing will be delivered on `doneChan`.
 func (w *Producer) PublishAsync(topic string, body []byte, doneChan chan *ProducerTransaction,
 	args ...interface{}) error {
 	return w.sendCommandAsync(Publish(topic, body), doneChan, args)
@@ -214,11 +431,19 @@ func (w *Producer) MultiPublishAsync(topic string, body [][]byte, doneChan chan
 // Publish synchronously publishes a message body to the specified topic, returning
 // an error if publish failed
 func (w *Producer) Publish(topic string, body []byte) error {
+	w.spillMtx.Lock()
+	spill := w.spill
+	w.spillMtx.Unlock()
+	if spill != nil {
+		return w.publishOrSpill(topic, body)
+	}
 	return w.sendCommand(Publish(topic, body))
 }
 
 // MultiPublish synchronously publishes a slice of message bodies to the specified topic, returning
 // an error if publish failed
+//
+// The bodies are sent as a single MPUB command, nsqd accepts or rejects them atomically.
 func (w *Producer) MultiPublish(topic string, body [][]byte) error {
 	cmd, err := MultiPublish(topic, body)
 	if err != nil {
@@ -227,10 +452,49 @@ func (w *Producer) MultiPublish(topic string, body [][]byte) error {
 	return w.sendCommand(cmd)
 }
 
+// PublishToTopics synchronously publishes a message body to each of the specified
+// topics, returning a TopicErrors for those that failed (or nil).
+//
+// The commands are sent without waiting for each response in turn, so this
+// takes about as long as a single Publish.
+func (w *Producer) PublishToTopics(topics []string, body []byte) error {
+	doneChan := make(chan *ProducerTransaction, len(topics))
+	errs := make(TopicErrors)
+	sent := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		if sent[topic] {
+			continue
+		}
+		err := w.sendCommandAsync(Publish(topic, body), doneChan, []interface{}{topic})
+		if err != nil {
+			errs[topic] = err
+			continue
+		}
+		sent[topic] = true
+	}
+
+	for range sent {
+		t := <-doneChan
+		if t.Error != nil {
+			errs[t.Args[0].(string)] = t.Error
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
 // DeferredPublish synchronously publishes a message body to the specified topic
 // where the message will queue at the channel level until the timeout expires, returning
 // an error if publish failed
+//
+// The delay has millisecond resolution and must not be negative, nor exceed
+// the nsqd --max-req-timeout (default 1h).
 func (w *Producer) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	if err := validateDeferDelay(delay); err != nil {
+		return err
+	}
 	return w.sendCommand(DeferredPublish(topic, delay, body))
 }
 
@@ -244,44 +508,201 @@ func (w *Producer) DeferredPublish(topic string, delay time.Duration, body []byt
 // and the response error if present
 func (w *Producer) DeferredPublishAsync(topic string, delay time.Duration, body []byte,
 	doneChan chan *ProducerTransaction, args ...interface{}) error {
+	if err := validateDeferDelay(delay); err != nil {
+		return err
+	}
 	return w.sendCommandAsync(DeferredPublish(topic, delay, body), doneChan, args)
 }
 
+func validateDeferDelay(delay time.Duration) error {
+	if delay < 0 {
+		return fmt.Errorf("invalid deferred publish delay %s", delay)
+	}
+	return nil
+}
+
+// PublishContext is like Publish but stops waiting for the response from
+// `nsqd` when ctx is cancelled (or its deadline passes), returning ctx.Err().
+//
+// A cancelled publish may still have been (or later be) accepted by `nsqd`.
+func (w *Producer) PublishContext(ctx context.Context, topic string, body []byte) error {
+	return w.sendCommandContext(ctx, Publish(topic, body))
+}
+
+// MultiPublishContext is like MultiPublish but stops waiting for the response
+// from `nsqd` when ctx is cancelled (or its deadline passes), returning ctx.Err().
+//
+// A cancelled publish may still have been (or later be) accepted by `nsqd`.
+func (w *Producer) MultiPublishContext(ctx context.Context, topic string, body [][]byte) error {
+	cmd, err := MultiPublish(topic, body)
+	if err != nil {
+		return err
+	}
+	return w.sendCommandContext(ctx, cmd)
+}
+
+// DeferredPublishContext is like DeferredPublish but stops waiting for the response
+// from `nsqd` when ctx is cancelled (or its deadline passes), returning ctx.Err().
+//
+// A cancelled publish may still have been (or later be) accepted by `nsqd`.
+func (w *Producer) DeferredPublishContext(ctx context.Context, topic string, delay time.Duration,
+	body []byte) error {
+	if err := validateDeferDelay(delay); err != nil {
+		return err
+	}
+	return w.sendCommandContext(ctx, DeferredPublish(topic, delay, body))
+}
+
+// PublishWithTimeout is like Publish but gives up after timeout (rather than
+// the connection's write_timeout/read_timeout), including any retries, returning
+// context.DeadlineExceeded (see PublishContext).
+//
+// Connecting to `nsqd`, when needed, is still bounded by dial_timeout.
+func (w *Producer) PublishWithTimeout(topic string, body []byte, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return w.PublishContext(ctx, topic, body)
+}
+
+// MultiPublishWithTimeout is like MultiPublish but gives up after timeout
+// (see PublishWithTimeout)
+func (w *Producer) MultiPublishWithTimeout(topic string, body [][]byte, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return w.MultiPublishContext(ctx, topic, body)
+}
+
 func (w *Producer) sendCommand(cmd *Command) error {
-	doneChan := make(chan *ProducerTransaction)
-	err := w.sendCommandAsync(cmd, doneChan, nil)
+	return w.sendCommandContext(context.Background(), cmd)
+}
+
+// sendCommandContext sends cmd and waits for the response, retrying
+// according to the publish_* options
+func (w *Producer) sendCommandContext(ctx context.Context, cmd *Command) error {
+	w.guard.Lock()
+	maxAttempts := int(w.config.PublishMaxAttempts)
+	backoff := w.config.PublishRetryBackoff
+	maxBackoff := w.config.PublishMaxRetryBackoff
+	retryable := w.config.PublishRetryable
+	w.guard.Unlock()
+	if retryable == nil {
+		retryable = isRetryablePublishError
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := w.sendCommandOnce(ctx, cmd)
+		if err == nil || attempt >= maxAttempts || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+
+		w.log(LogLevelWarning, "(%s) publish failed (attempt %d of %d), retrying in %s - %s",
+			w, attempt, maxAttempts, backoff, err)
+		atomic.AddUint64(&w.publishRetries, 1)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.exitChan:
+			return ErrStopped
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (w *Producer) sendCommandOnce(ctx context.Context, cmd *Command) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// buffered so that the router doesn't block on a caller that gave up
+	doneChan := make(chan *ProducerTransaction, 1)
+	err := w.sendCommandAsyncContext(ctx, cmd, doneChan, nil)
 	if err != nil {
-		close(doneChan)
 		return err
 	}
-	t := <-doneChan
-	return t.Error
+	select {
+	case t := <-doneChan:
+		return t.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isRetryablePublishError returns true for errors that are specific to the
+// nsqd that returned them, or to the state of the connection to it, as opposed
+// to those (like an invalid topic name) that any nsqd would return
+func isRetryablePublishError(err error) bool {
+	if err == ErrStopped || err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if e, ok := err.(ErrProtocol); ok {
+		return strings.HasPrefix(e.Reason, "E_PUB_FAILED") ||
+			strings.HasPrefix(e.Reason, "E_MPUB_FAILED") ||
+			strings.HasPrefix(e.Reason, "E_DPUB_FAILED")
+	}
+	return true
 }
 
 func (w *Producer) sendCommandAsync(cmd *Command, doneChan chan *ProducerTransaction,
 	args []interface{}) error {
+	return w.sendCommandAsyncContext(context.Background(), cmd, doneChan, args)
+}
+
+func (w *Producer) sendCommandAsyncContext(ctx context.Context, cmd *Command,
+	doneChan chan *ProducerTransaction, args []interface{}) error {
+	t := &ProducerTransaction{
+		cmd:      cmd,
+		doneChan: doneChan,
+		Args:     args,
+	}
+	return w.sendTransaction(ctx, t)
+}
+
+func (w *Producer) sendTransaction(ctx context.Context, t *ProducerTransaction) (err error) {
+	cmd := t.cmd
+
 	// keep track of how many outstanding producers we're dealing with
 	// in order to later ensure that we clean them all up...
 	atomic.AddInt32(&w.concurrentProducers, 1)
 	defer atomic.AddInt32(&w.concurrentProducers, -1)
 
-	if atomic.LoadInt32(&w.state) != StateConnected {
-		err := w.connect()
+	defer func() {
+		if err != nil {
+			w.runPublishHooks(cmd, 0, err)
+		}
+	}()
+
+	if limiter := w.limiter.Load().(*rateLimiter); limiter != nil && cmd != nil {
+		wait, err := limiter.reserve(publishSize(cmd))
 		if err != nil {
 			return err
 		}
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-w.exitChan:
+				return ErrStopped
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
 	}
 
-	t := &ProducerTransaction{
-		cmd:      cmd,
-		doneChan: doneChan,
-		Args:     args,
+	if atomic.LoadInt32(&w.state) != StateConnected {
+		err := w.connect()
+		if err != nil {
+			return err
+		}
 	}
 
 	select {
 	case w.transactionChan <- t:
 	case <-w.exitChan:
 		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
 	return nil
@@ -303,51 +724,163 @@ func (w *Producer) connect() error {
 		return ErrNotConnected
 	}
 
-	w.log(LogLevelInfo, "(%s) connecting to nsqd", w.addr)
+	// the connection gets its own copy so that ApplyConfig doesn't race with it
+	config := w.config
 
-	w.conn = NewConn(w.addr, &w.config, &producerConnDelegate{w})
-	w.conn.SetLoggerLevel(w.getLogLevel())
-	format := fmt.Sprintf("%3d (%%s)", w.id)
-	for index := range w.logger {
-		w.conn.SetLoggerForLevel(w.logger[index], LogLevel(index), format)
+	addrs := []string{w.addr}
+	if w.discoverer != nil {
+		var err error
+		addrs, err = w.discoverer.discover(&config, w.addr)
+		if err != nil {
+			w.log(LogLevelError, "error discovering nsqd - %s", err)
+			return err
+		}
 	}
 
-	_, err := w.conn.Connect()
+	// added before the connection's goroutines (which may close() and wait
+	// on it) are started
+	w.wg.Add(1)
+	var err error
+	for _, addr := range addrs {
+		err = w.connectTo(addr, &config)
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
-		w.conn.Close()
-		w.log(LogLevelError, "(%s) error connecting to nsqd - %s", w.addr, err)
+		w.wg.Done()
 		return err
 	}
 	atomic.StoreInt32(&w.state, StateConnected)
 	w.closeChan = make(chan int)
-	w.wg.Add(1)
 	go w.router()
 
+	if w.connectedOnce {
+		if hooks := w.getHooks(); hooks != nil && hooks.OnReconnect != nil {
+			hooks.OnReconnect(w.addr)
+		}
+	}
+	w.connectedOnce = true
+	select {
+	case w.reconnectChan <- 1:
+	default:
+	}
+
+	return nil
+}
+
+func (w *Producer) connectTo(addr string, config *Config) error {
+	w.addrMtx.Lock()
+	w.addr = addr
+	w.addrMtx.Unlock()
+
+	w.log(LogLevelInfo, "(%s) connecting to nsqd", addr)
+
+	conn := NewConn(addr, config, &producerConnDelegate{w})
+	conn.SetLoggerLevel(w.getLogLevel())
+	format := fmt.Sprintf("%3d (%%s)", w.id)
+	for index := range w.logger {
+		conn.SetLoggerForLevel(w.logger[index], LogLevel(index), format)
+	}
+	if l, lvl := w.getStructuredLogger(); l != nil {
+		conn.SetStructuredLogger(l, lvl, "producer", w.id)
+	}
+	w.conn = conn
+
+	_, err := w.conn.Connect()
+	if err != nil {
+		w.conn.Close()
+		w.log(LogLevelError, "(%s) error connecting to nsqd - %s", addr, err)
+		return err
+	}
 	return nil
 }
 
 func (w *Producer) close() {
+	w.closeWithError(nil)
+}
+
+// closeWithError is like close, a non-nil err being the cause of the connection
+// being lost, after which pending commands fail with ErrConnectionLost and nsqd
+// is re-dialed in the background (see Config.ReconnectBackoff)
+func (w *Producer) closeWithError(err error) {
 	if !atomic.CompareAndSwapInt32(&w.state, StateConnected, StateDisconnected) {
 		return
 	}
+	w.closeErrMtx.Lock()
+	w.closeErr = err
+	w.closeErrMtx.Unlock()
+
 	w.conn.Close()
 	go func() {
 		// we need to handle this in a goroutine so we don't
 		// block the caller from making progress
 		w.wg.Wait()
 		atomic.StoreInt32(&w.state, StateInit)
+		if err != nil {
+			w.reconnectLoop()
+		}
 	}()
 }
 
+// reconnectLoop re-dials nsqd, backing off exponentially, until it succeeds,
+// something else (re)connects or the Producer is stopped
+func (w *Producer) reconnectLoop() {
+	w.guard.Lock()
+	backoff := w.config.ReconnectBackoff
+	maxBackoff := w.config.MaxReconnectBackoff
+	w.guard.Unlock()
+	if backoff == 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-w.exitChan:
+			return
+		}
+		if atomic.LoadInt32(&w.state) != StateInit {
+			return
+		}
+		w.log(LogLevelInfo, "(%s) reconnecting to nsqd", w)
+		err := w.connect()
+		if err == nil || err == ErrStopped || err == ErrNotConnected {
+			// ErrNotConnected means something else is (re)connecting
+			return
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
 func (w *Producer) router() {
 	for {
 		select {
 		case t := <-w.transactionChan:
+			if t.cmd == nil {
+				t.Error = w.conn.FlushCommands()
+				if t.Error != nil {
+					w.log(LogLevelError, "(%s) flushing commands - %s", w.conn.String(), t.Error)
+					w.closeWithError(t.Error)
+				}
+				t.finish()
+				continue
+			}
+			t.start = time.Now()
 			w.transactions = append(w.transactions, t)
-			err := w.conn.WriteCommand(t.cmd)
+			w.checkHighWatermark(int(atomic.AddInt64(&w.pendingCount, 1)))
+			var err error
+			if t.buffered {
+				err = w.conn.WriteCommandBuffered(t.cmd)
+			} else {
+				err = w.conn.WriteCommand(t.cmd)
+			}
 			if err != nil {
 				w.log(LogLevelError, "(%s) sending command - %s", w.conn.String(), err)
-				w.close()
+				w.closeWithError(err)
 			}
 		case data := <-w.responseChan:
 			w.popTransaction(FrameTypeResponse, data)
@@ -369,18 +902,46 @@ exit:
 func (w *Producer) popTransaction(frameType int32, data []byte) {
 	t := w.transactions[0]
 	w.transactions = w.transactions[1:]
+	w.checkHighWatermark(int(atomic.AddInt64(&w.pendingCount, -1)))
 	if frameType == FrameTypeError {
 		t.Error = ErrProtocol{string(data)}
+		atomic.AddUint64(&w.publishErrors, 1)
+	} else {
+		msgs, size := publishSize(t.cmd)
+		atomic.AddUint64(&w.messagesPublished, uint64(msgs))
+		atomic.AddUint64(&w.bytesPublished, uint64(size))
 	}
+	latency := time.Since(t.start)
+	w.observeLatency(latency)
+	w.runPublishHooks(t.cmd, latency, t.Error)
 	t.finish()
 }
 
+func (w *Producer) observeLatency(d time.Duration) {
+	i := sort.Search(len(producerLatencyBuckets), func(i int) bool {
+		return d <= producerLatencyBuckets[i]
+	})
+	atomic.AddUint64(&w.latencyCounts[i], 1)
+	atomic.AddInt64(&w.latencySum, d.Nanoseconds())
+}
+
 func (w *Producer) transactionCleanup() {
+	var err error = ErrNotConnected
+	w.closeErrMtx.Lock()
+	if w.closeErr != nil {
+		err = ErrConnectionLost{Addr: w.String(), Err: w.closeErr}
+	}
+	w.closeErrMtx.Unlock()
+
 	// clean up transactions we can easily account for
 	for _, t := range w.transactions {
-		t.Error = ErrNotConnected
+		t.Error = err
+		w.runPublishHooks(t.cmd, time.Since(t.start), t.Error)
 		t.finish()
 	}
+	w.checkHighWatermark(int(atomic.AddInt64(&w.pendingCount, -int64(len(w.transactions)))))
+	atomic.AddInt64(&w.abandonedCount, int64(len(w.transactions)))
+	atomic.AddUint64(&w.publishErrors, uint64(len(w.transactions)))
 	w.transactions = w.transactions[:0]
 
 	// spin and free up any writes that might have raced
@@ -389,8 +950,13 @@ func (w *Producer) transactionCleanup() {
 	for {
 		select {
 		case t := <-w.transactionChan:
-			t.Error = ErrNotConnected
+			t.Error = err
+			w.runPublishHooks(t.cmd, 0, t.Error)
 			t.finish()
+			if t.cmd != nil {
+				atomic.AddInt64(&w.abandonedCount, 1)
+				atomic.AddUint64(&w.publishErrors, 1)
+			}
 		default:
 			// keep spinning until there are 0 concurrent producers
 			if atomic.LoadInt32(&w.concurrentProducers) == 0 {
@@ -403,6 +969,14 @@ func (w *Producer) transactionCleanup() {
 }
 
 func (w *Producer) log(lvl LogLevel, line string, args ...interface{}) {
+	if l, logLvl := w.getStructuredLogger(); l != nil {
+		if logLvl <= lvl {
+			msg, keyvals := logFields([]interface{}{"producer", w.id}, line, args)
+			l.Log(lvl, msg, keyvals...)
+		}
+		return
+	}
+
 	logger, logLvl := w.getLogger(lvl)
 
 	if logger == nil {
@@ -419,7 +993,7 @@ func (w *Producer) log(lvl LogLevel, line string, args ...interface{}) {
 func (w *Producer) onConnResponse(c *Conn, data []byte) { w.responseChan <- data }
 func (w *Producer) onConnError(c *Conn, data []byte)    { w.errorChan <- data }
 func (w *Producer) onConnHeartbeat(c *Conn)             {}
-func (w *Producer) onConnIOError(c *Conn, err error)    { w.close() }
+func (w *Producer) onConnIOError(c *Conn, err error)    { w.closeWithError(err) }
 func (w *Producer) onConnClose(c *Conn) {
 	w.guard.Lock()
 	defer w.guard.Unlock()
@@ -0,0 +1,72 @@
+package nsq
+
+import (
+	"time"
+)
+
+// PublishEvent describes the outcome of a publish command (PUB, MPUB or DPUB)
+// and is passed to the ProducerHooks
+type PublishEvent struct {
+	Topic    string
+	Messages int           // the number of messages in the command
+	Size     int           // the total size of the message bodies
+	Latency  time.Duration // the time from sending the command to its response (0 if it wasn't sent)
+	Err      error         // the error (or nil) of the command
+}
+
+// ProducerHooks are callbacks invoked by a Producer (see SetHooks), any of
+// which may be nil
+//
+// They are called synchronously from the Producer's internal goroutines and
+// must not block nor call back into the Producer.
+type ProducerHooks struct {
+	// OnPublish is called for each publish command acknowledged by nsqd
+	OnPublish func(e PublishEvent)
+	// OnError is called for each publish command that failed (including each
+	// failed attempt when retrying, see Config.PublishMaxAttempts)
+	OnError func(e PublishEvent)
+	// OnReconnect is called each time the Producer connects to nsqd after
+	// its first connection
+	OnReconnect func(addr string)
+}
+
+// SetHooks registers hooks, replacing any registered previously
+func (w *Producer) SetHooks(hooks ProducerHooks) {
+	w.hooks.Store(&hooks)
+}
+
+func (w *Producer) getHooks() *ProducerHooks {
+	hooks, _ := w.hooks.Load().(*ProducerHooks)
+	return hooks
+}
+
+// runPublishHooks calls the OnPublish or OnError hook (per err) for cmd
+func (w *Producer) runPublishHooks(cmd *Command, latency time.Duration, err error) {
+	hooks := w.getHooks()
+	if hooks == nil || cmd == nil || !isPublishCommand(cmd) {
+		return
+	}
+	f := hooks.OnPublish
+	if err != nil {
+		f = hooks.OnError
+	}
+	if f == nil {
+		return
+	}
+	msgs, size := publishSize(cmd)
+	f(PublishEvent{
+		Topic:    string(cmd.Params[0]),
+		Messages: msgs,
+		Size:     size,
+		Latency:  latency,
+		Err:      err,
+	})
+}
+
+func isPublishCommand(cmd *Command) bool {
+	switch string(cmd.Name) {
+	case "PUB", "MPUB", "DPUB":
+		return len(cmd.Params) > 0
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package nsq
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NodeSelector is used by a Producer created with NewProducerFromLookupd (and
+// by a Consumer, see Consumer.SetNodeSelector) to filter and order the nsqd
+// returned by nsqlookupd, e.g. to prefer those in the same availability zone.
+//
+// A Producer tries the returned nsqd in order until a connection succeeds.
+type NodeSelector func(nodes []*PeerInfo) []*PeerInfo
+
+type nodesResp struct {
+	Producers []*PeerInfo `json:"producers"`
+}
+
+// nsqdDiscoverer discovers the nsqd a Producer publishes to
+type nsqdDiscoverer interface {
+	// discover returns the addresses of the nsqd to try, in order, moving
+	// previous (the nsqd last connected to) to the end
+	discover(config *Config, previous string) ([]string, error)
+}
+
+// producerLookupd discovers the nsqd a Producer publishes to via nsqlookupd
+type producerLookupd struct {
+	sync.Mutex
+
+	addrs      []string
+	queryIndex int
+	selector   NodeSelector
+	rng        *rand.Rand
+	httpClient *http.Client
+}
+
+// NewProducerFromLookupd returns an instance of Producer that discovers the
+// nsqd to publish to by querying the /nodes endpoint of the specified
+// nsqlookupd.
+//
+// Each time the Producer (re)connects it queries nsqlookupd again and tries
+// the nsqd in the order returned by selector (or in random order when selector
+// is nil), so that publishing moves on from an nsqd that has failed.
+// String returns the address of the nsqd currently in use.
+func NewProducerFromLookupd(lookupdAddrs []string, config *Config, selector NodeSelector) (*Producer, error) {
+	if len(lookupdAddrs) == 0 {
+		return nil, errors.New("no nsqlookupd addresses")
+	}
+
+	w, err := NewProducer("", config)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := newLookupdHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	l := &producerLookupd{
+		selector:   selector,
+		rng:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		httpClient: httpClient,
+	}
+	for _, addr := range lookupdAddrs {
+		endpoint, err := buildNodesAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		l.addrs = append(l.addrs, endpoint)
+	}
+	w.discoverer = l
+	return w, nil
+}
+
+func buildNodesAddr(addr string) (string, error) {
+	urlString := addr
+	if !strings.Contains(urlString, "://") {
+		urlString = "http://" + addr
+	}
+
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Port() == "" {
+		return "", errors.New("missing port")
+	}
+
+	if u.Path == "/" || u.Path == "" {
+		u.Path = "/nodes"
+	}
+	return u.String(), nil
+}
+
+// discover returns the addresses of the nsqd to try, in order, moving
+// previous (the nsqd last connected to) to the end
+func (l *producerLookupd) discover(config *Config, previous string) ([]string, error) {
+	headers, err := lookupdHeaders(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var data nodesResp
+	var errs []string
+	for range l.addrs {
+		endpoint := l.nextEndpoint()
+		err := apiRequestNegotiateV1(l.httpClient, "GET", endpoint, headers, &data)
+		if err == nil {
+			errs = nil
+			break
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", redactEndpoint(endpoint), err))
+	}
+	if errs != nil {
+		return nil, fmt.Errorf("failed to query nsqlookupd - %s", strings.Join(errs, "; "))
+	}
+
+	nodes := data.Producers
+	if l.selector != nil {
+		nodes = l.selector(nodes)
+	} else {
+		l.Lock()
+		l.rng.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+		l.Unlock()
+	}
+
+	var addrs []string
+	for _, node := range nodes {
+		addrs = append(addrs, node.TCPAddress())
+	}
+	addrs = moveToEnd(filterNSQDAddrs(config, addrs), previous)
+	if len(addrs) == 0 {
+		return nil, errors.New("no nsqd found via nsqlookupd")
+	}
+	return addrs, nil
+}
+
+// moveToEnd returns addrs with any occurrence of previous moved to the end
+func moveToEnd(addrs []string, previous string) []string {
+	var ordered []string
+	var last []string
+	for _, addr := range addrs {
+		if addr == previous {
+			last = append(last, addr)
+			continue
+		}
+		ordered = append(ordered, addr)
+	}
+	return append(ordered, last...)
+}
+
+// return the next lookupd endpoint to query
+func (l *producerLookupd) nextEndpoint() string {
+	l.Lock()
+	defer l.Unlock()
+	addr := l.addrs[l.queryIndex]
+	l.queryIndex = (l.queryIndex + 1) % len(l.addrs)
+	return addr
+}
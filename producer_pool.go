@@ -0,0 +1,276 @@
+package nsq
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolStrategy determines the order in which a ProducerPool
+// tries its nsqd for each publish
+type PoolStrategy int32
+
+const (
+	// PoolRoundRobin rotates through the nsqd for successive publishes (default)
+	PoolRoundRobin PoolStrategy = iota
+	// PoolLeastPending prefers the nsqd with the fewest commands
+	// awaiting a response
+	PoolLeastPending
+	// PoolFailover always prefers the nsqd in the order they were given,
+	// i.e. the first address is the primary and the rest are standbys
+	PoolFailover
+)
+
+// ProducerPool is a high-level type to publish to a set of `nsqd`.
+//
+// It holds a Producer per address and spreads publishes across them
+// according to its PoolStrategy. When a publish fails because an `nsqd` is
+// unreachable (or cannot accept the message) it is retried on the others,
+// so that single node failures are handled transparently.
+//
+// An nsqd that fails is tried only after all the others until a health check
+// (every Config.HealthCheckInterval) or a later publish to it succeeds.
+type ProducerPool struct {
+	producers []*Producer
+	down      []int32
+	strategy  int32
+	counter   uint64
+
+	healthCheckInterval time.Duration
+
+	stopFlag int32
+	exitChan chan int
+	wg       sync.WaitGroup
+}
+
+// NewProducerPool returns an instance of ProducerPool with a Producer
+// (see NewProducer) for each of the specified addresses
+func NewProducerPool(addrs []string, config *Config) (*ProducerPool, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no nsqd addresses")
+	}
+
+	producers := make([]*Producer, 0, len(addrs))
+	for _, addr := range addrs {
+		w, err := NewProducer(addr, config)
+		if err != nil {
+			for _, w := range producers {
+				w.Stop()
+			}
+			return nil, err
+		}
+		producers = append(producers, w)
+	}
+	return newProducerPool(producers, config.HealthCheckInterval), nil
+}
+
+// NewFailoverProducer returns an instance of ProducerPool (see NewProducerPool)
+// that publishes to the first of the specified addresses, switching to the
+// next while it is unavailable and failing back once it is healthy again
+func NewFailoverProducer(addrs []string, config *Config) (*ProducerPool, error) {
+	p, err := NewProducerPool(addrs, config)
+	if err != nil {
+		return nil, err
+	}
+	p.SetStrategy(PoolFailover)
+	return p, nil
+}
+
+func newProducerPool(producers []*Producer, healthCheckInterval time.Duration) *ProducerPool {
+	p := &ProducerPool{
+		producers:           producers,
+		down:                make([]int32, len(producers)),
+		healthCheckInterval: healthCheckInterval,
+		exitChan:            make(chan int),
+	}
+	p.wg.Add(1)
+	go p.healthCheckLoop()
+	return p
+}
+
+// SetStrategy sets the PoolStrategy used for subsequent publishes
+func (p *ProducerPool) SetStrategy(strategy PoolStrategy) {
+	atomic.StoreInt32(&p.strategy, int32(strategy))
+}
+
+// Producers returns the underlying Producer for each nsqd
+func (p *ProducerPool) Producers() []*Producer {
+	producers := make([]*Producer, len(p.producers))
+	copy(producers, p.producers)
+	return producers
+}
+
+// SetLogger assigns the logger (and level) to every underlying Producer
+//
+// See Producer.SetLogger
+func (p *ProducerPool) SetLogger(l logger, lvl LogLevel) {
+	for _, w := range p.producers {
+		w.SetLogger(l, lvl)
+	}
+}
+
+// SetLoggerLevel sets the logging level of every underlying Producer
+func (p *ProducerPool) SetLoggerLevel(lvl LogLevel) {
+	for _, w := range p.producers {
+		w.SetLoggerLevel(lvl)
+	}
+}
+
+// Stop gracefully stops every underlying Producer
+func (p *ProducerPool) Stop() {
+	if !atomic.CompareAndSwapInt32(&p.stopFlag, 0, 1) {
+		return
+	}
+	close(p.exitChan)
+	p.wg.Wait()
+	for _, w := range p.producers {
+		w.Stop()
+	}
+}
+
+// Publish synchronously publishes a message body to the specified topic,
+// trying each nsqd (in the order determined by the PoolStrategy) until one
+// succeeds
+func (p *ProducerPool) Publish(topic string, body []byte) error {
+	return p.do(func(w *Producer) error {
+		return w.Publish(topic, body)
+	})
+}
+
+// MultiPublish synchronously publishes a slice of message bodies to the
+// specified topic, trying each nsqd (in the order determined by the
+// PoolStrategy) until one succeeds
+func (p *ProducerPool) MultiPublish(topic string, body [][]byte) error {
+	return p.do(func(w *Producer) error {
+		return w.MultiPublish(topic, body)
+	})
+}
+
+// DeferredPublish synchronously publishes a deferred message body to the
+// specified topic, trying each nsqd (in the order determined by the
+// PoolStrategy) until one succeeds
+func (p *ProducerPool) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	return p.do(func(w *Producer) error {
+		return w.DeferredPublish(topic, delay, body)
+	})
+}
+
+// PublishAsync publishes a message body to the specified topic via the
+// first nsqd (in the order determined by the PoolStrategy) that accepts it
+// for sending.
+//
+// Only failures to send are retried on other nsqd, the outcome delivered on
+// doneChan is that of the selected nsqd (see Producer.PublishAsync).
+func (p *ProducerPool) PublishAsync(topic string, body []byte, doneChan chan *ProducerTransaction,
+	args ...interface{}) error {
+	return p.do(func(w *Producer) error {
+		return w.PublishAsync(topic, body, doneChan, args...)
+	})
+}
+
+// MultiPublishAsync publishes a slice of message bodies to the specified topic
+// via the first nsqd (in the order determined by the PoolStrategy) that
+// accepts it for sending.
+//
+// Only failures to send are retried on other nsqd, the outcome delivered on
+// doneChan is that of the selected nsqd (see Producer.MultiPublishAsync).
+func (p *ProducerPool) MultiPublishAsync(topic string, body [][]byte, doneChan chan *ProducerTransaction,
+	args ...interface{}) error {
+	return p.do(func(w *Producer) error {
+		return w.MultiPublishAsync(topic, body, doneChan, args...)
+	})
+}
+
+func (p *ProducerPool) do(f func(w *Producer) error) error {
+	var errs []string
+	for _, i := range p.order() {
+		w := p.producers[i]
+		err := f(w)
+		if err == nil {
+			p.markUp(i)
+			return nil
+		}
+		if !isRetryablePublishError(err) {
+			return err
+		}
+		w.log(LogLevelWarning, "(%s) publish failed, trying next nsqd - %s", w.String(), err)
+		p.markDown(i)
+		errs = append(errs, fmt.Sprintf("%s: %s", w.String(), err))
+	}
+	return fmt.Errorf("failed to publish to any nsqd - %s", strings.Join(errs, "; "))
+}
+
+// order returns the indexes of the producers in the order they should be tried
+func (p *ProducerPool) order() []int {
+	n := len(p.producers)
+	strategy := PoolStrategy(atomic.LoadInt32(&p.strategy))
+
+	start := 0
+	if strategy != PoolFailover {
+		start = int((atomic.AddUint64(&p.counter, 1) - 1) % uint64(n))
+	}
+	order := make([]int, n)
+	for j := range order {
+		order[j] = (start + j) % n
+	}
+
+	// sorts are stable, so that ties keep the order above
+	if strategy == PoolLeastPending {
+		sort.SliceStable(order, func(a, b int) bool {
+			return atomic.LoadInt64(&p.producers[order[a]].pendingCount) <
+				atomic.LoadInt64(&p.producers[order[b]].pendingCount)
+		})
+	}
+	// unavailable nsqd are still tried, but last
+	sort.SliceStable(order, func(a, b int) bool {
+		return atomic.LoadInt32(&p.down[order[a]]) < atomic.LoadInt32(&p.down[order[b]])
+	})
+	return order
+}
+
+func (p *ProducerPool) markDown(i int) {
+	if atomic.CompareAndSwapInt32(&p.down[i], 0, 1) {
+		w := p.producers[i]
+		w.log(LogLevelWarning, "(%s) marked unavailable", w)
+	}
+}
+
+func (p *ProducerPool) markUp(i int) {
+	if atomic.CompareAndSwapInt32(&p.down[i], 1, 0) {
+		w := p.producers[i]
+		w.log(LogLevelInfo, "(%s) available again", w)
+	}
+}
+
+// healthCheckLoop periodically pings unavailable nsqd so that they are
+// preferred again (failback) as soon as they recover
+func (p *ProducerPool) healthCheckLoop() {
+	ticker := time.NewTicker(p.healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for i, w := range p.producers {
+				if atomic.LoadInt32(&p.down[i]) == 0 {
+					continue
+				}
+				err := w.Ping()
+				if err != nil {
+					w.log(LogLevelDebug, "(%s) health check failed - %s", w.String(), err)
+					continue
+				}
+				p.markUp(i)
+			}
+		case <-p.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	p.wg.Done()
+}
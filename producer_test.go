@@ -2,13 +2,17 @@ package nsq
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -283,17 +287,26 @@ func readMessages(topicName string, t *testing.T, msgCount int) {
 	}
 }
 
+const mockHoldCount = 8
+
 type mockProducerConn struct {
+	published  int64
+	failWrites int32
+
 	delegate ConnDelegate
 	closeCh  chan struct{}
-	pubCh    chan struct{}
+	pubCh    chan *Command
+
+	mtx      sync.Mutex
+	cmds     []*Command
+	buffered []*Command
 }
 
 func newMockProducerConn(delegate ConnDelegate) producerConn {
 	m := &mockProducerConn{
 		delegate: delegate,
 		closeCh:  make(chan struct{}),
-		pubCh:    make(chan struct{}, 4),
+		pubCh:    make(chan *Command, 64),
 	}
 	go m.router()
 	return m
@@ -319,24 +332,129 @@ func (m *mockProducerConn) Close() error {
 }
 
 func (m *mockProducerConn) WriteCommand(cmd *Command) error {
-	if bytes.Equal(cmd.Name, []byte("PUB")) {
-		m.pubCh <- struct{}{}
+	if err := m.WriteCommandBuffered(cmd); err != nil {
+		return err
+	}
+	return m.FlushCommands()
+}
+
+func (m *mockProducerConn) WriteCommandBuffered(cmd *Command) error {
+	if atomic.LoadInt32(&m.failWrites) == 1 {
+		return errors.New("broken pipe")
+	}
+	m.mtx.Lock()
+	m.buffered = append(m.buffered, cmd)
+	m.mtx.Unlock()
+	return nil
+}
+
+// FlushCommands "sends" the buffered commands
+func (m *mockProducerConn) FlushCommands() error {
+	if atomic.LoadInt32(&m.failWrites) == 1 {
+		return errors.New("broken pipe")
+	}
+	m.mtx.Lock()
+	buffered := m.buffered
+	m.buffered = nil
+	m.mtx.Unlock()
+	for _, cmd := range buffered {
+		m.send(cmd)
 	}
 	return nil
 }
 
+func (m *mockProducerConn) send(cmd *Command) {
+	switch string(cmd.Name) {
+	case "PUB", "MPUB", "DPUB":
+		atomic.AddInt64(&m.published, 1)
+		m.mtx.Lock()
+		m.cmds = append(m.cmds, cmd)
+		m.mtx.Unlock()
+		m.pubCh <- cmd
+	}
+}
+
+// router responds OK to every publish, except for those with the body
+// "mock_error" which receive E_BAD_MESSAGE, "mock_pub_failed" which receive
+// E_PUB_FAILED and "mock_hang" which never receive a response. Responses to
+// "mock_hold" are withheld until mockHoldCount of them are outstanding.
 func (m *mockProducerConn) router() {
+	var held int
 	for {
 		select {
 		case <-m.closeCh:
 			goto exit
-		case <-m.pubCh:
+		case cmd := <-m.pubCh:
+			if bytes.Equal(cmd.Body, []byte("mock_error")) {
+				m.delegate.OnError(nil, []byte("E_BAD_MESSAGE"))
+				continue
+			}
+			if bytes.Equal(cmd.Body, []byte("mock_hang")) {
+				continue
+			}
+			if bytes.Equal(cmd.Body, []byte("mock_pub_failed")) {
+				m.delegate.OnError(nil, []byte("E_PUB_FAILED"))
+				continue
+			}
+			if bytes.Equal(cmd.Body, []byte("mock_hold")) {
+				held++
+				if held < mockHoldCount {
+					continue
+				}
+				for ; held > 1; held-- {
+					m.delegate.OnResponse(nil, framedResponse(FrameTypeResponse, []byte("OK")))
+				}
+				held = 0
+			}
 			m.delegate.OnResponse(nil, framedResponse(FrameTypeResponse, []byte("OK")))
 		}
 	}
 exit:
 }
 
+// newMockProducer returns a connected Producer backed by a mockProducerConn
+func newMockProducer(t *testing.T) *Producer {
+	p, _ := NewProducer("127.0.0.1:0", NewConfig())
+	p.SetLogger(newTestLogger(t), LogLevelDebug)
+
+	p.conn = newMockProducerConn(&producerConnDelegate{p})
+	atomic.StoreInt32(&p.state, StateConnected)
+	p.closeChan = make(chan int)
+	p.wg.Add(1)
+	go p.router()
+	return p
+}
+
+func TestProducerPublishAsyncTransactions(t *testing.T) {
+	p := newMockProducer(t)
+	defer p.Stop()
+
+	doneChan := make(chan *ProducerTransaction, 10)
+	for i := 0; i < 10; i++ {
+		body := []byte("publish_test_case")
+		if i == 5 {
+			body = []byte("mock_error")
+		}
+		if err := p.PublishAsync("test", body, doneChan, i, "arg"); err != nil {
+			t.Fatalf("error %s", err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		trans := <-doneChan
+		if len(trans.Args) != 2 || trans.Args[0].(int) != i || trans.Args[1].(string) != "arg" {
+			t.Fatalf("transaction %d has unexpected args %v", i, trans.Args)
+		}
+		if i == 5 {
+			if _, ok := trans.Error.(ErrProtocol); !ok {
+				t.Fatalf("transaction %d expected ErrProtocol, got %v", i, trans.Error)
+			}
+		} else if trans.Error != nil {
+			t.Fatalf("transaction %d unexpected error %s", i, trans.Error)
+		}
+	}
+}
+
 func BenchmarkProducer(b *testing.B) {
 	b.StopTimer()
 	body := make([]byte, 512)
@@ -368,3 +486,913 @@ func BenchmarkProducer(b *testing.B) {
 	close(startCh)
 	wg.Wait()
 }
+
+func TestProducerMultiPublishMock(t *testing.T) {
+	p := newMockProducer(t)
+	defer p.Stop()
+
+	err := p.MultiPublish("test", [][]byte{[]byte("a"), []byte("b")})
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	if err := p.MultiPublish("test", nil); err == nil {
+		t.Fatal("expected error for MultiPublish without bodies")
+	}
+
+	doneChan := make(chan *ProducerTransaction, 1)
+	err = p.MultiPublishAsync("test", [][]byte{[]byte("a")}, doneChan, "batch")
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	trans := <-doneChan
+	if trans.Error != nil || trans.Args[0].(string) != "batch" {
+		t.Fatalf("unexpected transaction %+v", trans)
+	}
+}
+
+func TestProducerDeferredPublishMock(t *testing.T) {
+	p := newMockProducer(t)
+	defer p.Stop()
+
+	err := p.DeferredPublish("test", 100*time.Millisecond, []byte("deferred"))
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	if err := p.DeferredPublish("test", -time.Second, []byte("deferred")); err == nil {
+		t.Fatal("expected error for negative delay")
+	}
+	if err := p.DeferredPublishAsync("test", -time.Second, []byte("deferred"), nil); err == nil {
+		t.Fatal("expected error for negative delay")
+	}
+
+	cmd := DeferredPublish("test", 1500*time.Millisecond, []byte("deferred"))
+	if string(cmd.Params[1]) != "1500" {
+		t.Fatalf("DPUB delay %s != 1500", cmd.Params[1])
+	}
+}
+
+func TestProducerPublishWithTimeout(t *testing.T) {
+	p := newMockProducer(t)
+	defer p.Stop()
+
+	if err := p.PublishWithTimeout("test", []byte("publish_test_case"), time.Second); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if err := p.MultiPublishWithTimeout("test", [][]byte{[]byte("a")}, time.Second); err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	start := time.Now()
+	err := p.PublishWithTimeout("test", []byte("mock_hang"), 50*time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("PublishWithTimeout did not return after the timeout")
+	}
+}
+
+func TestProducerPublishContext(t *testing.T) {
+	p := newMockProducer(t)
+	defer p.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.PublishContext(ctx, "test", []byte("publish_test_case")); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if err := p.MultiPublishContext(ctx, "test", [][]byte{[]byte("a")}); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if err := p.DeferredPublishContext(ctx, "test", time.Second, []byte("a")); err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := p.PublishContext(ctx, "test", []byte("mock_hang"))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("PublishContext did not return at the deadline")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := p.PublishContext(ctx, "test", []byte("publish_test_case")); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestProducerPoolRoundRobin(t *testing.T) {
+	producers := []*Producer{newMockProducer(t), newMockProducer(t), newMockProducer(t)}
+	pool := newProducerPool(producers, time.Second)
+	defer pool.Stop()
+
+	for i := 0; i < 9; i++ {
+		if err := pool.Publish("test", []byte("publish_test_case")); err != nil {
+			t.Fatalf("error %s", err)
+		}
+	}
+
+	for i, w := range producers {
+		n := atomic.LoadInt64(&w.conn.(*mockProducerConn).published)
+		if n != 3 {
+			t.Fatalf("producer %d received %d publishes, expected 3", i, n)
+		}
+	}
+}
+
+func TestProducerPoolLeastPending(t *testing.T) {
+	producers := []*Producer{newMockProducer(t), newMockProducer(t)}
+	pool := newProducerPool(producers, time.Second)
+	pool.SetStrategy(PoolLeastPending)
+	defer pool.Stop()
+
+	// leave a transaction outstanding on the first producer
+	doneChan := make(chan *ProducerTransaction, 1)
+	if err := producers[0].PublishAsync("test", []byte("mock_hang"), doneChan); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	for atomic.LoadInt64(&producers[0].pendingCount) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := pool.Publish("test", []byte("publish_test_case")); err != nil {
+			t.Fatalf("error %s", err)
+		}
+	}
+
+	if n := atomic.LoadInt64(&producers[1].conn.(*mockProducerConn).published); n != 4 {
+		t.Fatalf("least pending producer received %d publishes, expected 4", n)
+	}
+}
+
+func TestProducerPoolFailover(t *testing.T) {
+	down, _ := NewProducer("127.0.0.1:1", NewConfig())
+	down.SetLogger(nullLogger, LogLevelInfo)
+	up := newMockProducer(t)
+	pool := newProducerPool([]*Producer{down, up}, time.Second)
+	defer pool.Stop()
+
+	for i := 0; i < 4; i++ {
+		if err := pool.Publish("test", []byte("publish_test_case")); err != nil {
+			t.Fatalf("error %s", err)
+		}
+	}
+	if n := atomic.LoadInt64(&up.conn.(*mockProducerConn).published); n != 4 {
+		t.Fatalf("available producer received %d publishes, expected 4", n)
+	}
+
+	// errors any nsqd would return are not retried
+	err := pool.Publish("test", []byte("mock_error"))
+	if _, ok := err.(ErrProtocol); !ok {
+		t.Fatalf("expected ErrProtocol, got %v", err)
+	}
+
+	pool = newProducerPool([]*Producer{down}, time.Second)
+	defer pool.Stop()
+	err = pool.Publish("test", []byte("publish_test_case"))
+	if err == nil || !strings.Contains(err.Error(), "127.0.0.1:1") {
+		t.Fatalf("expected aggregated error, got %v", err)
+	}
+}
+
+func TestProducerPoolFailback(t *testing.T) {
+	primary := newMockProducer(t)
+	standby := newMockProducer(t)
+	pool := newProducerPool([]*Producer{primary, standby}, 10*time.Millisecond)
+	pool.SetStrategy(PoolFailover)
+	defer pool.Stop()
+
+	published := func(w *Producer) int64 {
+		return atomic.LoadInt64(&w.conn.(*mockProducerConn).published)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := pool.Publish("test", []byte("publish_test_case")); err != nil {
+			t.Fatalf("error %s", err)
+		}
+	}
+	if published(primary) != 3 || published(standby) != 0 {
+		t.Fatalf("expected all publishes on primary, got %d/%d", published(primary), published(standby))
+	}
+
+	pool.markDown(0)
+	if err := pool.Publish("test", []byte("publish_test_case")); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if published(standby) != 1 {
+		t.Fatal("expected publish to fail over to standby")
+	}
+
+	// the health check finds the primary reachable again
+	for atomic.LoadInt32(&pool.down[0]) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := pool.Publish("test", []byte("publish_test_case")); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if published(primary) != 4 {
+		t.Fatal("expected publish to fail back to primary")
+	}
+}
+
+func TestNewProducerPool(t *testing.T) {
+	if _, err := NewProducerPool(nil, NewConfig()); err == nil {
+		t.Fatal("expected error for empty address list")
+	}
+
+	pool, err := NewProducerPool([]string{"127.0.0.1:4150", "127.0.0.1:5150"}, NewConfig())
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	defer pool.Stop()
+	if len(pool.Producers()) != 2 {
+		t.Fatalf("expected 2 producers, got %d", len(pool.Producers()))
+	}
+}
+
+func TestBatchingProducer(t *testing.T) {
+	w := newMockProducer(t)
+	body := []byte("publish_test_case")
+	b := newBatchingProducer(w, 3*(len(body)+4), time.Hour)
+	defer b.Stop()
+
+	doneChan := make(chan *ProducerTransaction, 3)
+	for i := 0; i < 3; i++ {
+		if err := b.PublishAsync("test", body, doneChan, i); err != nil {
+			t.Fatalf("error %s", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		trans := <-doneChan
+		if trans.Error != nil {
+			t.Fatalf("error %s", trans.Error)
+		}
+	}
+
+	if n := atomic.LoadInt64(&w.conn.(*mockProducerConn).published); n != 1 {
+		t.Fatalf("expected a single MPUB, got %d commands", n)
+	}
+}
+
+func TestBatchingProducerLinger(t *testing.T) {
+	w := newMockProducer(t)
+	b := newBatchingProducer(w, 1024*1024, 10*time.Millisecond)
+
+	if err := b.Publish("test", []byte("publish_test_case")); err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	// Stop flushes what is still buffered
+	doneChan := make(chan *ProducerTransaction, 1)
+	if err := b.PublishAsync("test", []byte("publish_test_case"), doneChan); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	b.Stop()
+	if trans := <-doneChan; trans.Error != nil {
+		t.Fatalf("error %s", trans.Error)
+	}
+
+	if n := atomic.LoadInt64(&w.conn.(*mockProducerConn).published); n != 2 {
+		t.Fatalf("expected 2 MPUB, got %d commands", n)
+	}
+	if err := b.Publish("test", []byte("publish_test_case")); err != ErrStopped {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+}
+
+func TestProducerPublishRetry(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+	w.config.PublishMaxAttempts = 3
+	w.config.PublishRetryBackoff = time.Millisecond
+	published := func() int64 {
+		return atomic.LoadInt64(&w.conn.(*mockProducerConn).published)
+	}
+
+	err := w.Publish("test", []byte("mock_pub_failed"))
+	if e, ok := err.(ErrProtocol); !ok || e.Reason != "E_PUB_FAILED" {
+		t.Fatalf("expected E_PUB_FAILED, got %v", err)
+	}
+	if published() != 3 {
+		t.Fatalf("expected 3 attempts, got %d", published())
+	}
+
+	// errors that any nsqd would return are not retried
+	err = w.Publish("test", []byte("mock_error"))
+	if _, ok := err.(ErrProtocol); !ok {
+		t.Fatalf("expected ErrProtocol, got %v", err)
+	}
+	if published() != 4 {
+		t.Fatalf("expected 1 attempt, got %d", published()-3)
+	}
+
+	w.config.PublishRetryable = func(err error) bool { return true }
+	w.Publish("test", []byte("mock_error"))
+	if published() != 7 {
+		t.Fatalf("expected 3 attempts, got %d", published()-4)
+	}
+}
+
+func TestProducerPingMock(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+
+	if err := w.Ping(); err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	atomic.StoreInt32(&w.conn.(*mockProducerConn).failWrites, 1)
+	if err := w.Ping(); err == nil {
+		t.Fatal("expected error from failed write")
+	}
+	if atomic.LoadInt32(&w.state) == StateConnected {
+		t.Fatal("expected connection to be closed after failed write")
+	}
+}
+
+func TestProducerStopWithTimeout(t *testing.T) {
+	w := newMockProducer(t)
+	doneChan := make(chan *ProducerTransaction, 4)
+	for i := 0; i < 3; i++ {
+		if err := w.PublishAsync("test", []byte("publish_test_case"), doneChan); err != nil {
+			t.Fatalf("error %s", err)
+		}
+	}
+	if abandoned := w.StopWithTimeout(time.Second); abandoned != 0 {
+		t.Fatalf("expected no abandoned publishes, got %d", abandoned)
+	}
+	for i := 0; i < 3; i++ {
+		if trans := <-doneChan; trans.Error != nil {
+			t.Fatalf("error %s", trans.Error)
+		}
+	}
+
+	w = newMockProducer(t)
+	w.PublishAsync("test", []byte("publish_test_case"), doneChan)
+	w.PublishAsync("test", []byte("mock_hang"), doneChan)
+	if abandoned := w.StopWithTimeout(50 * time.Millisecond); abandoned != 1 {
+		t.Fatalf("expected 1 abandoned publish, got %d", abandoned)
+	}
+	if trans := <-doneChan; trans.Error != nil {
+		t.Fatalf("error %s", trans.Error)
+	}
+	if trans := <-doneChan; trans.Error != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", trans.Error)
+	}
+}
+
+func TestProducerConnect(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+	if err := w.Connect(); err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	w, _ = NewProducer("127.0.0.1:1", NewConfig())
+	w.SetLogger(nullLogger, LogLevelInfo)
+	defer w.Stop()
+	if err := w.Connect(); err == nil {
+		t.Fatal("expected error connecting to unreachable nsqd")
+	}
+}
+
+func TestProducerRateLimit(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+
+	config := NewConfig()
+	config.PublishRateLimit = 2
+	config.PublishRateLimitFailFast = true
+	w.limiter.Store(newRateLimiter(config))
+	for i := 0; i < 2; i++ {
+		if err := w.Publish("test", []byte("publish_test_case")); err != nil {
+			t.Fatalf("error %s", err)
+		}
+	}
+	if err := w.Publish("test", []byte("publish_test_case")); err != ErrRateLimited {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+
+	config = NewConfig()
+	config.PublishByteRateLimit = 1000
+	w.limiter.Store(newRateLimiter(config))
+	body := make([]byte, 500)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := w.Publish("test", body); err != nil {
+			t.Fatalf("error %s", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("expected publishes over the byte rate limit to wait, took %s", elapsed)
+	}
+}
+
+func TestPublishSize(t *testing.T) {
+	cmd, _ := MultiPublish("test", [][]byte{[]byte("a"), []byte("bcd")})
+	if msgs, size := publishSize(cmd); msgs != 2 || size != 4 {
+		t.Fatalf("MPUB size %d/%d, expected 2/4", msgs, size)
+	}
+	if msgs, size := publishSize(DeferredPublish("test", time.Second, []byte("abc"))); msgs != 1 || size != 3 {
+		t.Fatalf("DPUB size %d/%d, expected 1/3", msgs, size)
+	}
+}
+
+func TestProducerStats(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+	w.config.PublishMaxAttempts = 2
+	w.config.PublishRetryBackoff = time.Millisecond
+
+	w.Publish("test", []byte("abc"))
+	w.MultiPublish("test", [][]byte{[]byte("de"), []byte("f")})
+	w.Publish("test", []byte("mock_pub_failed"))
+
+	stats := w.Stats()
+	if stats.MessagesPublished != 3 || stats.BytesPublished != 6 {
+		t.Fatalf("published %d/%d, expected 3/6", stats.MessagesPublished, stats.BytesPublished)
+	}
+	if stats.Errors != 2 || stats.Retries != 1 {
+		t.Fatalf("errors/retries %d/%d, expected 2/1", stats.Errors, stats.Retries)
+	}
+	var observed uint64
+	for _, b := range stats.Latency {
+		observed += b.Count
+	}
+	if observed != 4 {
+		t.Fatalf("latency histogram has %d observations, expected 4", observed)
+	}
+	if stats.Latency[len(stats.Latency)-1].UpperBound != 0 {
+		t.Fatal("expected last latency bucket to be unbounded")
+	}
+}
+
+type memorySpillQueue struct {
+	topics []string
+	bodies [][]byte
+}
+
+func (q *memorySpillQueue) Append(topic string, body []byte) error {
+	q.topics = append(q.topics, topic)
+	q.bodies = append(q.bodies, body)
+	return nil
+}
+
+func (q *memorySpillQueue) Front() (string, []byte, bool, error) {
+	if len(q.topics) == 0 {
+		return "", nil, false, nil
+	}
+	return q.topics[0], q.bodies[0], true, nil
+}
+
+func (q *memorySpillQueue) Pop() error {
+	q.topics = q.topics[1:]
+	q.bodies = q.bodies[1:]
+	return nil
+}
+
+func TestProducerSpill(t *testing.T) {
+	config := NewConfig()
+	config.HealthCheckInterval = time.Minute
+	w, _ := NewProducer("127.0.0.1:1", config)
+	w.SetLogger(nullLogger, LogLevelInfo)
+	defer w.Stop()
+
+	q := &memorySpillQueue{}
+	w.SetSpillQueue(q)
+	if err := w.Publish("test", []byte("spilled")); err != nil {
+		t.Fatalf("expected publish to be spilled, got %s", err)
+	}
+	if err := w.Publish("test", []byte("spilled")); err != nil {
+		t.Fatalf("expected publish to be spilled, got %s", err)
+	}
+	w.spillMtx.Lock()
+	n := len(q.topics)
+	w.spillMtx.Unlock()
+	if n != 2 {
+		t.Fatalf("expected 2 spilled publishes, got %d", n)
+	}
+}
+
+func TestProducerSpillDrain(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+	w.config.HealthCheckInterval = 10 * time.Millisecond
+
+	// left over from a previous run
+	q := &memorySpillQueue{}
+	q.Append("test", []byte("first"))
+	q.Append("test", []byte("second"))
+	w.SetSpillQueue(q)
+
+	// stored behind the left over publishes to preserve order
+	if err := w.Publish("test", []byte("third")); err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	for {
+		w.spillMtx.Lock()
+		spilling := w.spilling
+		w.spillMtx.Unlock()
+		if !spilling {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&w.conn.(*mockProducerConn).published); n != 3 {
+		t.Fatalf("expected 3 publishes, got %d", n)
+	}
+	if err := w.Publish("test", []byte("fourth")); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if len(q.topics) != 0 {
+		t.Fatalf("expected publish straight to nsqd once drained")
+	}
+}
+
+func TestProducerPublishWithDedupeID(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+
+	if err := w.PublishWithDedupeID("test", "", []byte("body")); err == nil {
+		t.Fatal("expected error for empty dedupe ID")
+	}
+	if err := w.PublishWithDedupeID("test", NewDedupeID(), []byte("body")); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if NewDedupeID() == NewDedupeID() {
+		t.Fatal("expected unique dedupe IDs")
+	}
+}
+
+// publishedBodies returns the message bodies of the publishes sent to a mock Producer
+func publishedBodies(w *Producer) []string {
+	m := w.conn.(*mockProducerConn)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var bodies []string
+	for _, cmd := range m.cmds {
+		if string(cmd.Name) != "MPUB" {
+			bodies = append(bodies, string(cmd.Body))
+			continue
+		}
+		b := cmd.Body[4:]
+		for len(b) > 0 {
+			l := binary.BigEndian.Uint32(b)
+			bodies = append(bodies, string(b[4:4+l]))
+			b = b[4+l:]
+		}
+	}
+	return bodies
+}
+
+func TestProducerWriter(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+
+	wr := w.Writer("test")
+	fmt.Fprintf(wr, "one\ntwo")
+	wr.Write([]byte("three"))
+	wr.Close()
+	if _, err := wr.Write([]byte("four")); err == nil {
+		t.Fatal("expected error writing to closed writer")
+	}
+
+	got := strings.Join(publishedBodies(w), "|")
+	if got != "one\ntwo|three" {
+		t.Fatalf("unexpected publishes %q", got)
+	}
+}
+
+func TestProducerLineWriter(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+
+	wr := w.LineWriter("test")
+	wr.Write([]byte("one\ntw"))
+	wr.Write([]byte("o\n\nthree\nfo"))
+	if n := atomic.LoadInt64(&w.conn.(*mockProducerConn).published); n != 2 {
+		t.Fatalf("expected 2 publish commands, got %d", n)
+	}
+	wr.Close()
+
+	got := strings.Join(publishedBodies(w), "|")
+	if got != "one|two|three|fo" {
+		t.Fatalf("unexpected publishes %q", got)
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+
+	type event struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	if _, err := NewPublisher[event](w, "invalid topic", nil); err == nil {
+		t.Fatal("expected error for invalid topic")
+	}
+
+	pub, err := NewPublisher[event](w, "test", nil)
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	ctx := context.Background()
+	if err := pub.Publish(ctx, event{"a", 1}); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if err := pub.MultiPublish(ctx, []event{{"b", 2}, {"c", 3}}); err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	got := strings.Join(publishedBodies(w), "|")
+	if got != `{"name":"a","count":1}|{"name":"b","count":2}|{"name":"c","count":3}` {
+		t.Fatalf("unexpected publishes %s", got)
+	}
+
+	failing, _ := NewPublisher[int](w, "test", func(v int) ([]byte, error) {
+		return nil, errors.New("marshal failed")
+	})
+	if err := failing.Publish(ctx, 1); err == nil || err.Error() != "marshal failed" {
+		t.Fatalf("expected marshal error, got %v", err)
+	}
+}
+
+func TestProducerPublishJSON(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+
+	if err := w.PublishJSON("test", map[string]int{"a": 1}); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if err := w.PublishJSON("test", make(chan int)); err == nil {
+		t.Fatal("expected marshal error")
+	}
+
+	bodies := publishedBodies(w)
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 publish, got %d", len(bodies))
+	}
+	env, err := DecodeEnvelope([]byte(bodies[0]))
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if env.ContentType() != ContentTypeJSON || string(env.Body) != `{"a":1}` {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+}
+
+func TestProducerPublishWithHeaders(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+
+	headers := map[string]string{
+		HeaderContentType:   "text/plain",
+		HeaderSchemaVersion: "2",
+		"x-team":            "payments",
+	}
+	if err := w.PublishWithHeaders("test", headers, []byte("body")); err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	bodies := publishedBodies(w)
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 publish, got %d", len(bodies))
+	}
+	msg := NewMessage(MessageID{}, []byte(bodies[0]))
+	env, err := msg.Envelope()
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if string(env.Body) != "body" || env.ContentType() != "text/plain" ||
+		env.SchemaVersion() != "2" || env.Headers["x-team"] != "payments" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+
+	if _, err := NewMessage(MessageID{}, []byte("plain")).Envelope(); err != ErrNotEnveloped {
+		t.Fatalf("expected ErrNotEnveloped, got %v", err)
+	}
+}
+
+func TestProducerPublishToTopics(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+
+	if err := w.PublishToTopics([]string{"a", "b", "a"}, []byte("publish_test_case")); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if n := atomic.LoadInt64(&w.conn.(*mockProducerConn).published); n != 2 {
+		t.Fatalf("expected 2 publishes, got %d", n)
+	}
+
+	err := w.PublishToTopics([]string{"a", "b"}, []byte("mock_error"))
+	errs, ok := err.(TopicErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expected TopicErrors for both topics, got %v", err)
+	}
+	if _, ok := errs["b"].(ErrProtocol); !ok {
+		t.Fatalf("expected ErrProtocol for topic b, got %v", errs["b"])
+	}
+	if !strings.HasPrefix(err.Error(), "failed to publish to 2 topics - a: E_BAD_MESSAGE") {
+		t.Fatalf("unexpected error string %q", err)
+	}
+}
+
+func TestProducerHighWatermark(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+
+	calls := make(chan int, 10)
+	w.SetHighWatermark(2, func(pending int) {
+		calls <- pending
+	})
+
+	doneChan := make(chan *ProducerTransaction, 10)
+	for i := 0; i < 4; i++ {
+		w.PublishAsync("test", []byte("mock_hang"), doneChan)
+	}
+	for w.PendingTransactions() != 4 {
+		time.Sleep(time.Millisecond)
+	}
+	if pending := <-calls; pending != 3 {
+		t.Fatalf("expected callback at 3 pending, got %d", pending)
+	}
+	select {
+	case pending := <-calls:
+		t.Fatalf("unexpected callback at %d pending", pending)
+	default:
+	}
+	if stats := w.Stats(); stats.Pending != 4 {
+		t.Fatalf("expected 4 pending in stats, got %d", stats.Pending)
+	}
+}
+
+func TestProducerHooks(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+
+	var mtx sync.Mutex
+	var published, failed []PublishEvent
+	w.SetHooks(ProducerHooks{
+		OnPublish: func(e PublishEvent) {
+			mtx.Lock()
+			published = append(published, e)
+			mtx.Unlock()
+		},
+		OnError: func(e PublishEvent) {
+			mtx.Lock()
+			failed = append(failed, e)
+			mtx.Unlock()
+		},
+	})
+
+	if err := w.Publish("test", []byte("hello")); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := w.MultiPublish("multi", [][]byte{[]byte("a"), []byte("bc")}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := w.Publish("test", []byte("mock_error")); err == nil {
+		t.Fatal("expected error")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(published) != 2 {
+		t.Fatalf("expected 2 OnPublish calls, got %d", len(published))
+	}
+	if e := published[0]; e.Topic != "test" || e.Messages != 1 || e.Size != 5 || e.Latency <= 0 || e.Err != nil {
+		t.Fatalf("unexpected publish event %+v", e)
+	}
+	if e := published[1]; e.Topic != "multi" || e.Messages != 2 || e.Size != 3 {
+		t.Fatalf("unexpected multi publish event %+v", e)
+	}
+	if len(failed) != 1 {
+		t.Fatalf("expected 1 OnError call, got %d", len(failed))
+	}
+	if e := failed[0]; e.Topic != "test" || e.Size != 10 || e.Err == nil {
+		t.Fatalf("unexpected error event %+v", e)
+	}
+}
+
+func TestProducerPipelining(t *testing.T) {
+	w := newMockProducer(t)
+	defer w.Stop()
+
+	// the mock only responds once mockHoldCount publishes are outstanding,
+	// so this would deadlock if synchronous publishes were serialized
+	var wg sync.WaitGroup
+	errChan := make(chan error, mockHoldCount)
+	for i := 0; i < mockHoldCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errChan <- w.Publish("test", []byte("mock_hold"))
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("publishes were not pipelined (%d pending)", w.PendingTransactions())
+	}
+	close(errChan)
+	for err := range errChan {
+		if err != nil {
+			t.Fatalf("error %s", err)
+		}
+	}
+}
+
+func TestProducerConnectionLost(t *testing.T) {
+	w := newMockProducer(t)
+	w.config.ReconnectBackoff = 0
+	defer w.Stop()
+
+	doneChan := make(chan *ProducerTransaction, 1)
+	w.PublishAsync("test", []byte("mock_hang"), doneChan)
+	for w.PendingTransactions() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cause := errors.New("i/o timeout")
+	w.onConnIOError(nil, cause)
+	w.onConnClose(nil)
+
+	trans := <-doneChan
+	if !errors.Is(trans.Error, ErrNotConnected) || !errors.Is(trans.Error, cause) {
+		t.Fatalf("unexpected error %v", trans.Error)
+	}
+	if e, ok := trans.Error.(ErrConnectionLost); !ok || e.Addr != "127.0.0.1:0" {
+		t.Fatalf("expected ErrConnectionLost, got %#v", trans.Error)
+	}
+}
+
+func TestBufferedProducer(t *testing.T) {
+	w := newMockProducer(t)
+	w.config.OutputBufferTimeout = 0
+	b := newBufferedProducer(w)
+
+	for _, body := range []string{"a", "mock_error", "b"} {
+		if err := b.Publish("test", []byte(body)); err != nil {
+			t.Fatalf("error %s", err)
+		}
+	}
+	if err := b.MultiPublish("test", [][]byte{[]byte("c"), []byte("d")}); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	// nothing is sent until flushed
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt64(&w.conn.(*mockProducerConn).published); n != 0 {
+		t.Fatalf("expected no publishes before Flush, got %d", n)
+	}
+
+	errs := b.Flush()
+	if len(errs) != 4 || errs[0] != nil || errs[1] == nil || errs[2] != nil || errs[3] != nil {
+		t.Fatalf("unexpected results %v", errs)
+	}
+	if bodies := strings.Join(publishedBodies(w), ","); bodies != "a,mock_error,b,c,d" {
+		t.Fatalf("unexpected publishes %s", bodies)
+	}
+	if errs := b.Flush(); errs != nil {
+		t.Fatalf("expected no results, got %v", errs)
+	}
+
+	b.Publish("test", []byte("e"))
+	if errs := b.Stop(); len(errs) != 1 || errs[0] != nil {
+		t.Fatalf("unexpected results %v", errs)
+	}
+	if err := b.Publish("test", []byte("f")); err != ErrStopped {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+}
+
+func TestBufferedProducerTimeout(t *testing.T) {
+	w := newMockProducer(t)
+	w.config.OutputBufferTimeout = 10 * time.Millisecond
+	b := newBufferedProducer(w)
+	defer b.Stop()
+
+	b.Publish("test", []byte("a"))
+	for atomic.LoadInt64(&w.conn.(*mockProducerConn).published) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if errs := b.Flush(); len(errs) != 1 || errs[0] != nil {
+		t.Fatalf("unexpected results %v", errs)
+	}
+}
@@ -49,6 +49,13 @@ func isValidName(name string) bool {
 //    ------------------------...
 //        size       data
 func ReadResponse(r io.Reader) ([]byte, error) {
+	return ReadResponseInto(r, nil)
+}
+
+// ReadResponseInto is like ReadResponse but reads the data into buf when its
+// capacity is large enough (allocating a new slice otherwise), so that buffers
+// can be reused. The returned data is a slice of buf in that case.
+func ReadResponseInto(r io.Reader, buf []byte) ([]byte, error) {
 	var msgSize int32
 
 	// message size
@@ -61,7 +68,11 @@ func ReadResponse(r io.Reader) ([]byte, error) {
 		return nil, fmt.Errorf("response msg size is negative: %v", msgSize)
 	}
 	// message binary data
-	buf := make([]byte, msgSize)
+	if int(msgSize) <= cap(buf) {
+		buf = buf[:msgSize]
+	} else {
+		buf = make([]byte, msgSize)
+	}
 	_, err = io.ReadFull(r, buf)
 	if err != nil {
 		return nil, err
@@ -98,3 +109,14 @@ func ReadUnpackedResponse(r io.Reader) (int32, []byte, error) {
 	}
 	return UnpackResponse(resp)
 }
+
+// ReadUnpackedResponseInto is like ReadUnpackedResponse but reads the frame
+// into buf when its capacity is large enough (see ReadResponseInto), in which
+// case the returned data is a slice of buf
+func ReadUnpackedResponseInto(r io.Reader, buf []byte) (int32, []byte, error) {
+	resp, err := ReadResponseInto(r, buf)
+	if err != nil {
+		return -1, nil, err
+	}
+	return UnpackResponse(resp)
+}
@@ -0,0 +1,36 @@
+package nsq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestReadUnpackedResponseInto(t *testing.T) {
+	var frame bytes.Buffer
+	binary.Write(&frame, binary.BigEndian, int32(4+5))
+	binary.Write(&frame, binary.BigEndian, FrameTypeResponse)
+	frame.WriteString("hello")
+	b := frame.Bytes()
+
+	buf := make([]byte, 0, 16)
+	frameType, data, err := ReadUnpackedResponseInto(bytes.NewReader(b), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frameType != FrameTypeResponse || string(data) != "hello" {
+		t.Fatalf("unexpected frame %d %q", frameType, data)
+	}
+	if &buf[:cap(buf)][4] != &data[0] {
+		t.Errorf("data was not read into buf")
+	}
+
+	small := make([]byte, 0, 4)
+	_, data, err = ReadUnpackedResponseInto(bytes.NewReader(b), small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("unexpected data %q", data)
+	}
+}
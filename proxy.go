@@ -0,0 +1,239 @@
+package nsq
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// proxiedDialer returns a Dialer that tunnels connections made through
+// forward via the proxy described by proxyURL (see Config.ProxyURL).
+//
+// When proxyURL is empty forward is returned as-is.
+func proxiedDialer(proxyURL string, forward Dialer) (Dialer, error) {
+	if proxyURL == "" {
+		return forward, nil
+	}
+	u, err := parseProxyURL(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http":
+		return &httpConnectDialer{proxy: u, forward: forward}, nil
+	}
+	return &socks5Dialer{proxy: u, forward: forward}, nil
+}
+
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	var defaultPort string
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		defaultPort = "1080"
+	case "http":
+		defaultPort = "80"
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (expected socks5 or http)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", s)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	return u, nil
+}
+
+// dialProxy connects to the proxy itself, applying any deadline from ctx
+// to the handshake that follows
+func dialProxy(ctx context.Context, forward Dialer, proxy *url.URL) (net.Conn, error) {
+	conn, err := forward.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+type socks5Dialer struct {
+	proxy   *url.URL
+	forward Dialer
+}
+
+// DialContext implements the client side of RFC 1928 (CONNECT only),
+// with optional username/password authentication (RFC 1929)
+func (d *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := dialProxy(ctx, d.forward, d.proxy)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.handshake(conn, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 proxy %s - %s", d.proxy.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	methods := []byte{0x00}
+	if d.proxy.User != nil {
+		methods = []byte{0x02, 0x00}
+	}
+	buf := append([]byte{0x05, byte(len(methods))}, methods...)
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 0x05 {
+		return fmt.Errorf("unexpected protocol version %d", resp[0])
+	}
+	switch resp[1] {
+	case 0x00:
+	case 0x02:
+		if d.proxy.User == nil {
+			return errors.New("proxy requires authentication")
+		}
+		user := d.proxy.User.Username()
+		pass, _ := d.proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("username or password too long")
+		}
+		buf = []byte{0x01, byte(len(user))}
+		buf = append(buf, user...)
+		buf = append(buf, byte(len(pass)))
+		buf = append(buf, pass...)
+		if _, err := conn.Write(buf); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	default:
+		return errors.New("no acceptable authentication methods")
+	}
+
+	buf = []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, 0x01)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, 0x04)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("hostname %q too long", host)
+		}
+		buf = append(buf, 0x03, byte(len(host)))
+		buf = append(buf, host...)
+	}
+	buf = append(buf, byte(port>>8), byte(port))
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("connect to %s failed (reply code %d)", addr, reply[1])
+	}
+
+	// discard the bound address
+	var skip int
+	switch reply[3] {
+	case 0x01:
+		skip = net.IPv4len + 2
+	case 0x04:
+		skip = net.IPv6len + 2
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0]) + 2
+	default:
+		return fmt.Errorf("unexpected address type %d", reply[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+type httpConnectDialer struct {
+	proxy   *url.URL
+	forward Dialer
+}
+
+// DialContext establishes a tunnel using an HTTP CONNECT request,
+// with basic authentication when the proxy URL contains credentials
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := dialProxy(ctx, d.forward, d.proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if d.proxy.User != nil {
+		pass, _ := d.proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(d.proxy.User.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s - %s", d.proxy.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s - CONNECT %s failed: %s", d.proxy.Host, addr, resp.Status)
+	}
+	// neither nsqd nor nsqlookupd speak first, so nothing should be buffered
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s - unexpected data after CONNECT response", d.proxy.Host)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
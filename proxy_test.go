@@ -0,0 +1,192 @@
+package nsq
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startEchoServer accepts connections and echoes a single line back
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte(line))
+			}()
+		}
+	}()
+	return l
+}
+
+func pipeConns(a net.Conn, b net.Conn) {
+	go io.Copy(a, b)
+	io.Copy(b, a)
+	a.Close()
+	b.Close()
+}
+
+// startSOCKS5Proxy serves a minimal SOCKS5 proxy requiring user/pass
+// authentication, recording the requested destination
+func startSOCKS5Proxy(t *testing.T, dests chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 262)
+				io.ReadFull(conn, buf[:2])
+				io.ReadFull(conn, buf[:buf[1]])
+				conn.Write([]byte{0x05, 0x02})
+
+				io.ReadFull(conn, buf[:2])
+				user := make([]byte, buf[1])
+				io.ReadFull(conn, user)
+				io.ReadFull(conn, buf[:1])
+				pass := make([]byte, buf[0])
+				io.ReadFull(conn, pass)
+				if string(user) != "user" || string(pass) != "pass" {
+					conn.Write([]byte{0x01, 0x01})
+					conn.Close()
+					return
+				}
+				conn.Write([]byte{0x01, 0x00})
+
+				io.ReadFull(conn, buf[:4])
+				var host string
+				switch buf[3] {
+				case 0x01:
+					io.ReadFull(conn, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 0x03:
+					io.ReadFull(conn, buf[:1])
+					b := make([]byte, buf[0])
+					io.ReadFull(conn, b)
+					host = string(b)
+				}
+				io.ReadFull(conn, buf[:2])
+				port := int(buf[0])<<8 | int(buf[1])
+				dest := net.JoinHostPort(host, strconv.Itoa(port))
+				dests <- dest
+
+				upstream, err := net.Dial("tcp", dest)
+				if err != nil {
+					conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+					conn.Close()
+					return
+				}
+				conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+				pipeConns(conn, upstream)
+			}()
+		}
+	}()
+	return l
+}
+
+// startHTTPConnectProxy serves a minimal HTTP CONNECT proxy,
+// recording the requested destination
+func startHTTPConnectProxy(t *testing.T, dests chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != "CONNECT" {
+					conn.Close()
+					return
+				}
+				dests <- req.Host
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					conn.Close()
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				pipeConns(conn, upstream)
+			}()
+		}
+	}()
+	return l
+}
+
+func testProxyRoundTrip(t *testing.T, proxyURL string, target string, dests chan string) {
+	dialer, err := proxiedDialer(proxyURL, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if dest := <-dests; dest != target {
+		t.Fatalf("proxy connected to %s, expected %s", dest, target)
+	}
+
+	conn.Write([]byte("hello\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Fatalf("got %q through proxy", line)
+	}
+}
+
+func TestProxySOCKS5(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	dests := make(chan string, 1)
+	proxy := startSOCKS5Proxy(t, dests)
+	defer proxy.Close()
+
+	testProxyRoundTrip(t, "socks5://user:pass@"+proxy.Addr().String(), echo.Addr().String(), dests)
+
+	dialer, _ := proxiedDialer("socks5://user:wrong@"+proxy.Addr().String(), &net.Dialer{})
+	_, err := dialer.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err == nil {
+		t.Fatal("expected authentication failure")
+	}
+}
+
+func TestProxyHTTPConnect(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	dests := make(chan string, 1)
+	proxy := startHTTPConnectProxy(t, dests)
+	defer proxy.Close()
+
+	testProxyRoundTrip(t, "http://"+proxy.Addr().String(), echo.Addr().String(), dests)
+}
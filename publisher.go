@@ -0,0 +1,72 @@
+package nsq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Publisher is a typed publisher bound to a topic, marshaling values of type T
+// to message bodies before publishing them with a Producer
+type Publisher[T any] struct {
+	producer *Producer
+	topic    string
+	marshal  func(v T) ([]byte, error)
+}
+
+// NewPublisher returns a Publisher that publishes values of type T to topic
+// via producer, encoding them with marshal (json.Marshal when nil)
+func NewPublisher[T any](producer *Producer, topic string, marshal func(v T) ([]byte, error)) (*Publisher[T], error) {
+	if !IsValidTopicName(topic) {
+		return nil, errors.New("invalid topic name")
+	}
+	if marshal == nil {
+		marshal = func(v T) ([]byte, error) {
+			return json.Marshal(v)
+		}
+	}
+	return &Publisher[T]{
+		producer: producer,
+		topic:    topic,
+		marshal:  marshal,
+	}, nil
+}
+
+// Topic returns the topic the Publisher publishes to
+func (p *Publisher[T]) Topic() string {
+	return p.topic
+}
+
+// Publish marshals v and synchronously publishes it (see Producer.PublishContext)
+func (p *Publisher[T]) Publish(ctx context.Context, v T) error {
+	body, err := p.marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.producer.PublishContext(ctx, p.topic, body)
+}
+
+// MultiPublish marshals vs and synchronously publishes them as a single MPUB
+// (see Producer.MultiPublishContext)
+func (p *Publisher[T]) MultiPublish(ctx context.Context, vs []T) error {
+	bodies := make([][]byte, 0, len(vs))
+	for _, v := range vs {
+		body, err := p.marshal(v)
+		if err != nil {
+			return err
+		}
+		bodies = append(bodies, body)
+	}
+	return p.producer.MultiPublishContext(ctx, p.topic, bodies)
+}
+
+// DeferredPublish marshals v and synchronously publishes it for delivery after
+// delay (see Producer.DeferredPublishContext)
+func (p *Publisher[T]) DeferredPublish(ctx context.Context, delay time.Duration, v T) error {
+	body, err := p.marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.producer.DeferredPublishContext(ctx, p.topic, delay, body)
+}
@@ -0,0 +1,125 @@
+package nsq
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// tokenBucket holds up to one second's worth of tokens, refilled at rate per second
+//
+// tokens may go negative, representing a debt that has to be waited out
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: rate,
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// available returns true if n tokens can be taken now, a full bucket
+// always allows taking (so that n larger than the burst isn't starved)
+func (b *tokenBucket) available(n float64) bool {
+	return b.tokens >= n || b.tokens >= b.rate
+}
+
+// take removes n tokens, returning how long to wait until the debt
+// (if any) has been repaid
+func (b *tokenBucket) take(n float64) time.Duration {
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter limits the messages and bytes per second published by a Producer
+// (see Config.PublishRateLimit and Config.PublishByteRateLimit)
+type rateLimiter struct {
+	sync.Mutex
+
+	msgs     *tokenBucket
+	bytes    *tokenBucket
+	failFast bool
+}
+
+// newRateLimiter returns nil when config sets no limits
+func newRateLimiter(config *Config) *rateLimiter {
+	if config.PublishRateLimit == 0 && config.PublishByteRateLimit == 0 {
+		return nil
+	}
+	now := time.Now()
+	l := &rateLimiter{failFast: config.PublishRateLimitFailFast}
+	if config.PublishRateLimit > 0 {
+		l.msgs = newTokenBucket(config.PublishRateLimit, now)
+	}
+	if config.PublishByteRateLimit > 0 {
+		l.bytes = newTokenBucket(config.PublishByteRateLimit, now)
+	}
+	return l
+}
+
+// reserve accounts for publishing msgs messages totalling size bytes,
+// returning how long to wait before doing so or, in fail-fast mode,
+// ErrRateLimited when they can't be published immediately
+func (l *rateLimiter) reserve(msgs int, size int) (time.Duration, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if l.msgs != nil {
+		l.msgs.refill(now)
+	}
+	if l.bytes != nil {
+		l.bytes.refill(now)
+	}
+
+	if l.failFast {
+		if (l.msgs != nil && !l.msgs.available(float64(msgs))) ||
+			(l.bytes != nil && !l.bytes.available(float64(size))) {
+			return 0, ErrRateLimited
+		}
+	}
+
+	var wait time.Duration
+	if l.msgs != nil {
+		wait = l.msgs.take(float64(msgs))
+	}
+	if l.bytes != nil {
+		if d := l.bytes.take(float64(size)); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// publishSize returns the number of messages and bytes of message bodies
+// published by cmd
+func publishSize(cmd *Command) (int, int) {
+	switch string(cmd.Name) {
+	case "MPUB":
+		if len(cmd.Body) < 4 {
+			return 0, 0
+		}
+		n := int(binary.BigEndian.Uint32(cmd.Body[:4]))
+		// each body is preceded by its 4 byte size
+		return n, len(cmd.Body) - 4 - 4*n
+	case "PUB", "DPUB":
+		return 1, len(cmd.Body)
+	}
+	return 0, 0
+}
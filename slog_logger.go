@@ -0,0 +1,34 @@
+//go:build go1.21
+
+package nsq
+
+import (
+	"context"
+	"log/slog"
+)
+
+// NewSlogLogger returns a StructuredLogger logging with l (see
+// SetStructuredLogger), LogLevelWarning being slog.LevelWarn and so on
+func NewSlogLogger(l *slog.Logger) StructuredLogger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) Log(lvl LogLevel, msg string, keyvals ...interface{}) {
+	s.l.Log(context.Background(), slogLevel(lvl), msg, keyvals...)
+}
+
+func slogLevel(lvl LogLevel) slog.Level {
+	switch lvl {
+	case LogLevelDebug:
+		return slog.LevelDebug
+	case LogLevelInfo:
+		return slog.LevelInfo
+	case LogLevelWarning:
+		return slog.LevelWarn
+	}
+	return slog.LevelError
+}
@@ -0,0 +1,49 @@
+//go:build go1.21
+
+package nsq
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	q, _ := NewConsumer("test_slog", "ch", NewConfig())
+	q.SetStructuredLogger(l, LogLevelInfo)
+	var id MessageID
+	copy(id[:], "0123456789abcdef")
+	q.log(LogLevelDebug, "not logged")
+	q.log(LogLevelWarning, "(%s) failed to decode envelope of msg %s - %s",
+		"127.0.0.1:4150", id, "boom")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a single JSON line, got %q - %s", buf.Bytes(), err)
+	}
+	expected := map[string]interface{}{
+		"level":   "WARN",
+		"topic":   "test_slog",
+		"channel": "ch",
+		"addr":    "127.0.0.1:4150",
+		"msg_id":  "0123456789abcdef",
+	}
+	for k, v := range expected {
+		if line[k] != v {
+			t.Errorf("expected %s %q, got %q", k, v, line[k])
+		}
+	}
+	if line["msg"] != "failed to decode envelope of msg 0123456789abcdef - boom" {
+		t.Errorf("unexpected msg %q", line["msg"])
+	}
+	if _, ok := line["consumer"]; !ok {
+		t.Errorf("missing consumer field")
+	}
+}
+
+// a *slog.Logger is also a LeveledLogger
+var _ LeveledLogger = (*slog.Logger)(nil)
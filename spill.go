@@ -0,0 +1,482 @@
+package nsq
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpillQueue stores, in order, publishes that could not be sent to nsqd
+// (see Producer.SetSpillQueue)
+//
+// Calls are serialized by the Producer.
+type SpillQueue interface {
+	// Append stores a publish at the back of the queue
+	Append(topic string, body []byte) error
+	// Front returns the publish at the front of the queue,
+	// ok is false when the queue is empty
+	Front() (topic string, body []byte, ok bool, err error)
+	// Pop removes the publish at the front of the queue
+	Pop() error
+}
+
+// DiskSpillQueue is a SpillQueue backed by an append-only file, with the
+// position of the front of the queue kept in a second file (suffixed ".offset").
+//
+// Each Append is synced to disk before returning, and the files are truncated
+// whenever the queue has been emptied.
+type DiskSpillQueue struct {
+	path   string
+	file   *os.File
+	size   int64
+	offset int64
+}
+
+// NewDiskSpillQueue opens (or creates) the DiskSpillQueue stored at path,
+// resuming from where it was left
+func NewDiskSpillQueue(path string) (*DiskSpillQueue, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	q := &DiskSpillQueue{
+		path: path,
+		file: f,
+		size: fi.Size(),
+	}
+
+	data, err := ioutil.ReadFile(q.offsetPath())
+	if err != nil && !os.IsNotExist(err) {
+		f.Close()
+		return nil, err
+	}
+	if len(data) > 0 {
+		q.offset, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil || q.offset < 0 {
+			f.Close()
+			return nil, fmt.Errorf("invalid spill queue offset %q", data)
+		}
+	}
+	if q.offset > q.size {
+		// a Pop emptying the queue was interrupted after truncating the file
+		q.offset = 0
+		if err := q.writeOffset(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := q.truncatePartial(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// truncatePartial truncates the file after the last complete publish, removing
+// what an Append interrupted by a crash left of its publish
+func (q *DiskSpillQueue) truncatePartial() error {
+	offset := q.offset
+	for offset < q.size {
+		end, err := q.skipField(offset)
+		if err == nil {
+			end, err = q.skipField(end)
+		}
+		if err != nil {
+			break
+		}
+		offset = end
+	}
+	if offset == q.size {
+		return nil
+	}
+	if err := q.file.Truncate(offset); err != nil {
+		return err
+	}
+	q.size = offset
+	return nil
+}
+
+// skipField returns the offset following the field at offset
+func (q *DiskSpillQueue) skipField(offset int64) (int64, error) {
+	if offset+4 > q.size {
+		return 0, io.ErrUnexpectedEOF
+	}
+	var l [4]byte
+	if _, err := q.file.ReadAt(l[:], offset); err != nil {
+		return 0, err
+	}
+	end := offset + 4 + int64(binary.BigEndian.Uint32(l[:]))
+	if end > q.size {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return end, nil
+}
+
+func (q *DiskSpillQueue) offsetPath() string {
+	return q.path + ".offset"
+}
+
+// Append stores a publish at the back of the queue
+func (q *DiskSpillQueue) Append(topic string, body []byte) error {
+	buf := make([]byte, 8+len(topic)+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(topic)))
+	copy(buf[4:], topic)
+	binary.BigEndian.PutUint32(buf[4+len(topic):], uint32(len(body)))
+	copy(buf[8+len(topic):], body)
+
+	n, err := q.file.WriteAt(buf, q.size)
+	if err == nil {
+		err = q.file.Sync()
+	}
+	if err != nil {
+		// don't leave part of the publish behind
+		q.file.Truncate(q.size)
+		return err
+	}
+	q.size += int64(n)
+	return nil
+}
+
+// Front returns the publish at the front of the queue
+//
+// When it can't be read, the error reports the number of bytes left in the
+// queue, which Pop discards.
+func (q *DiskSpillQueue) Front() (string, []byte, bool, error) {
+	if q.offset >= q.size {
+		return "", nil, false, nil
+	}
+	topic, err := q.readField(q.offset)
+	if err == nil {
+		var body []byte
+		body, err = q.readField(q.offset + 4 + int64(len(topic)))
+		if err == nil {
+			return string(topic), body, true, nil
+		}
+	}
+	return "", nil, false, fmt.Errorf("corrupt spill queue, %d bytes unreadable at offset %d - %s",
+		q.size-q.offset, q.offset, err)
+}
+
+func (q *DiskSpillQueue) readField(offset int64) ([]byte, error) {
+	end, err := q.skipField(offset)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, end-offset-4)
+	if _, err := q.file.ReadAt(b, offset+4); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Pop removes the publish at the front of the queue.
+//
+// When the front can't be read (see Front), the rest of the queue is discarded,
+// as the publishes following it can't be located.
+func (q *DiskSpillQueue) Pop() error {
+	var offset int64
+	topic, body, ok, err := q.Front()
+	switch {
+	case err != nil:
+		offset = q.size
+	case !ok:
+		return errors.New("spill queue is empty")
+	default:
+		offset = q.offset + 8 + int64(len(topic)) + int64(len(body))
+	}
+	if offset < q.size {
+		if err := q.writeOffset(offset); err != nil {
+			return err
+		}
+		q.offset = offset
+		return nil
+	}
+
+	// the queue is empty, the offset is reset before truncating the file so
+	// that a crash in between can't leave it past the end
+	if err := q.writeOffset(0); err != nil {
+		return err
+	}
+	q.offset = 0
+	if err := q.file.Truncate(0); err != nil {
+		return err
+	}
+	q.size = 0
+	return nil
+}
+
+// writeOffset durably replaces the offset file with offset
+func (q *DiskSpillQueue) writeOffset(offset int64) error {
+	tmp := q.offsetPath() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strconv.FormatInt(offset, 10))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.offsetPath())
+}
+
+// Close closes the underlying file
+func (q *DiskSpillQueue) Close() error {
+	return q.file.Close()
+}
+
+// OverflowPolicy determines what a MemorySpillQueue does with a publish when full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes Publish wait until there is space (or the Producer is stopped)
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest publish in the queue, other than
+	// one that is being published (returned by Front but not yet popped)
+	OverflowDropOldest
+	// OverflowError makes Publish return ErrSpillQueueFull
+	OverflowError
+)
+
+// ErrSpillQueueFull is returned by a MemorySpillQueue that is full
+// (see OverflowError)
+var ErrSpillQueueFull = errors.New("spill queue full")
+
+// MemorySpillQueue is a SpillQueue kept in memory, holding up to a fixed
+// number of publishes, for buffering while nsqd is unreachable without
+// the durability (nor the cost) of a DiskSpillQueue
+type MemorySpillQueue struct {
+	capacity int
+	policy   OverflowPolicy
+
+	mtx        sync.Mutex
+	topics     []string
+	bodies     [][]byte
+	frontTaken bool // the front was returned by Front since the last Pop
+	dropped    uint64
+	space      chan struct{} // closed (and replaced) on Pop
+}
+
+// NewMemorySpillQueue returns a MemorySpillQueue holding up to capacity
+// publishes, handling any more according to policy
+func NewMemorySpillQueue(capacity int, policy OverflowPolicy) *MemorySpillQueue {
+	return &MemorySpillQueue{
+		capacity: capacity,
+		policy:   policy,
+		space:    make(chan struct{}),
+	}
+}
+
+// Append stores a publish at the back of the queue
+func (q *MemorySpillQueue) Append(topic string, body []byte) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.topics) >= q.capacity {
+		i := 0
+		if q.frontTaken {
+			i = 1
+		}
+		if q.policy != OverflowDropOldest || i >= len(q.topics) {
+			return ErrSpillQueueFull
+		}
+		q.topics = append(q.topics[:i], q.topics[i+1:]...)
+		q.bodies = append(q.bodies[:i], q.bodies[i+1:]...)
+		q.dropped++
+	}
+	q.topics = append(q.topics, topic)
+	q.bodies = append(q.bodies, body)
+	return nil
+}
+
+// Front returns the publish at the front of the queue
+func (q *MemorySpillQueue) Front() (string, []byte, bool, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.topics) == 0 {
+		return "", nil, false, nil
+	}
+	q.frontTaken = true
+	return q.topics[0], q.bodies[0], true, nil
+}
+
+// Pop removes the publish at the front of the queue
+func (q *MemorySpillQueue) Pop() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.topics) == 0 {
+		return errors.New("spill queue is empty")
+	}
+	q.topics[0], q.bodies[0] = "", nil
+	q.topics = q.topics[1:]
+	q.bodies = q.bodies[1:]
+	q.frontTaken = false
+	close(q.space)
+	q.space = make(chan struct{})
+	return nil
+}
+
+// Len returns the number of publishes in the queue
+func (q *MemorySpillQueue) Len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return len(q.topics)
+}
+
+// Dropped returns the number of publishes discarded by OverflowDropOldest
+func (q *MemorySpillQueue) Dropped() uint64 {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.dropped
+}
+
+func (q *MemorySpillQueue) spaceChan() <-chan struct{} {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.space
+}
+
+// SetSpillQueue makes Publish store messages in q, rather than fail, when they
+// can't be sent to nsqd (i.e. for errors other than those any nsqd would return,
+// like an invalid topic). Stored messages are published in order once nsqd is
+// reachable again (checked every Config.HealthCheckInterval) and, to preserve
+// that order, Publish stores new messages in q for as long as it isn't empty.
+//
+// Messages already in q (e.g. from before a restart) are published too, and
+// draining also starts as soon as the Producer reconnects.
+//
+// Only Publish spills, and a nil error from it no longer means that nsqd has
+// accepted the message. SetSpillQueue must be called before publishing and at
+// most once.
+func (w *Producer) SetSpillQueue(q SpillQueue) {
+	w.spillMtx.Lock()
+	w.spill = q
+	_, _, ok, _ := q.Front()
+	w.spilling = ok
+	w.spillMtx.Unlock()
+
+	go w.spillLoop()
+}
+
+func (w *Producer) publishOrSpill(topic string, body []byte) error {
+	w.spillMtx.Lock()
+	spilling := w.spilling
+	w.spillMtx.Unlock()
+
+	if !spilling {
+		err := w.sendCommand(Publish(topic, body))
+		if err == nil || !isRetryablePublishError(err) {
+			return err
+		}
+		w.log(LogLevelWarning, "(%s) spilling publish to %s - %s", w, topic, err)
+	}
+
+	w.spillMtx.Lock()
+	defer w.spillMtx.Unlock()
+	for {
+		err := w.spill.Append(topic, body)
+		if err == ErrSpillQueueFull {
+			if q, ok := w.spill.(*MemorySpillQueue); ok && q.policy == OverflowBlock {
+				// a Pop (which needs spillMtx) closes the channel
+				space := q.spaceChan()
+				w.spillMtx.Unlock()
+				select {
+				case <-space:
+				case <-w.exitChan:
+					w.spillMtx.Lock()
+					return ErrStopped
+				}
+				w.spillMtx.Lock()
+				continue
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to spill publish - %s", err)
+		}
+		w.spilling = true
+		return nil
+	}
+}
+
+func (w *Producer) spillLoop() {
+	w.guard.Lock()
+	interval := w.config.HealthCheckInterval
+	w.guard.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.drainSpill()
+		case <-w.reconnectChan:
+			w.drainSpill()
+		case <-w.exitChan:
+			return
+		}
+	}
+}
+
+// drainSpill publishes the messages in the spill queue until it is empty
+// or a publish fails
+func (w *Producer) drainSpill() {
+	for atomic.LoadInt32(&w.stopFlag) == 0 {
+		w.spillMtx.Lock()
+		topic, body, ok, err := w.spill.Front()
+		if err != nil {
+			// discard what can't be read (for a DiskSpillQueue, the rest of
+			// the queue), rather than stall every later publish
+			w.log(LogLevelError, "(%s) discarding unreadable spilled publishes - %s", w, err)
+			if err := w.spill.Pop(); err != nil {
+				w.log(LogLevelError, "(%s) failed to remove from spill queue, no longer spilling - %s", w, err)
+				w.spilling = false
+				w.spillMtx.Unlock()
+				return
+			}
+			w.spillMtx.Unlock()
+			continue
+		}
+		if !ok {
+			if w.spilling {
+				w.log(LogLevelInfo, "(%s) spill queue drained", w)
+				w.spilling = false
+			}
+			w.spillMtx.Unlock()
+			return
+		}
+		w.spillMtx.Unlock()
+
+		err = w.sendCommand(Publish(topic, body))
+		if err != nil {
+			if err == ErrStopped || isRetryablePublishError(err) {
+				return
+			}
+			w.log(LogLevelError, "(%s) dropping spilled publish to %s - %s", w, topic, err)
+		}
+
+		w.spillMtx.Lock()
+		err = w.spill.Pop()
+		w.spillMtx.Unlock()
+		if err != nil {
+			w.log(LogLevelError, "failed to remove from spill queue - %s", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package nsq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskSpillQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spill")
+
+	q, err := NewDiskSpillQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, _ := q.Front(); ok {
+		t.Fatal("expected empty queue")
+	}
+	for _, body := range []string{"a", "bc", "def"} {
+		if err := q.Append("topic_"+body, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Pop(); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	// reopening resumes after the publish already removed
+	q, err = NewDiskSpillQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, body := range []string{"bc", "def"} {
+		topic, b, ok, err := q.Front()
+		if err != nil || !ok {
+			t.Fatalf("expected %s, got ok=%v err=%v", body, ok, err)
+		}
+		if topic != "topic_"+body || string(b) != body {
+			t.Fatalf("expected %s, got %s %s", body, topic, b)
+		}
+		if err := q.Pop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Pop(); err == nil {
+		t.Fatal("expected error popping empty queue")
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 0 {
+		t.Fatalf("expected drained queue to be truncated, size %d", fi.Size())
+	}
+
+	// an offset past the end (a crash while emptying the queue) reopens empty
+	q.Close()
+	if err := ioutil.WriteFile(path+".offset", []byte("17"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	q, err = NewDiskSpillQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if _, _, ok, err := q.Front(); ok || err != nil {
+		t.Fatalf("expected empty queue, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestMemorySpillQueue(t *testing.T) {
+	q := NewMemorySpillQueue(2, OverflowError)
+	q.Append("test", []byte("a"))
+	q.Append("test", []byte("b"))
+	if err := q.Append("test", []byte("c")); err != ErrSpillQueueFull {
+		t.Fatalf("expected ErrSpillQueueFull, got %v", err)
+	}
+
+	q = NewMemorySpillQueue(3, OverflowDropOldest)
+	for _, body := range []string{"a", "b", "c", "d"} {
+		if err := q.Append("test", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the front is being published, so the next oldest is dropped
+	if _, body, _, _ := q.Front(); string(body) != "b" {
+		t.Fatalf("expected b, got %s", body)
+	}
+	q.Append("test", []byte("e"))
+	if q.Len() != 3 || q.Dropped() != 2 {
+		t.Fatalf("unexpected len %d (dropped %d)", q.Len(), q.Dropped())
+	}
+
+	var bodies []string
+	for {
+		_, body, ok, err := q.Front()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		bodies = append(bodies, string(body))
+		q.Pop()
+	}
+	if strings.Join(bodies, ",") != "b,d,e" {
+		t.Fatalf("unexpected bodies %v", bodies)
+	}
+}
+
+func TestProducerSpillOverflowBlock(t *testing.T) {
+	config := NewConfig()
+	config.HealthCheckInterval = time.Minute
+	w, _ := NewProducer("127.0.0.1:1", config)
+	w.SetLogger(nullLogger, LogLevelInfo)
+
+	q := NewMemorySpillQueue(1, OverflowBlock)
+	w.SetSpillQueue(q)
+	if err := w.Publish("test", []byte("a")); err != nil {
+		t.Fatalf("expected publish to be spilled, got %s", err)
+	}
+
+	errChan := make(chan error, 2)
+	go func() {
+		errChan <- w.Publish("test", []byte("b"))
+	}()
+	select {
+	case err := <-errChan:
+		t.Fatalf("expected publish to block on a full queue, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.spillMtx.Lock()
+	q.Pop()
+	w.spillMtx.Unlock()
+	if err := <-errChan; err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if _, body, _, _ := q.Front(); string(body) != "b" {
+		t.Fatalf("expected b, got %s", body)
+	}
+
+	go func() {
+		errChan <- w.Publish("test", []byte("c"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	w.Stop()
+	if err := <-errChan; err != ErrStopped {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+}
+
+func TestDiskSpillQueueCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spill")
+
+	q, err := NewDiskSpillQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Append("test", []byte("a"))
+	q.Append("test", []byte("b"))
+	size := q.size
+	q.Close()
+
+	// a publish torn by a crash mid-Append is truncated on open
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 4, 't', 'e'})
+	f.Close()
+	q, err = NewDiskSpillQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.size != size {
+		t.Fatalf("expected size %d, got %d", size, q.size)
+	}
+	if err := q.Append("test", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unreadable publish is skipped by the Producer, with the rest of the queue
+	f, err = os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 0)
+	f.Close()
+	_, _, _, err = q.Front()
+	if err == nil {
+		t.Fatal("expected error reading corrupt front")
+	}
+	if expected := fmt.Sprintf("%d bytes unreadable", q.size); !strings.Contains(err.Error(), expected) {
+		t.Fatalf("expected error %q to contain %q", err, expected)
+	}
+
+	config := NewConfig()
+	config.HealthCheckInterval = time.Minute
+	w, _ := NewProducer("127.0.0.1:1", config)
+	w.SetLogger(nullLogger, LogLevelInfo)
+	defer w.Stop()
+	w.SetSpillQueue(q)
+	w.drainSpill()
+
+	w.spillMtx.Lock()
+	defer w.spillMtx.Unlock()
+	if w.spilling {
+		t.Fatal("expected the Producer to stop spilling")
+	}
+	if _, _, ok, err := q.Front(); ok || err != nil {
+		t.Fatalf("expected empty queue, got ok=%v err=%v", ok, err)
+	}
+}
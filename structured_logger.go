@@ -0,0 +1,134 @@
+package nsq
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StructuredLogger is a logger receiving the context of each log line as
+// key/value pairs (see SetStructuredLogger), rather than formatted into it:
+//
+//   - "consumer", "topic" and "channel" for the lines of a Consumer (and its
+//     connections), "producer" for those of a Producer
+//   - "addr", the address of the nsqd a line is about
+//   - "msg_id", the ID of the message a line is about
+//
+// NewSlogLogger adapts a *slog.Logger (with Go 1.21+) and NewLeveledLogger
+// a LeveledLogger.
+type StructuredLogger interface {
+	Log(lvl LogLevel, msg string, keyvals ...interface{})
+}
+
+// LeveledLogger is a logger with a method per level, taking key/value pairs
+// (e.g. a *slog.Logger), see NewLeveledLogger
+type LeveledLogger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// NewLeveledLogger returns a StructuredLogger logging with the method of l
+// for the level of each line (see SetStructuredLogger), e.g. to only log the
+// errors of a Producer or Consumer (rather than their reconnections) with:
+//
+//	consumer.SetStructuredLogger(nsq.NewLeveledLogger(l), nsq.LogLevelError)
+func NewLeveledLogger(l LeveledLogger) StructuredLogger {
+	return leveledLogger{l}
+}
+
+type leveledLogger struct {
+	l LeveledLogger
+}
+
+func (l leveledLogger) Log(lvl LogLevel, msg string, keyvals ...interface{}) {
+	switch lvl {
+	case LogLevelDebug:
+		l.l.Debug(msg, keyvals...)
+	case LogLevelInfo:
+		l.l.Info(msg, keyvals...)
+	case LogLevelWarning:
+		l.l.Warn(msg, keyvals...)
+	default:
+		l.l.Error(msg, keyvals...)
+	}
+}
+
+// addrLogPrefix prefixes the log lines about an nsqd, formatted with its address
+const addrLogPrefix = "(%s) "
+
+// logFields formats a log line for a StructuredLogger, lifting the nsqd
+// address (see addrLogPrefix) and message IDs of its args into keyvals
+func logFields(keyvals []interface{}, line string, args []interface{}) (string, []interface{}) {
+	fields := make([]interface{}, len(keyvals), len(keyvals)+4)
+	copy(fields, keyvals)
+	if strings.HasPrefix(line, addrLogPrefix) && len(args) > 0 {
+		fields = append(fields, "addr", fmt.Sprint(args[0]))
+		line = line[len(addrLogPrefix):]
+		args = args[1:]
+	}
+	for _, arg := range args {
+		if id, ok := arg.(MessageID); ok {
+			fields = append(fields, "msg_id", string(id[:]))
+		}
+	}
+	return fmt.Sprintf(line, args...), fields
+}
+
+// SetStructuredLogger assigns a StructuredLogger to use (and the level), in
+// place of the loggers assigned with SetLogger, to it and its connections
+func (r *Consumer) SetStructuredLogger(l StructuredLogger, lvl LogLevel) {
+	r.logGuard.Lock()
+	defer r.logGuard.Unlock()
+
+	r.structuredLogger = l
+	r.logLvl = lvl
+}
+
+func (r *Consumer) getStructuredLogger() (StructuredLogger, LogLevel) {
+	r.logGuard.RLock()
+	defer r.logGuard.RUnlock()
+
+	return r.structuredLogger, r.logLvl
+}
+
+// logKeyvals are the key/value pairs of the lines of the Consumer
+func (r *Consumer) logKeyvals() []interface{} {
+	return []interface{}{"consumer", r.id, "topic", r.topic, "channel", r.channel}
+}
+
+// SetStructuredLogger assigns a StructuredLogger to use (and the level), in
+// place of the loggers assigned with SetLogger, to it and its connections
+func (w *Producer) SetStructuredLogger(l StructuredLogger, lvl LogLevel) {
+	w.logGuard.Lock()
+	defer w.logGuard.Unlock()
+
+	w.structuredLogger = l
+	w.logLvl = lvl
+}
+
+func (w *Producer) getStructuredLogger() (StructuredLogger, LogLevel) {
+	w.logGuard.RLock()
+	defer w.logGuard.RUnlock()
+
+	return w.structuredLogger, w.logLvl
+}
+
+// SetStructuredLogger assigns a StructuredLogger to use (and the level), in
+// place of the loggers assigned with SetLogger, logging keyvals (e.g. those of
+// the Consumer it belongs to) and the "addr" of the connection with each line
+func (c *Conn) SetStructuredLogger(l StructuredLogger, lvl LogLevel, keyvals ...interface{}) {
+	c.logGuard.Lock()
+	defer c.logGuard.Unlock()
+
+	c.structuredLogger = l
+	c.logKeyvals = keyvals
+	c.logLvl = lvl
+}
+
+func (c *Conn) getStructuredLogger() (StructuredLogger, LogLevel, []interface{}) {
+	c.logGuard.RLock()
+	defer c.logGuard.RUnlock()
+
+	return c.structuredLogger, c.logLvl, c.logKeyvals
+}
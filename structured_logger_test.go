@@ -0,0 +1,46 @@
+package nsq
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type recordingLeveledLogger struct {
+	lines []string
+}
+
+func (l *recordingLeveledLogger) record(lvl string, msg string, keyvals []interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf("%s %s %v", lvl, msg, keyvals))
+}
+
+func (l *recordingLeveledLogger) Debug(msg string, keyvals ...interface{}) {
+	l.record("debug", msg, keyvals)
+}
+func (l *recordingLeveledLogger) Info(msg string, keyvals ...interface{}) {
+	l.record("info", msg, keyvals)
+}
+func (l *recordingLeveledLogger) Warn(msg string, keyvals ...interface{}) {
+	l.record("warn", msg, keyvals)
+}
+func (l *recordingLeveledLogger) Error(msg string, keyvals ...interface{}) {
+	l.record("error", msg, keyvals)
+}
+
+func TestLeveledLogger(t *testing.T) {
+	l := &recordingLeveledLogger{}
+	w, _ := NewProducer("127.0.0.1:4150", NewConfig())
+	w.SetStructuredLogger(NewLeveledLogger(l), LogLevelWarning)
+
+	w.log(LogLevelInfo, "(%s) reconnecting to nsqd", "127.0.0.1:4150")
+	w.log(LogLevelWarning, "timed out waiting for %d pending publishes", 2)
+	w.log(LogLevelError, "(%s) error connecting to nsqd - %s", "127.0.0.1:4150", "refused")
+
+	expected := []string{
+		fmt.Sprintf("warn timed out waiting for 2 pending publishes [producer %d]", w.id),
+		fmt.Sprintf("error error connecting to nsqd - refused [producer %d addr 127.0.0.1:4150]", w.id),
+	}
+	if strings.Join(l.lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected lines %q", l.lines)
+	}
+}
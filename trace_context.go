@@ -0,0 +1,134 @@
+package nsq
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// W3C trace context envelope headers (see https://www.w3.org/TR/trace-context/)
+const (
+	// HeaderTraceparent identifies the span a message was published from
+	HeaderTraceparent = "traceparent"
+	// HeaderTracestate carries vendor-specific trace data along with it
+	HeaderTracestate = "tracestate"
+)
+
+// TraceContext is a W3C trace context, propagated from publishers to the
+// handlers of the messages they publish in the envelope headers
+// HeaderTraceparent and HeaderTracestate
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	// the tracestate, passed along unchanged
+	State string
+}
+
+// ParseTraceparent parses a traceparent header (e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01") along with the
+// tracestate (if any)
+func ParseTraceparent(traceparent string, tracestate string) (TraceContext, error) {
+	var tc TraceContext
+	parts := strings.Split(traceparent, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tc, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	// versions other than 00 may append fields, but not change these
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return tc, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+
+	var flags [1]byte
+	for _, f := range []struct {
+		dst []byte
+		src string
+	}{{tc.TraceID[:], parts[1]}, {tc.SpanID[:], parts[2]}, {flags[:], parts[3]}} {
+		if strings.ToLower(f.src) != f.src {
+			return tc, fmt.Errorf("invalid traceparent %q", traceparent)
+		}
+		if _, err := hex.Decode(f.dst, []byte(f.src)); err != nil {
+			return tc, fmt.Errorf("invalid traceparent %q - %s", traceparent, err)
+		}
+	}
+	tc.Flags = flags[0]
+	tc.State = tracestate
+	if !tc.IsValid() {
+		return tc, errors.New("invalid traceparent, the trace and span IDs must not be zero")
+	}
+	return tc, nil
+}
+
+// IsValid reports whether both the trace ID and the span ID are set
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+// IsSampled reports whether the sampled flag is set
+func (tc TraceContext) IsSampled() bool {
+	return tc.Flags&0x01 == 0x01
+}
+
+// Traceparent returns the traceparent header of the trace context
+func (tc TraceContext) Traceparent() string {
+	return fmt.Sprintf("00-%x-%x-%02x", tc.TraceID, tc.SpanID, tc.Flags)
+}
+
+type traceContextKey struct{}
+
+// ContextWithTraceContext returns a copy of ctx carrying tc, which messages
+// published with it are stamped with (see Producer.PublishWithHeadersContext)
+func ContextWithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceContextFromContext returns the trace context carried by ctx, e.g. the
+// one of the message passed to a HandlerWithContext along with it
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok && tc.IsValid()
+}
+
+// InjectTraceContext sets the HeaderTraceparent and HeaderTracestate headers
+// from the trace context carried by ctx, if any
+func InjectTraceContext(ctx context.Context, headers map[string]string) {
+	tc, ok := TraceContextFromContext(ctx)
+	if !ok {
+		return
+	}
+	headers[HeaderTraceparent] = tc.Traceparent()
+	if tc.State != "" {
+		headers[HeaderTracestate] = tc.State
+	}
+}
+
+// TraceContext returns the trace context the message was published with,
+// from its Headers (see Consumer.SetEnvelopeCodec), ok is false when it has
+// none or it's invalid
+func (m *Message) TraceContext() (TraceContext, bool) {
+	traceparent, ok := m.Headers[HeaderTraceparent]
+	if !ok {
+		return TraceContext{}, false
+	}
+	tc, err := ParseTraceparent(traceparent, m.Headers[HeaderTracestate])
+	return tc, err == nil
+}
+
+// PublishWithHeadersContext is like PublishWithHeaders but stamps the envelope
+// with the trace context carried by ctx, if any (see ContextWithTraceContext),
+// and gives up waiting for the response when ctx is done (see PublishContext)
+func (w *Producer) PublishWithHeadersContext(ctx context.Context, topic string, headers map[string]string, body []byte) error {
+	stamped := make(map[string]string, len(headers)+2)
+	for k, v := range headers {
+		stamped[k] = v
+	}
+	InjectTraceContext(ctx, stamped)
+
+	data, err := EncodeEnvelope(stamped, body)
+	if err != nil {
+		return err
+	}
+	return w.PublishContext(ctx, topic, data)
+}
@@ -0,0 +1,53 @@
+package nsq
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// TypedHandler is a Handler for messages whose bodies are values of type T
+// (e.g. published with a Publisher), decoding them before they are handled
+type TypedHandler[T any] struct {
+	handle    func(v T, message *Message) error
+	unmarshal func(data []byte, v *T) error
+	poison    func(message *Message, err error) error
+}
+
+// NewTypedHandler returns a TypedHandler that decodes message bodies with
+// unmarshal (json.Unmarshal when nil) and calls handle with the decoded value
+// and the message
+func NewTypedHandler[T any](handle func(v T, message *Message) error, unmarshal func(data []byte, v *T) error) *TypedHandler[T] {
+	if unmarshal == nil {
+		unmarshal = func(data []byte, v *T) error {
+			return json.Unmarshal(data, v)
+		}
+	}
+	return &TypedHandler[T]{
+		handle:    handle,
+		unmarshal: unmarshal,
+	}
+}
+
+// SetPoisonHandler registers f to be called, instead of handle, with the
+// messages whose body can't be decoded and the decoding error. Such a message
+// is FINished when f returns nil and requeued otherwise.
+//
+// Without a poison handler the decoding error is returned, so that the
+// message is requeued until it exceeds Config.MaxAttempts.
+//
+// It must be called before the TypedHandler is added to a Consumer.
+func (h *TypedHandler[T]) SetPoisonHandler(f func(message *Message, err error) error) {
+	h.poison = f
+}
+
+// HandleMessage implements the Handler interface
+func (h *TypedHandler[T]) HandleMessage(m *Message) error {
+	var v T
+	if err := h.unmarshal(m.Body, &v); err != nil {
+		if h.poison != nil {
+			return h.poison(m, err)
+		}
+		return fmt.Errorf("failed to decode msg %s - %s", m.ID, err)
+	}
+	return h.handle(v, m)
+}
@@ -0,0 +1,96 @@
+package nsq
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+var errWriterClosed = errors.New("writer closed")
+
+// Writer returns an io.WriteCloser that synchronously publishes the data of
+// each Write as a message to the specified topic
+//
+// Closing it does not stop the Producer.
+func (w *Producer) Writer(topic string) io.WriteCloser {
+	return &producerWriter{producer: w, topic: topic}
+}
+
+// LineWriter returns an io.WriteCloser that synchronously publishes each
+// newline-delimited line written to it (without the newline) as a message to
+// the specified topic. The lines completed by a single Write are published
+// together with MultiPublish, and an incomplete line is buffered until it is
+// completed by a later Write or the writer is closed. Empty lines are skipped.
+//
+// Closing it does not stop the Producer.
+func (w *Producer) LineWriter(topic string) io.WriteCloser {
+	return &producerWriter{producer: w, topic: topic, lines: true}
+}
+
+type producerWriter struct {
+	producer *Producer
+	topic    string
+	lines    bool
+
+	mtx    sync.Mutex
+	buf    []byte
+	closed bool
+}
+
+func (pw *producerWriter) Write(p []byte) (int, error) {
+	pw.mtx.Lock()
+	defer pw.mtx.Unlock()
+
+	if pw.closed {
+		return 0, errWriterClosed
+	}
+	if !pw.lines {
+		// p must not be retained
+		body := make([]byte, len(p))
+		copy(body, p)
+		if err := pw.producer.Publish(pw.topic, body); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	pw.buf = append(pw.buf, p...)
+	i := bytes.LastIndexByte(pw.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+
+	var bodies [][]byte
+	for _, line := range bytes.Split(pw.buf[:i], []byte("\n")) {
+		if len(line) > 0 {
+			bodies = append(bodies, line)
+		}
+	}
+	if len(bodies) > 0 {
+		if err := pw.producer.MultiPublish(pw.topic, bodies); err != nil {
+			// drop what was just written from the buffer
+			pw.buf = pw.buf[:len(pw.buf)-len(p)]
+			return 0, err
+		}
+	}
+	pw.buf = append([]byte(nil), pw.buf[i+1:]...)
+	return len(p), nil
+}
+
+// Close publishes any incomplete line
+func (pw *producerWriter) Close() error {
+	pw.mtx.Lock()
+	defer pw.mtx.Unlock()
+
+	if pw.closed {
+		return nil
+	}
+	pw.closed = true
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	body := pw.buf
+	pw.buf = nil
+	return pw.producer.Publish(pw.topic, body)
+}